@@ -4,16 +4,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
@@ -26,8 +23,6 @@ import (
 )
 var accidentWorker *AccidentWorker
 
-var categories map[int]string
-
 type AccidentWorker struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -38,98 +33,120 @@ type AccidentWorker struct {
 	tsfiles chan *AccidentSegment
 
 	streams sync.Map
+
+	// The policy to confirm and end accident.
+	policy *AccidentPolicy
+	// The trackers to confirm accident, key is accidentKey with category, value is *AccidentTracker.
+	trackers sync.Map
+	// The latest segments for pre-roll, key is accidentKey without category, value is *SegmentRing.
+	rings sync.Map
+}
+
+// accidentKey identify the trackers and rings by the publish generation of stream, so the teardown of the
+// previous publish never drops the ones of the next publish.
+type accidentKey struct {
+	stream     string
+	generation uint64
+	category   int
 }
 type AccidentSegmentMsg struct {
+	Category int
+	// The detection of segment, nil for pre-roll or post-roll.
 	DetectResult *ProcessDetectResult
 	TsFile *TsFile
 	inputStream *SrsStream
+	// Whether the segment is pre-roll, which is allowed to start an accident without detection.
+	Preroll bool
+	// Whether to end the accident, without segment.
+	End bool
+	// The frame of detection, to update the best snapshot.
+	Image *AccidentImage
+	// The frame which triggers the accident, only for the first segment of accident.
+	Snapshot *AccidentImage
+}
+func (v *AccidentSegmentMsg) String() string {
+	return fmt.Sprintf("category=%v, end=%v, preroll=%v, result(%v), ts(%v)",
+		v.Category, v.End, v.Preroll, v.DetectResult, v.TsFile,
+	)
 }
 type AccidentSegment struct {
-	DetectResult *ProcessDetectResult
-	TsFile *TsFile
-	inputStream *SrsStream
+	Category     int                  `json:"category,omitempty"`
+	DetectResult *ProcessDetectResult `json:"result,omitempty"`
+	TsFile       *TsFile              `json:"tsfile,omitempty"`
+	InputStream  *SrsStream           `json:"stream,omitempty"`
+	Preroll      bool                 `json:"preroll,omitempty"`
+	End          bool                 `json:"end,omitempty"`
+	// The copied frame of detection, removed after served.
+	Image *AccidentImage `json:"image,omitempty"`
+	// The copied frame which triggers the accident, removed after snapshot generated.
+	Snapshot *AccidentImage `json:"snapshot,omitempty"`
 }
 func (v *AccidentSegment) String() string {
-	return fmt.Sprintf("msg(%v), ts(%v)", v.DetectResult.String(), v.TsFile.String())
+	return fmt.Sprintf("category=%v, end=%v, preroll=%v, result(%v), ts(%v)",
+		v.Category, v.End, v.Preroll, v.DetectResult, v.TsFile,
+	)
 }
 func NewAccidentWorker() *AccidentWorker {
-	categories = map[int]string{
-		2: "NON_SAFETY_VEST",
-		1: "NON_SAFETY_HELMET",
-		7: "FALL",
-		8: "USE_PHONE_WHILE_WORKING",
-		9: "SOS_REQUEST",
-	}
-
 	v := &AccidentWorker{
 		// Message on_hls.
 		tsfiles: make(chan *AccidentSegment, 1024),
 		msgs: make(chan *AccidentSegmentMsg, 1024),
+		// The policy from env.
+		policy: NewAccidentPolicy(),
 	}
 	return v
 }
 func (v *AccidentWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
-	mp4Handler := func(w http.ResponseWriter, r *http.Request) error {
-		// Format is :uuid/index.mp4
-		filename := r.URL.Path[len("/accident/hls/"):]
-		uuid := path.Dir(filename)
-		if len(uuid) == 0 {
-			return errors.Errorf("invalid uuid %v from %v of %v", uuid, filename, r.URL.Path)
-		}
-
-		mp4FilePath := path.Join("accident", uuid, "index.mp4")
-		stats, err := os.Stat(mp4FilePath)
-		if err != nil {
-			return errors.Wrapf(err, "no mp4 file %v", mp4FilePath)
-		}
-
-		mp4File, err := os.Open(mp4FilePath)
-		if err != nil {
-			return errors.Wrapf(err, "open file %v", mp4FilePath)
-		}
-		defer mp4File.Close()
-
-		// No range request.
-		rangeHeader := r.Header.Get("Range")
-		if rangeHeader == "" {
-			w.Header().Set("Content-Type", "video/mp4")
-			io.Copy(w, mp4File)
-			logger.T(ctx, "accident serve full mp4=%v", mp4FilePath)
-			return nil
-		}
-
-		// Support range request.
-		var start, end int64
-		fmt.Sscanf(rangeHeader, "bytes=%u-%u", &start, &end)
-		if end == 0 {
-			end = stats.Size() - 1
-		}
-
-		if _, err := mp4File.Seek(start, io.SeekStart); err != nil {
-			return errors.Wrapf(err, "seek to %v of %v", start, mp4FilePath)
-		}
-
-		w.Header().Set("ccept-Ranges", "bytes")
-		w.Header().Set("Content-Length", fmt.Sprintf("%v", end+1-start))
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, stats.Size()))
-
-		w.WriteHeader(http.StatusPartialContent)
-		w.Header().Set("Content-Type", "video/mp4")
-		io.CopyN(w, mp4File, end+1-start)
-
-		logger.Tf(ctx, "accident serve partial ok, uuid=%v, mp4=%v", uuid, mp4FilePath)
-		return nil
+	if err := v.handleArtifacts(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle artifacts")
 	}
 
 	ep := "/accident/hls/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
 		if err := func() error {
-			if strings.HasSuffix(r.URL.Path, ".mp4") {
-				return mp4Handler(w, r)
+			// Format is :uuid/:name, such as :uuid/index.mp4, :uuid/index.m3u8, :uuid/:tsid.ts or
+			// :uuid/snapshot.jpg
+			accidentUUID, name, err := parseMediaPath(r.URL.Path, ep)
+			if err != nil {
+				return errors.Wrapf(err, "parse %v", r.URL.Path)
+			}
+			if _, err := uuid.Parse(accidentUUID); err != nil {
+				return errors.Wrapf(err, "invalid uuid %v of %v", accidentUUID, r.URL.Path)
+			}
+
+			if err := verifyPlayback(r, fmt.Sprintf("%v%v/", ep, accidentUUID)); err != nil {
+				return errors.Wrapf(err, "verify playback")
 			}
 
-			return errors.Errorf("invalid handler for %v", r.URL.Path)
+			// The segments in playlist should carry the token, so rewrite the playlist.
+			file := path.Join("accident", accidentUUID, name)
+			if path.Ext(name) == ".m3u8" && playbackQuery(r) != "" {
+				return servePlaybackPlaylist(ctx, w, r, file)
+			}
+
+			// The ts file is in segment store, so resolve it by the tsid of artifact.
+			if path.Ext(name) == ".ts" {
+				artifact, err := queryArtifact(ctx, accidentUUID)
+				if err != nil {
+					return errors.Wrapf(err, "query artifact %v", accidentUUID)
+				}
+
+				file = ""
+				if artifact != nil {
+					for _, tsFile := range artifact.Files {
+						if fmt.Sprintf("%v.ts", tsFile.TsID) == name {
+							file = tsFile.Key
+							break
+						}
+					}
+				}
+				if file == "" {
+					http.NotFound(w, r)
+					return nil
+				}
+			}
+			return serveMediaFile(ctx, w, r, file)
 		}(); err != nil {
 			ohttp.WriteError(ctx, w, r, err)
 		}
@@ -137,36 +154,169 @@ func (v *AccidentWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 
 	return nil
 }
-func (v *AccidentWorker) OnAccidentAdded(ctx context.Context, result *ProcessDetectResult, _TsFile *TsFile, stream *SrsStream) error {
+func (v *AccidentWorker) OnAccidentAdded(ctx context.Context, category int, result *ProcessDetectResult, _TsFile *TsFile, stream *SrsStream, preroll bool, image, snapshot *AccidentImage) error {
 	select {
 	case <-ctx.Done():
 	case v.msgs <- &AccidentSegmentMsg{
+		Category: category,
 		DetectResult: result,
 		TsFile: _TsFile,
 		inputStream: stream,
+		Preroll: preroll,
+		Image: image,
+		Snapshot: snapshot,
 	}:
 	}
 
 	return nil
 }
-func (v *AccidentWorker) OnAccidentAddedImpl(ctx context.Context, msg *AccidentSegmentMsg) error {
-	// Copy the ts file to temporary cache dir.
-	tsid := uuid.NewString()
-	tsfile := path.Join("accident", fmt.Sprintf("%v.ts", tsid))
 
-	logger.Tf(ctx, "On AccidentAdded %v", msg.TsFile.File)
-	// Always use execFile when params contains user inputs, see https://auth0.com/blog/preventing-command-injection-attacks-in-node-js-apps/
-	// Note that should never use fs.copyFileSync(file, tsfile, fs.constants.COPYFILE_FICLONE_FORCE) which fails in macOS.
-	if err := exec.CommandContext(ctx, "cp", "-f", msg.TsFile.File, tsfile).Run(); err != nil {
-		return errors.Wrapf(err, "copy file %v to %v", msg.TsFile.File, tsfile)
+// OnAccidentEnded end the accident after all segments are appended, because the message is in order.
+func (v *AccidentWorker) OnAccidentEnded(ctx context.Context, category int, stream *SrsStream) error {
+	select {
+	case <-ctx.Done():
+	case v.msgs <- &AccidentSegmentMsg{Category: category, inputStream: stream, End: true}:
+	}
+
+	return nil
+}
+// OnDetectSegment feed the detections of segment to trackers, and raise the accident only when confirmed by
+// enough detections, to avoid false positive.
+func (v *AccidentWorker) OnDetectSegment(ctx context.Context, segment *ProcessSegment, stream *SrsStream) error {
+	// Keep the latest segments for pre-roll, and some more for the confirmation window.
+	generation := segment.Msg.generation
+	obj, _ := v.rings.LoadOrStore(accidentKey{stream: stream.Stream, generation: generation},
+		NewSegmentRing(v.policy.Preroll+60))
+	ring := obj.(*SegmentRing)
+	if err := ring.Push(ctx, segment.TsFile); err != nil {
+		return errors.Wrapf(err, "push %v", segment.TsFile.String())
+	}
+
+	for _, category := range categoryRegistry.Categories() {
+		if !category.Enabled {
+			continue
+		}
+		policy := categoryRegistry.Policy(category)
+
+		// Use the detection with max score in segment.
+		var best *ProcessDetectResult
+		for _, box := range segment.BoundingBox {
+			if !category.Match(policy, &box) {
+				continue
+			}
+			if best == nil || box.Score > best.Score {
+				best = &box
+			}
+		}
+
+		key := accidentKey{stream: stream.Stream, generation: generation, category: category.ID}
+		obj, _ := v.trackers.LoadOrStore(key, NewAccidentTracker(stream.Stream, category.ID))
+		tracker := obj.(*AccidentTracker)
+
+		event := tracker.OnSegment(ctx, policy, segment.TsFile, best, newAccidentImage(segment, best))
+		if event.Ended {
+			if err := v.OnAccidentEnded(ctx, category.ID, stream); err != nil {
+				return errors.Wrapf(err, "end accident %v", category.ID)
+			}
+		}
+
+		// The last hit triggers the accident, whose frame is the snapshot, sent with the first segment to
+		// generate the snapshot before callback.
+		var snapshot *AccidentImage
+		if event.Confirmed && len(event.Hits) > 0 {
+			snapshot = event.Hits[len(event.Hits)-1].Image
+		}
+
+		// Prepend the pre-roll segments before the first detection.
+		if event.Confirmed && len(event.Hits) > 0 {
+			for _, tsFile := range ring.Before(event.Hits[0].TsFile, policy.Preroll) {
+				if err := v.OnAccidentAdded(ctx, category.ID, nil, tsFile, stream, true, nil, snapshot); err != nil {
+					return errors.Wrapf(err, "add pre-roll %v", tsFile.String())
+				}
+				snapshot = nil
+			}
+		}
+
+		for _, hit := range event.Hits {
+			if err := v.OnAccidentAdded(ctx, category.ID, hit.DetectResult, hit.TsFile, stream, false, hit.Image, snapshot); err != nil {
+				return errors.Wrapf(err, "add accident %v", hit.TsFile.String())
+			}
+			logger.Tf(ctx, "boundingbox category %v %v, result %v", category.ID, stream.String(), hit.DetectResult)
+			snapshot = nil
+		}
 	}
 
-	// Get the file size.
+	return nil
+}
+
+// OnStreamUnpublished end the active accidents of stream, and drop the trackers and pre-roll ring, because
+// the segments of the next publish are not continuous with this one. Only the trackers and rings created in
+// the generation or before are dropped, because it's called asynchronously, so the stream might have been
+// published again.
+func (v *AccidentWorker) OnStreamUnpublished(ctx context.Context, stream *SrsStream, generation uint64) error {
+	outdated := func(key interface{}) bool {
+		k := key.(accidentKey)
+		return k.stream == stream.Stream && k.generation <= generation
+	}
+
+	v.rings.Range(func(key, value interface{}) bool {
+		if !outdated(key) {
+			return true
+		}
+		if _, ok := v.rings.LoadAndDelete(key); ok {
+			if err := value.(*SegmentRing).Close(ctx); err != nil {
+				logger.Wf(ctx, "ignore close ring of %v err %+v", stream.String(), err)
+			}
+		}
+		return true
+	})
+
+	var trackers []*AccidentTracker
+	v.trackers.Range(func(key, value interface{}) bool {
+		if outdated(key) {
+			trackers = append(trackers, value.(*AccidentTracker))
+			v.trackers.Delete(key)
+		}
+		return true
+	})
+
+	for _, tracker := range trackers {
+		if !tracker.Reset() {
+			continue
+		}
+		if err := v.OnAccidentEnded(ctx, tracker.Category, stream); err != nil {
+			return errors.Wrapf(err, "end accident %v", tracker.String())
+		}
+		logger.Tf(ctx, "accident end by unpublish, %v", tracker.String())
+	}
+	return nil
+}
+
+func (v *AccidentWorker) OnAccidentAddedImpl(ctx context.Context, msg *AccidentSegmentMsg) error {
+	// Forward the end message in order, without any file.
+	if msg.End {
+		select {
+		case <-ctx.Done():
+		case v.tsfiles <- &AccidentSegment{Category: msg.Category, InputStream: msg.inputStream, End: true}:
+		}
+		return nil
+	}
+
+	// Get the file size, before acquiring the reference which must be released on error.
 	stats, err := os.Stat(msg.TsFile.File)
 	if err != nil {
 		return errors.Wrapf(err, "stat file %v", msg.TsFile.File)
 	}
 
+	// Hold the ts file in segment store, the reference is held by the artifact after served.
+	tsid := uuid.NewString()
+
+	logger.Tf(ctx, "On AccidentAdded %v", msg.TsFile.File)
+	tsfile, err := segmentStore.Acquire(ctx, msg.TsFile.File)
+	if err != nil {
+		return errors.Wrapf(err, "acquire file %v", msg.TsFile.File)
+	}
+
 	// Create a local ts file object.
 	tsFile := &TsFile{
 		TsID:     tsid,
@@ -177,12 +327,28 @@ func (v *AccidentWorker) OnAccidentAddedImpl(ctx context.Context, msg *AccidentS
 		File:     tsfile,
 	}
 	logger.Tf(ctx, "TsFile generated %v", tsFile.File)
+
+	// Copy the frames, which are disposed with segment. Ignore if failed, because the video is more important.
+	image, err := copyAccidentImage(ctx, msg.Image)
+	if err != nil {
+		logger.Wf(ctx, "ignore image of %v err %+v", msg.String(), err)
+	}
+	snapshot, err := copyAccidentImage(ctx, msg.Snapshot)
+	if err != nil {
+		logger.Wf(ctx, "ignore snapshot of %v err %+v", msg.String(), err)
+	}
+
 	select {
 	case <-ctx.Done():
+		segmentStore.Release(ctx, tsFile.File)
 	case v.tsfiles <- &AccidentSegment {
+		Category: msg.Category,
 		TsFile: tsFile,
 		DetectResult: msg.DetectResult,
-		inputStream: msg.inputStream,
+		InputStream: msg.inputStream,
+		Preroll: msg.Preroll,
+		Image: image,
+		Snapshot: snapshot,
 	}:
 	}
 
@@ -201,12 +367,84 @@ func (v *AccidentWorker) QueryTask(uuid string) *AccidentM3u8Stream {
 	return target
 }
 
+// OnAccidentId bind the accident id responded by API server, to the working object and artifact.
+func (v *AccidentWorker) OnAccidentId(ctx context.Context, accidentUUID string, accidentId int) error {
+	if task := v.QueryTask(accidentUUID); task != nil {
+		task.lock.Lock()
+		task.AccidentId = accidentId
+		if task.artifact != nil {
+			task.artifact.AccidentId = accidentId
+		}
+		task.lock.Unlock()
+
+		if err := task.saveObject(ctx); err != nil {
+			return errors.Wrapf(err, "save object %v", task.String())
+		}
+		if task.artifact != nil {
+			if err := task.saveArtifact(ctx, task.artifact); err != nil {
+				return errors.Wrapf(err, "save artifact %v", task.artifact.String())
+			}
+		}
+		return nil
+	}
+
+	// The accident is done, only update the artifact.
+	artifact, err := queryArtifact(ctx, accidentUUID)
+	if err != nil {
+		return errors.Wrapf(err, "query artifact %v", accidentUUID)
+	} else if artifact == nil {
+		return nil
+	}
+
+	artifact.AccidentId = accidentId
+	if b, err := json.Marshal(artifact); err != nil {
+		return errors.Wrapf(err, "marshal %v", artifact.String())
+	} else if err = rdb.HSet(ctx, SRS_ACCIDENT_M3U8_ARTIFACT, accidentUUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_ACCIDENT_M3U8_ARTIFACT, accidentUUID, string(b))
+	}
+	return nil
+}
+
+// files return the files used by pre-roll rings and working accidents, which should never be removed.
+func (v *AccidentWorker) files() []string {
+	var files []string
+	v.rings.Range(func(key, value interface{}) bool {
+		files = append(files, value.(*SegmentRing).Files()...)
+		return true
+	})
+	v.streams.Range(func(key, value interface{}) bool {
+		files = append(files, value.(*AccidentM3u8Stream).files()...)
+		return true
+	})
+	return files
+}
+
+// uuids return the uuid of working accidents.
+func (v *AccidentWorker) uuids() []string {
+	var uuids []string
+	v.streams.Range(func(key, value interface{}) bool {
+		uuids = append(uuids, value.(*AccidentM3u8Stream).UUID)
+		return true
+	})
+	return uuids
+}
+
 func (v *AccidentWorker) Close() error {
 	if v.cancel != nil {
 		v.cancel()
 	}
 
 	v.wg.Wait()
+
+	// Release the pre-roll segments, which are never used after closed.
+	ctx := logger.WithContext(context.Background())
+	v.rings.Range(func(key, value interface{}) bool {
+		v.rings.Delete(key)
+		if err := value.(*SegmentRing).Close(ctx); err != nil {
+			logger.Wf(ctx, "ignore close ring of %v err %+v", key, err)
+		}
+		return true
+	})
 	return nil
 }
 
@@ -219,22 +457,70 @@ func (v *AccidentWorker) Start(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "Accident: start a worker")
 
+	// Restore the working objects, before consuming any message.
+	if err := v.restoreStreams(ctx); err != nil {
+		return errors.Wrapf(err, "restore streams")
+	}
+
 	// Create M3u8 object from message.
 	buildM3u8Object := func(ctx context.Context, msg *AccidentSegment) error {
 		// If glob filters are empty, ignore it, and record all streams.
 
+		M3u8URL := fmt.Sprintf("%v/%v",msg.InputStream.Stream,msg.Category)
+
+		// Expire the object when accident is ended.
+		if msg.End {
+			if obj, ok := v.streams.Load(M3u8URL); ok {
+				m3u8LocalObj := obj.(*AccidentM3u8Stream)
+				m3u8LocalObj.expire()
+				if err := m3u8LocalObj.saveObject(ctx); err != nil {
+					return errors.Wrapf(err, "save %v", m3u8LocalObj.String())
+				}
+				logger.Tf(ctx, "accident end %v", m3u8LocalObj.String())
+			}
+			return nil
+		}
+
+		// Retire the object which is ended or expired, but not finished yet, so the accident confirmed again
+		// starts a new object.
+		if obj, ok := v.streams.Load(M3u8URL); ok {
+			if m3u8LocalObj := obj.(*AccidentM3u8Stream); m3u8LocalObj.expired(ctx) {
+				if err := m3u8LocalObj.retire(ctx); err != nil {
+					return errors.Wrapf(err, "retire %v", m3u8LocalObj.String())
+				}
+				logger.Tf(ctx, "accident retire %v", m3u8LocalObj.String())
+			}
+		}
+
+		// Never start an accident by the post-roll segment, when the accident is already finished.
+		if _, ok := v.streams.Load(M3u8URL); !ok && msg.DetectResult == nil && !msg.Preroll {
+			segmentStore.Release(ctx, msg.TsFile.File)
+			logger.Tf(ctx, "accident drop post-roll %v", msg.String())
+			return nil
+		}
+
 		// Load stream local object.
 		var m3u8LocalObj *AccidentM3u8Stream
 		var freshObject bool
-		M3u8URL := fmt.Sprintf("%v/%v",msg.inputStream.Stream,msg.DetectResult.Category)
 		if obj, loaded := v.streams.LoadOrStore(M3u8URL, &AccidentM3u8Stream{
 			M3u8URL: M3u8URL, UUID: uuid.NewString(), AccidentWorker: v,
-			Stream: msg.inputStream.Stream,
-			Category: msg.DetectResult.Category,
+			Stream: msg.InputStream.Stream,
+			Category: msg.Category,
 		}); true {
 			m3u8LocalObj, freshObject = obj.(*AccidentM3u8Stream), !loaded
 		}
 
+		// Generate the snapshot before initialize, which callbacks with the snapshot.
+		if msg.Snapshot != nil {
+			if freshObject {
+				if err := m3u8LocalObj.saveSnapshot(ctx, msg.Snapshot); err != nil {
+					logger.Wf(ctx, "ignore snapshot %v err %+v", msg.Snapshot.String(), err)
+				}
+			}
+			os.Remove(msg.Snapshot.ImageFile.File)
+			msg.Snapshot = nil
+		}
+
 		// Initialize the fresh object.
 		if freshObject {
 			if err := m3u8LocalObj.Initialize(ctx, v); err != nil {
@@ -273,7 +559,7 @@ func (v *AccidentWorker) Start(ctx context.Context) error {
 			case <-ctx.Done():
 			case msg := <-v.msgs:
 				if err := v.OnAccidentAddedImpl(ctx, msg); err != nil {
-					logger.Wf(ctx, "process: task %v on hls ts message %v err %+v", msg.DetectResult.String(), err)
+					logger.Wf(ctx, "accident: handle message %v err %+v", msg.String(), err)
 				}
 			}
 		}
@@ -290,7 +576,7 @@ func (v *AccidentWorker) Start(ctx context.Context) error {
 				return
 			case msg := <-v.tsfiles:
 				if err := buildM3u8Object(ctx, msg); err != nil {
-					logger.Wf(ctx, "ignore msg %v ts %v err %+v", msg.DetectResult.String(), msg.TsFile.String(), err)
+					logger.Wf(ctx, "ignore msg %v err %+v", msg.String(), err)
 				}
 			}
 		}
@@ -299,6 +585,62 @@ func (v *AccidentWorker) Start(ctx context.Context) error {
 	return nil
 }
 
+// restoreStreams load the working objects from redis, which are interrupted by restart. The object keeps
+// recording if stream is still active, or it's expired and finished to a mp4 file.
+func (v *AccidentWorker) restoreStreams(ctx context.Context) error {
+	objs, err := rdb.HGetAll(ctx, SRS_ACCIDENT_M3U8_WORKING).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_ACCIDENT_M3U8_WORKING)
+	}
+
+	activeStreams, err := queryActiveStreams(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query active streams")
+	}
+
+	for m3u8URL, obj := range objs {
+		m3u8LocalObj := &AccidentM3u8Stream{}
+		if err := json.Unmarshal([]byte(obj), m3u8LocalObj); err != nil || m3u8LocalObj.UUID == "" {
+			logger.Wf(ctx, "accident: drop invalid object %v %v err %+v", m3u8URL, obj, err)
+			if err := rdb.HDel(ctx, SRS_ACCIDENT_M3U8_WORKING, m3u8URL).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_ACCIDENT_M3U8_WORKING, m3u8URL)
+			}
+			continue
+		}
+
+		// The messages saved by previous version has no stream.
+		for _, msg := range m3u8LocalObj.Messages {
+			if msg.InputStream == nil {
+				msg.InputStream = &SrsStream{Stream: m3u8LocalObj.Stream}
+			}
+		}
+
+		// Finish the object if stream is not active.
+		if _, ok := activeStreams[m3u8LocalObj.Stream]; !ok {
+			m3u8LocalObj.Expired = true
+		}
+
+		if err := m3u8LocalObj.Initialize(ctx, v); err != nil {
+			return errors.Wrapf(err, "init %v", m3u8LocalObj.String())
+		}
+		if err := m3u8LocalObj.saveObject(ctx); err != nil {
+			return errors.Wrapf(err, "save %v", m3u8LocalObj.String())
+		}
+		v.streams.Store(m3u8LocalObj.key(), m3u8LocalObj)
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			if err := m3u8LocalObj.Run(ctx); err != nil {
+				logger.Wf(ctx, "serve m3u8 %v err %+v", m3u8LocalObj.String(), err)
+			}
+		}()
+		logger.Tf(ctx, "accident: restore object %v", m3u8LocalObj.String())
+	}
+
+	return nil
+}
+
 // AccidentM3u8Stream is the current active local object for a HLS stream.
 // When recording done, it will generate a M3u8VoDArtifact, which is a HLS VoD object.
 type AccidentM3u8Stream struct {
@@ -317,21 +659,67 @@ type AccidentM3u8Stream struct {
 	Done string `json:"done"`
 	// Whether task is set to expire by user.
 	Expired bool `json:"expired"`
+	// Whether retired by a new accident of the same stream and category, before finished.
+	Retired bool `json:"retired,omitempty"`
 
 	AccidentId int `json:"accidentId"`
+	// The id of begin callback in outbox, which resolves the accident id.
+	BeginID string `json:"beginId,omitempty"`
+	// Whether the snapshot is generated, and the score of best snapshot.
+	Snapshot  bool    `json:"snapshot,omitempty"`
+	BestScore float64 `json:"bestScore,omitempty"`
 
 	// The ts files of this m3u8.
 	Messages []*AccidentSegment `json:"msgs"`
 
 	// The worker which owns this object.
-	AccidentWorker *AccidentWorker
+	AccidentWorker *AccidentWorker `json:"-"`
 	// The artifact we're working for.
 	artifact *M3u8VoDArtifact
+	// Whether removed from worker to finish, which is never retired.
+	finishing bool
 	// To protect the fields.
 	lock sync.Mutex
 }
 
-func (v AccidentM3u8Stream) String() string {
+// key return the key of object in worker and redis, which is the m3u8 url, or with the uuid if retired,
+// because a new object of the same m3u8 url might be working.
+func (v *AccidentM3u8Stream) key() string {
+	if v.Retired {
+		return fmt.Sprintf("%v/%v", v.M3u8URL, v.UUID)
+	}
+	return v.M3u8URL
+}
+
+// retire the object which is ended or expired but not finished yet, by moving it to the key with uuid, so
+// that the new accident of the same m3u8 url starts a new object, never appends to this finishing one.
+func (v *AccidentM3u8Stream) retire(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.finishing || v.Retired {
+		return nil
+	}
+	v.Expired, v.Retired = true, true
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "marshal object")
+	}
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, SRS_ACCIDENT_M3U8_WORKING, v.key(), string(b))
+		pipe.HDel(ctx, SRS_ACCIDENT_M3U8_WORKING, v.M3u8URL)
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "retire %v", v.key())
+	}
+
+	v.AccidentWorker.streams.Store(v.key(), v)
+	v.AccidentWorker.streams.CompareAndDelete(v.M3u8URL, v)
+	return nil
+}
+
+func (v *AccidentM3u8Stream) String() string {
 	return fmt.Sprintf("url=%v, uuid=%v, done=%v, update=%v, messages=%v, expired=%v",
 		v.M3u8URL, v.UUID, v.Done, v.Update, len(v.Messages), v.Expired,
 	)
@@ -341,8 +729,8 @@ func (v *AccidentM3u8Stream) deleteObject(ctx context.Context) error {
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	if err := rdb.HDel(ctx, SRS_ACCIDENT_M3U8_WORKING, v.M3u8URL).Err(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hdel %v %v", SRS_ACCIDENT_M3U8_WORKING, v.M3u8URL)
+	if err := rdb.HDel(ctx, SRS_ACCIDENT_M3U8_WORKING, v.key()).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_ACCIDENT_M3U8_WORKING, v.key())
 	}
 
 	return nil
@@ -354,8 +742,8 @@ func (v *AccidentM3u8Stream) saveObject(ctx context.Context) error {
 
 	if b, err := json.Marshal(v); err != nil {
 		return errors.Wrapf(err, "marshal object")
-	} else if err = rdb.HSet(ctx, SRS_ACCIDENT_M3U8_WORKING, v.M3u8URL, string(b)).Err(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hset %v %v %v", SRS_ACCIDENT_M3U8_WORKING, v.M3u8URL, string(b))
+	} else if err = rdb.HSet(ctx, SRS_ACCIDENT_M3U8_WORKING, v.key(), string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_ACCIDENT_M3U8_WORKING, v.key(), string(b))
 	}
 	return nil
 }
@@ -376,9 +764,9 @@ func (v *AccidentM3u8Stream) updateArtifact(ctx context.Context, artifact *M3u8V
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	artifact.Vhost = msg.inputStream.Vhost
-	artifact.App = msg.inputStream.App
-	artifact.Stream = msg.inputStream.Stream
+	artifact.Vhost = msg.InputStream.Vhost
+	artifact.App = msg.InputStream.App
+	artifact.Stream = msg.InputStream.Stream
 
 	artifact.Files = append(artifact.Files, msg.TsFile)
 	artifact.NN = len(artifact.Files)
@@ -392,6 +780,7 @@ func (v *AccidentM3u8Stream) finishArtifact(ctx context.Context, artifact *M3u8V
 
 	artifact.Processing = false
 	artifact.Update = time.Now().Format(time.RFC3339)
+	artifact.Done = artifact.Update
 }
 
 func (v *AccidentM3u8Stream) addMessage(ctx context.Context, msg *AccidentSegment) {
@@ -410,6 +799,25 @@ func (v *AccidentM3u8Stream) copyMessages() []*AccidentSegment {
 	return append([]*AccidentSegment{}, v.Messages...)
 }
 
+// files return the copied files of messages, which are not served yet.
+func (v *AccidentM3u8Stream) files() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var files []string
+	for _, msg := range v.Messages {
+		if msg.TsFile != nil {
+			files = append(files, msg.TsFile.File)
+		}
+		for _, image := range []*AccidentImage{msg.Image, msg.Snapshot} {
+			if image != nil && image.ImageFile != nil {
+				files = append(files, image.ImageFile.File)
+			}
+		}
+	}
+	return files
+}
+
 func (v *AccidentM3u8Stream) removeMessage(msg *AccidentSegment) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -425,6 +833,87 @@ func (v *AccidentM3u8Stream) removeMessage(msg *AccidentSegment) {
 	v.Update = time.Now().Format(time.RFC3339)
 }
 
+// saveSnapshot draw the frame which triggers the accident as the snapshot, which is also the best
+// snapshot util a frame with higher score.
+func (v *AccidentM3u8Stream) saveSnapshot(ctx context.Context, snapshot *AccidentImage) error {
+	dir := path.Join("accident", v.UUID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", dir)
+	}
+
+	for _, name := range []string{accidentSnapshot, accidentBestSnapshot} {
+		if err := drawSnapshot(snapshot, path.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "draw %v to %v", snapshot.String(), name)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.Snapshot, v.BestScore = true, snapshot.Score
+
+	logger.Tf(ctx, "accident snapshot %v ok, %v", dir, snapshot.String())
+	return nil
+}
+
+// updateBestSnapshot update the best snapshot, if the frame has higher score.
+func (v *AccidentM3u8Stream) updateBestSnapshot(ctx context.Context, image *AccidentImage) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.Snapshot && image.Score <= v.BestScore {
+		return nil
+	}
+
+	dir := path.Join("accident", v.UUID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", dir)
+	}
+
+	// Generate the snapshot if not, for example, failed to save it when begin.
+	names := []string{accidentBestSnapshot}
+	if !v.Snapshot {
+		names = append(names, accidentSnapshot)
+	}
+	for _, name := range names {
+		if err := drawSnapshot(image, path.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "draw %v to %v", image.String(), name)
+		}
+	}
+
+	v.Snapshot, v.BestScore = true, image.Score
+	logger.Tf(ctx, "accident best snapshot %v ok, %v", dir, image.String())
+	return nil
+}
+
+// newEvent create the accident event to push to clients.
+func (v *AccidentM3u8Stream) newEvent(ctx context.Context, eventType string) *Event {
+	event := &Event{
+		Type:       eventType,
+		Stream:     v.Stream,
+		Category:   v.Category,
+		AccidentId: v.AccidentId,
+		UUID:       v.UUID,
+	}
+	if category := categoryRegistry.Query(v.Category); category != nil {
+		event.AccidentType = category.Type
+	}
+	if v.Snapshot {
+		if u, err := snapshotURL(v.UUID, accidentSnapshot); err != nil {
+			logger.Wf(ctx, "ignore snapshot of %v err %+v", v.String(), err)
+		} else {
+			event.SnapshotURL = u
+		}
+	}
+	return event
+}
+
+func (v *AccidentM3u8Stream) expire() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.Expired = true
+}
+
 func (v *AccidentM3u8Stream) expired(ctx context.Context) bool {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -439,6 +928,9 @@ func (v *AccidentM3u8Stream) expired(ctx context.Context) bool {
 	}
 
 	duration := 30 * time.Second
+	if v.AccidentWorker != nil {
+		duration = v.AccidentWorker.policy.Quiet
+	}
 
 	if update.Add(duration).Before(time.Now()) {
 		return true
@@ -468,7 +960,10 @@ func (v *AccidentM3u8Stream) Initialize(ctx context.Context, r *AccidentWorker)
 		v.artifact = &M3u8VoDArtifact{
 			UUID:       v.UUID,
 			M3u8URL:    v.M3u8URL,
+			Stream:     v.Stream,
+			Category:   v.Category,
 			Processing: true,
+			Create:     time.Now().Format(time.RFC3339),
 			Update:     time.Now().Format(time.RFC3339),
 		}
 		if err := v.saveArtifact(ctx, v.artifact); err != nil {
@@ -476,7 +971,18 @@ func (v *AccidentM3u8Stream) Initialize(ctx context.Context, r *AccidentWorker)
 		}
 	}
 
-	v.callbackBegin(ctx, &v.AccidentId)
+	// Ignore if restored object, which already got the accident id or enqueued the begin callback. The
+	// accident id is bound to object and artifact when the begin callback is delivered.
+	if v.AccidentId == 0 && v.BeginID == "" {
+		if err := v.callbackBegin(ctx); err != nil {
+			logger.Wf(ctx, "ignore task %v callback begin err %+v", v.String(), err)
+		} else if err := v.saveObject(ctx); err != nil {
+			return errors.Wrapf(err, "save object %v", v.String())
+		}
+
+		eventHub.Publish(ctx, v.newEvent(ctx, EventTypeAccidentBegin))
+		metricAccidentsOpened.Inc(metricLabels("stream", v.Stream, "category", fmt.Sprint(v.Category)))
+	}
 
 	return nil
 }
@@ -548,22 +1054,37 @@ func (v *AccidentM3u8Stream) serveMessage(ctx context.Context, msg *AccidentSegm
 	// We always remove the msg from current object.
 	defer v.removeMessage(msg)
 
+	// Update the best snapshot by the frame, then remove it.
+	if msg.Image != nil {
+		defer os.Remove(msg.Image.ImageFile.File)
+		if err := v.updateBestSnapshot(ctx, msg.Image); err != nil {
+			logger.Wf(ctx, "ignore best snapshot %v err %+v", msg.Image.String(), err)
+		}
+	}
+
 	// Ignore file if not exists.
 	if _, err := os.Stat(msg.TsFile.File); err != nil {
+		segmentStore.Release(ctx, msg.TsFile.File)
 		return err
 	}
 
-	tsDir := path.Join("accident", v.UUID)
-	key := path.Join(tsDir, fmt.Sprintf("%v.ts", msg.TsFile.TsID))
-	msg.TsFile.Key = key
+	// Move the file copied by previous version to segment store.
+	if !segmentStore.contains(msg.TsFile.File) {
+		file, err := segmentStore.Acquire(ctx, msg.TsFile.File)
+		if err != nil {
+			return errors.Wrapf(err, "acquire %v", msg.TsFile.File)
+		}
+		segmentStore.Release(ctx, msg.TsFile.File)
+		msg.TsFile.File = file
+	}
 
+	tsDir := path.Join("accident", v.UUID)
 	if err := os.MkdirAll(tsDir, 0755); err != nil {
 		return errors.Wrapf(err, "mkdir %v", tsDir)
 	}
 
-	if err := os.Rename(msg.TsFile.File, key); err != nil {
-		return errors.Wrapf(err, "rename %v to %v", msg.TsFile.File, key)
-	}
+	// The artifact holds the file in segment store, and the playlist refers to it by the tsid.
+	msg.TsFile.Key = msg.TsFile.File
 
 	// Update the metadata for m3u8.
 	v.updateArtifact(ctx, v.artifact, msg)
@@ -577,37 +1098,76 @@ func (v *AccidentM3u8Stream) serveMessage(ctx context.Context, msg *AccidentSegm
 
 func (v *AccidentM3u8Stream) finishM3u8(ctx context.Context) error {
 	parentCtx := logger.WithContext(ctx)
-	contentType, m3u8Body, duration, err := buildVodM3u8ForLocal(ctx, v.artifact.Files, false, "")
-	if err != nil {
-		return errors.Wrapf(err, "build vod")
-	}
 
-	hls := path.Join("accident", v.UUID, "index.m3u8")
-	if f, err := os.OpenFile(hls, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
-		return errors.Wrapf(err, "open file %v", hls)
-	} else {
-		defer f.Close()
-		if _, err = f.Write([]byte(m3u8Body)); err != nil {
-			return errors.Wrapf(err, "write hls %v to %v", m3u8Body, hls)
+	// There might be no files, for example, all ts files are lost when restart, so we only notify the end.
+	var mp4 string
+	if len(v.artifact.Files) > 0 {
+		contentType, m3u8Body, duration, err := buildVodM3u8ForLocal(ctx, v.artifact.Files, false, "")
+		if err != nil {
+			return errors.Wrapf(err, "build vod")
+		}
+
+		hls := path.Join("accident", v.UUID, "index.m3u8")
+		if f, err := os.OpenFile(hls, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return errors.Wrapf(err, "open file %v", hls)
+		} else {
+			defer f.Close()
+			if _, err = f.Write([]byte(m3u8Body)); err != nil {
+				return errors.Wrapf(err, "write hls %v to %v", m3u8Body, hls)
+			}
+		}
+		logger.Tf(ctx, "accident to %v ok, type=%v, duration=%v", hls, contentType, duration)
+
+		// The ts files are in segment store, so ffmpeg reads them by a concat list.
+		concat := path.Join("accident", v.UUID, "concat.txt")
+		if err := writeConcatList(concat, v.artifact.Files); err != nil {
+			return errors.Wrapf(err, "write concat %v", concat)
+		}
+		defer os.Remove(concat)
+
+		mp4 = path.Join("accident", v.UUID, "index.mp4")
+		var b []byte
+		if err := scheduler.Run(ctx, SchedulerClassFFmpeg, v.Stream, func() (err error) {
+			b, err = exec.CommandContext(ctx, "ffmpeg",
+				"-f", "concat", "-safe", "0", "-i", concat, "-c", "copy", "-y", mp4,
+			).Output()
+			return
+		}); err != nil {
+			return errors.Wrapf(err, "covert to mp4 %v err %v", mp4, string(b))
 		}
+		logger.Tf(ctx, "accident to %v ok", mp4)
+	} else {
+		logger.Wf(ctx, "accident %v without any file", v.String())
 	}
-	logger.Tf(ctx, "accident to %v ok, type=%v, duration=%v", hls, contentType, duration)
 
-	mp4 := path.Join("accident", v.UUID, "index.mp4")
-	if b, err := exec.CommandContext(ctx, "ffmpeg", "-i", hls, "-c", "copy", "-y", mp4).Output(); err != nil {
-		return errors.Wrapf(err, "covert to mp4 %v err %v", mp4, string(b))
+	// Upload to object storage if configured, and use the local mp4 if failed.
+	videoURL := mp4
+	if s3Client != nil && mp4 != "" {
+		if u, err := v.uploadArtifact(ctx); err != nil {
+			logger.Wf(ctx, "ignore task %v upload err %+v", v.String(), err)
+		} else {
+			videoURL = u
+		}
 	}
-	logger.Tf(ctx, "accident to %v ok", mp4)
 
-	// Remove object from worker.
-	v.AccidentWorker.streams.Delete(v.M3u8URL)
+	// Remove object from worker, never retire it after removed.
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		v.finishing = true
+		v.AccidentWorker.streams.CompareAndDelete(v.key(), v)
+	}()
 	
 	if true {
 		ctx := parentCtx
 
-		if err := v.callbackEnd(ctx, mp4); err != nil {
+		if err := v.callbackEnd(ctx, videoURL); err != nil {
 			logger.Wf(ctx, "ignore task %v callback end err %+v", v.String(), err)
 		}
+
+		eventHub.Publish(ctx, v.newEvent(ctx, EventTypeAccidentEnd))
+		metricAccidentsClosed.Inc(metricLabels("stream", v.Stream, "category", fmt.Sprint(v.Category)))
 	}
 
 	// Update artifact after finally.
@@ -619,114 +1179,139 @@ func (v *AccidentM3u8Stream) finishM3u8(ctx context.Context) error {
 	// Do final cleanup, because new messages might arrive while converting to mp4, which takes a long time.
 	files := v.copyMessages()
 	for _, file := range files {
-		r2 := os.Remove(file.TsFile.File)
+		r2 := segmentStore.Release(ctx, file.TsFile.File)
+		if file.Image != nil {
+			os.Remove(file.Image.ImageFile.File)
+		}
 		logger.Tf(ctx, "drop %v r2=%v", file.String(), r2)
 	}
 
 	return nil
 }
 
-func (v *AccidentM3u8Stream) callbackBegin(ctx context.Context, accidentId *int) error {
-	logger.Tf(ctx, "callbackBegin called for url=%v", v.M3u8URL)
-	pf := func(url string, requestBody interface{}) error {
-		logger.Tf(ctx, "callbackBegin called for url=%v b=%v", v.M3u8URL, requestBody)
-		b, err := json.Marshal(requestBody)
-		if err != nil {
-			return errors.Wrapf(err, "marshal req")
-		}
+// uploadArtifact upload the mp4, playlist, ts files and snapshots to object storage, and return the url of mp4.
+// The uploaded keys are saved in artifact, so the upload is resumed from the last file when restart.
+func (v *AccidentM3u8Stream) uploadArtifact(ctx context.Context) (string, error) {
+	// The name in playlist and the local file. Note that the ts file is in segment store, named by tsid in
+	// playlist.
+	type uploadFile struct {
+		name string
+		file string
+	}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
-		if err != nil {
-			return errors.Wrapf(err, "new request")
+	dir := path.Join("accident", v.UUID)
+	files := []uploadFile{{"index.mp4", path.Join(dir, "index.mp4")}, {"index.m3u8", path.Join(dir, "index.m3u8")}}
+	for _, name := range []string{accidentSnapshot, accidentBestSnapshot} {
+		file := path.Join(dir, name)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, uploadFile{name, file})
 		}
-	
-		req.Header.Set("Content-Type", "application/json")
-	
-		var res *http.Response
-		res, err = http.DefaultClient.Do(req)
-		if err != nil {
-			return errors.Wrapf(err, "http post")
+	}
+	for _, tsFile := range v.artifact.Files {
+		files = append(files, uploadFile{fmt.Sprintf("%v.ts", tsFile.TsID), tsFile.Key})
+	}
+
+	uploaded := make(map[string]bool)
+	for _, key := range v.artifact.Keys {
+		uploaded[key] = true
+	}
+
+	for _, f := range files {
+		key := s3Client.Key(path.Join(v.UUID, f.name))
+		if uploaded[key] {
+			continue
 		}
-		defer res.Body.Close()
-	
-		if res.StatusCode != http.StatusCreated {
-			return errors.Errorf("response status %v", res.StatusCode)
+
+		if err := s3Client.PutFile(ctx, key, f.file); err != nil {
+			return "", errors.Wrapf(err, "upload %v to %v", f.file, key)
 		}
 
-		logger.Tf(ctx, "callbackBegin called for url=%v status=%v", url, res.StatusCode)
+		v.lock.Lock()
+		v.artifact.Bucket, v.artifact.Region = s3Client.Bucket, s3Client.Region
+		v.artifact.Keys = append(v.artifact.Keys, key)
+		v.lock.Unlock()
 
-		b2, err := io.ReadAll(res.Body)
-		if err != nil {
-			return errors.Wrapf(err, "read body")
-		}
-		if err := json.Unmarshal(b2, &struct {
-			AccidentId *int `json:"accidentId"`
-		}{
-			AccidentId: accidentId,
-		}); err != nil {
-			return errors.Wrapf(err, "unmarshal response")
+		if err := v.saveArtifact(ctx, v.artifact); err != nil {
+			return "", errors.Wrapf(err, "save artifact %v", v.artifact.String())
 		}
-		logger.Tf(ctx, "callbackBegin called for url=%v accidentId=%v", url, accidentId)
-		
-	
-		return nil
 	}
-	if Type, exists := categories[v.Category]; exists {
-		
-		err := pf("http://127.0.0.1:5000/accident", &struct {
-			StreamKey string `json:"streamKey"`
-			Type string `json:"type"`
-		}{
-			StreamKey: v.Stream,
-			Type: Type,
-		});
-		if err != nil {
-			return errors.Wrapf(err, "start Accident with %s", err)
-		}
-		return nil;
+
+	mediaURL, err := s3Client.ObjectURL(s3Client.Key(path.Join(v.UUID, "index.mp4")))
+	if err != nil {
+		return "", errors.Wrapf(err, "url of %v", v.UUID)
+	}
+
+	v.lock.Lock()
+	v.artifact.MediaURL = mediaURL
+	v.lock.Unlock()
+
+	logger.Tf(ctx, "accident upload %v ok, files=%v, url=%v", v.UUID, len(files), mediaURL)
+	return mediaURL, nil
+}
+
+// callbackBegin enqueue the begin callback to outbox, and the accident id is bound when delivered.
+func (v *AccidentM3u8Stream) callbackBegin(ctx context.Context) error {
+	category := categoryRegistry.Query(v.Category)
+	if category == nil {
+		return errors.Errorf("CategoryId does not exist %v", v.Category)
 	}
 
-	return errors.Errorf("CategoryId does not exist %v", v.Category)
+	// The snapshot is generated before callback, so the notification is able to show it. Never sign the url,
+	// because the message might be retried or replayed from dead letters after the token expires, so the API
+	// server should mint the token by uuid if playback token is on.
+	var snapshot string
+	if v.Snapshot {
+		snapshot = unsignedSnapshotURL(v.UUID, accidentSnapshot)
+	}
+
+	msg, err := NewOutboxMessage(OutboxTypeAccidentBegin, "/accident", &struct {
+		StreamKey   string `json:"streamKey"`
+		Type        string `json:"type"`
+		SnapshotURL string `json:"snapshotUrl,omitempty"`
+	}{
+		StreamKey: v.Stream, Type: category.Type, SnapshotURL: snapshot,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "create begin")
+	}
+	msg.AccidentUUID = v.UUID
+
+	if err := outboxWorker.Enqueue(ctx, msg); err != nil {
+		return errors.Wrapf(err, "enqueue begin %v", msg.String())
+	}
+
+	v.lock.Lock()
+	v.BeginID = msg.ID
+	v.lock.Unlock()
+
+	logger.Tf(ctx, "callbackBegin enqueue for url=%v, msg=%v", v.M3u8URL, msg.String())
+	return nil
 }
 
+// callbackEnd enqueue the end callback to outbox, which waits for the begin callback to resolve the accident id.
 func (v *AccidentM3u8Stream) callbackEnd(ctx context.Context, mp4File string) error {
-	logger.Tf(ctx, "callbackbeginend called for url=%v", v.M3u8URL)
-	pf := func(url string, requestBody interface{}) error {
-		logger.Tf(ctx, "callbackbeginend called for url=%v b=%v", v.M3u8URL, requestBody)
-		b, err := json.Marshal(requestBody)
-		if err != nil {
-			return errors.Wrapf(err, "marshal req")
-		}
+	msg, err := NewOutboxMessage(OutboxTypeAccidentEnd, "/accident/end", &struct {
+		AccidentId int    `json:"id"`
+		MP4        string `json:"videoUrl"`
+	}{
+		AccidentId: v.AccidentId, MP4: mp4File,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "create end")
+	}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
-		if err != nil {
-			return errors.Wrapf(err, "new request")
+	// Resolve the accident id when deliver, if the begin callback is not resolved yet.
+	if v.AccidentId == 0 {
+		if v.BeginID == "" {
+			return errors.Errorf("no begin of %v", v.String())
 		}
-	
-		req.Header.Set("Content-Type", "application/json")
-	
-		var res *http.Response
-		res, err = http.DefaultClient.Do(req)
-		if err != nil {
-			return errors.Wrapf(err, "http post")
-		}
-		defer res.Body.Close()
-	
-		if res.StatusCode != http.StatusCreated {
-			return errors.Errorf("response status %v", res.StatusCode)
-		}
-	
-		return nil
+		msg.DependsOn, msg.AccidentUUID = v.BeginID, v.UUID
 	}
-		err := pf("http://127.0.0.1:5000/accident/end", &struct {
-			AccidentId int `json:"id"`
-			MP4 string `json:"videoUrl"`
-		}{
-			AccidentId: v.AccidentId,
-			MP4: mp4File,
-		});
-		if err != nil {
-			return errors.Wrapf(err, "End Accident with %s", err)
-		}
-		return nil;
-}
\ No newline at end of file
+
+	if err := outboxWorker.Enqueue(ctx, msg); err != nil {
+		return errors.Wrapf(err, "enqueue end %v", msg.String())
+	}
+
+	logger.Tf(ctx, "callbackEnd enqueue for url=%v, msg=%v", v.M3u8URL, msg.String())
+	return nil
+}
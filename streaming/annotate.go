@@ -0,0 +1,136 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The size of image to detect, the bbox of detection is in this size.
+const detectImageSize = 640
+
+// The colors of boxes, by category.
+var annotateColors = []string{"red", "yellow", "lime", "cyan", "magenta", "orange", "white", "blue"}
+
+// annotateSegment re-encode the ts file of segment with the boxes and labels of detections drawn, to a new
+// ts file in process directory. The timestamp is kept, to play the annotated segments continuously.
+func annotateSegment(ctx context.Context, stream string, segment *ProcessSegment) (*TsFile, error) {
+	annotatedFile := &TsFile{
+		TsID:     fmt.Sprintf("%v-annotated-%v", segment.TsFile.SeqNo, uuid.NewString()),
+		URL:      segment.TsFile.URL,
+		SeqNo:    segment.TsFile.SeqNo,
+		Duration: segment.TsFile.Duration,
+	}
+	annotatedFile.File = path.Join("process", stream, fmt.Sprintf("%v.ts", annotatedFile.TsID))
+
+	transcode := func(labels bool) error {
+		args := []string{"-i", segment.TsFile.File, "-copyts"}
+		if filter := buildAnnotateFilter(segment, labels); filter != "" {
+			args = append(args, "-vf", filter)
+		}
+		args = append(args,
+			"-c:v", "libx264", "-preset", "veryfast", "-c:a", "copy",
+			"-muxdelay", "0", "-muxpreload", "0",
+			"-f", "mpegts", "-y", annotatedFile.File,
+		)
+
+		var stderr bytes.Buffer
+		if err := scheduler.Run(ctx, SchedulerClassFFmpeg, stream, func() error {
+			cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+			cmd.Stderr = &stderr
+			return cmd.Run()
+		}); err != nil {
+			return errors.Wrapf(err, "transcode %v, stderr is %v", args, stderr.String())
+		}
+		return nil
+	}
+
+	// Note that drawtext might fail if no font, so we retry without labels.
+	if err := transcode(true); err != nil {
+		logger.Wf(ctx, "annotate %v without labels, err %+v", segment.TsFile.File, err)
+		if err := transcode(false); err != nil {
+			os.Remove(annotatedFile.File)
+			return nil, errors.Wrapf(err, "annotate %v", segment.TsFile.File)
+		}
+	}
+
+	stats, err := os.Stat(annotatedFile.File)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat file %v", annotatedFile.File)
+	}
+	annotatedFile.Size = uint64(stats.Size())
+
+	return annotatedFile, nil
+}
+
+// buildAnnotateFilter build the filters to draw the boxes of segment. Each box is only drawn during its
+// frame, from the offset of frame to the next frame. If no frames, draw the merged boxes for the segment.
+func buildAnnotateFilter(segment *ProcessSegment, labels bool) string {
+	frames := segment.Frames
+	if len(frames) == 0 {
+		frames = []*ProcessFrame{{BoundingBox: segment.BoundingBox}}
+	}
+
+	// Note that we use -copyts, so the time of filter is the timestamp of stream.
+	starttime := segment.StreamStarttime.Seconds()
+
+	var filters []string
+	for i, frame := range frames {
+		start, end := starttime+frame.Offset, starttime+segment.TsFile.Duration
+		if i < len(frames)-1 {
+			end = starttime + frames[i+1].Offset
+		}
+		enable := fmt.Sprintf("enable='between(t,%.3f,%.3f)'", start, end)
+		if len(frames) == 1 {
+			enable = ""
+		}
+
+		for _, box := range frame.BoundingBox {
+			if len(box.BBox) < 4 {
+				continue
+			}
+			x, y, w, h := box.BBox[0], box.BBox[1], box.BBox[2], box.BBox[3]
+			color := annotateColors[box.Category%len(annotateColors)]
+
+			filter := fmt.Sprintf("drawbox=x=iw*%.2f/%v:y=ih*%.2f/%v:w=iw*%.2f/%v:h=ih*%.2f/%v:color=%v@0.8:t=4",
+				x, detectImageSize, y, detectImageSize, w, detectImageSize, h, detectImageSize, color,
+			)
+			if enable != "" {
+				filter = fmt.Sprintf("%v:%v", filter, enable)
+			}
+			filters = append(filters, filter)
+
+			if !labels {
+				continue
+			}
+
+			label := fmt.Sprintf("%v", box.Category)
+			if c := categoryRegistry.Query(box.Category); c != nil {
+				label = c.Type
+			}
+			filter = fmt.Sprintf("drawtext=text='%v %.2f':x=W*%.2f/%v:y=max(H*%.2f/%v-th-4\\,0):fontsize=h/30:fontcolor=%v:box=1:boxcolor=black@0.5",
+				label, box.Score, x, detectImageSize, y, detectImageSize, color,
+			)
+			if font := envProcessAnnotateFont(); font != "" {
+				filter = fmt.Sprintf("%v:fontfile='%v'", filter, font)
+			}
+			if enable != "" {
+				filter = fmt.Sprintf("%v:%v", filter, enable)
+			}
+			filters = append(filters, filter)
+		}
+	}
+
+	return strings.Join(filters, ",")
+}
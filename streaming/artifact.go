@@ -0,0 +1,304 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// The default and max page size of artifacts.
+const (
+	defaultArtifactPageSize = 20
+	maxArtifactPageSize     = 100
+)
+
+// ArtifactFilter is the filter and pagination to query artifacts.
+type ArtifactFilter struct {
+	// The stream name, all streams if empty.
+	Stream string
+	// The category id, all categories if zero.
+	Category int
+	// The time range of create time, ignore if zero.
+	From, To time.Time
+	// The processing state, all states if nil.
+	Processing *bool
+	// The page from 1, and the size of page.
+	Page, Size int
+}
+
+// newArtifactFilter parse the filter from query, the format is:
+//
+//	?stream=livestream&category=7&from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z&processing=false&page=1&size=20
+func newArtifactFilter(q url.Values) (*ArtifactFilter, error) {
+	v := &ArtifactFilter{Stream: q.Get("stream"), Page: 1, Size: defaultArtifactPageSize}
+
+	if category := q.Get("category"); category != "" {
+		if id, err := strconv.Atoi(category); err != nil {
+			return nil, errors.Wrapf(err, "invalid category %v", category)
+		} else {
+			v.Category = id
+		}
+	}
+
+	for _, t := range []struct {
+		key string
+		v   *time.Time
+	}{{"from", &v.From}, {"to", &v.To}} {
+		if value := q.Get(t.key); value != "" {
+			if tv, err := time.Parse(time.RFC3339, value); err != nil {
+				return nil, errors.Wrapf(err, "invalid %v %v", t.key, value)
+			} else {
+				*t.v = tv
+			}
+		}
+	}
+
+	if processing := q.Get("processing"); processing != "" {
+		if pv, err := strconv.ParseBool(processing); err != nil {
+			return nil, errors.Wrapf(err, "invalid processing %v", processing)
+		} else {
+			v.Processing = &pv
+		}
+	}
+
+	for _, n := range []struct {
+		key string
+		v   *int
+	}{{"page", &v.Page}, {"size", &v.Size}} {
+		if value := q.Get(n.key); value != "" {
+			if nv, err := strconv.Atoi(value); err != nil || nv <= 0 {
+				return nil, errors.Errorf("invalid %v %v", n.key, value)
+			} else {
+				*n.v = nv
+			}
+		}
+	}
+	if v.Size > maxArtifactPageSize {
+		v.Size = maxArtifactPageSize
+	}
+
+	return v, nil
+}
+
+// match whether the artifact is accepted by filter.
+func (v *ArtifactFilter) match(artifact *M3u8VoDArtifact) bool {
+	if v.Stream != "" && artifact.Stream != v.Stream {
+		return false
+	}
+	if v.Category != 0 && artifact.Category != v.Category {
+		return false
+	}
+	if v.Processing != nil && artifact.Processing != *v.Processing {
+		return false
+	}
+
+	if !v.From.IsZero() || !v.To.IsZero() {
+		create, err := time.Parse(time.RFC3339, artifact.Create)
+		if err != nil {
+			return false
+		}
+		if !v.From.IsZero() && create.Before(v.From) {
+			return false
+		}
+		if !v.To.IsZero() && create.After(v.To) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queryArtifacts load all artifacts from redis, ordered by create time, the latest first.
+func queryArtifacts(ctx context.Context) ([]*M3u8VoDArtifact, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_ACCIDENT_M3U8_ARTIFACT).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_ACCIDENT_M3U8_ARTIFACT)
+	}
+
+	var artifacts []*M3u8VoDArtifact
+	for id, obj := range objs {
+		artifact := &M3u8VoDArtifact{}
+		if err := json.Unmarshal([]byte(obj), artifact); err != nil {
+			logger.Wf(ctx, "artifact: ignore invalid %v %v err %+v", id, obj, err)
+			continue
+		}
+		artifact.fixup()
+		artifacts = append(artifacts, artifact)
+	}
+
+	sort.SliceStable(artifacts, func(i, j int) bool {
+		if artifacts[i].Create != artifacts[j].Create {
+			return artifacts[i].Create > artifacts[j].Create
+		}
+		return artifacts[i].UUID < artifacts[j].UUID
+	})
+	return artifacts, nil
+}
+
+// queryArtifact load the artifact by uuid, return nil if not exists.
+func queryArtifact(ctx context.Context, artifactUUID string) (*M3u8VoDArtifact, error) {
+	obj, err := rdb.HGet(ctx, SRS_ACCIDENT_M3U8_ARTIFACT, artifactUUID).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_ACCIDENT_M3U8_ARTIFACT, artifactUUID)
+	} else if obj == "" {
+		return nil, nil
+	}
+
+	artifact := &M3u8VoDArtifact{}
+	if err := json.Unmarshal([]byte(obj), artifact); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", obj)
+	}
+	artifact.fixup()
+	return artifact, nil
+}
+
+// removeArtifact remove the artifact from redis, and the directory of accident. The ts files held by the
+// artifact are released, which are removed if no one holds them.
+func removeArtifact(ctx context.Context, artifactUUID string) error {
+	artifact, err := queryArtifact(ctx, artifactUUID)
+	if err != nil {
+		return errors.Wrapf(err, "query artifact %v", artifactUUID)
+	}
+	if artifact != nil {
+		for _, tsFile := range artifact.Files {
+			if err := segmentStore.Release(ctx, tsFile.Key); err != nil {
+				return errors.Wrapf(err, "release %v", tsFile.Key)
+			}
+		}
+	}
+
+	if err := rdb.HDel(ctx, SRS_ACCIDENT_M3U8_ARTIFACT, artifactUUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_ACCIDENT_M3U8_ARTIFACT, artifactUUID)
+	}
+
+	dir := path.Join("accident", artifactUUID)
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "remove %v", dir)
+	}
+	return nil
+}
+
+func (v *AccidentWorker) handleArtifacts(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/accident/artifacts"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+			if r.Method != http.MethodGet {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			filter, err := newArtifactFilter(r.URL.Query())
+			if err != nil {
+				return errors.Wrapf(err, "parse filter")
+			}
+
+			artifacts, err := queryArtifacts(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query artifacts")
+			}
+
+			var matched []*M3u8VoDArtifact
+			for _, artifact := range artifacts {
+				if filter.match(artifact) {
+					matched = append(matched, artifact)
+				}
+			}
+
+			// Only return the files in detail, to make the list small.
+			start := (filter.Page - 1) * filter.Size
+			end := start + filter.Size
+			if start > len(matched) {
+				start = len(matched)
+			}
+			if end > len(matched) {
+				end = len(matched)
+			}
+			page := []*M3u8VoDArtifact{}
+			for _, artifact := range matched[start:end] {
+				artifact.Files = nil
+				page = append(page, artifact)
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Total     int                `json:"total"`
+				Page      int                `json:"page"`
+				Size      int                `json:"size"`
+				Artifacts []*M3u8VoDArtifact `json:"artifacts"`
+			}{
+				Total: len(matched), Page: filter.Page, Size: filter.Size, Artifacts: page,
+			})
+			logger.Tf(ctx, "artifact: query total=%v, page=%v, size=%v", len(matched), filter.Page, filter.Size)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/accident/artifacts/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Format is /accident/artifacts/:uuid
+			artifactUUID := strings.TrimPrefix(r.URL.Path, ep)
+			if _, err := uuid.Parse(artifactUUID); err != nil {
+				return errors.Wrapf(err, "invalid uuid %v of %v", artifactUUID, r.URL.Path)
+			}
+
+			artifact, err := queryArtifact(ctx, artifactUUID)
+			if err != nil {
+				return errors.Wrapf(err, "query artifact %v", artifactUUID)
+			} else if artifact == nil {
+				return errors.Errorf("no artifact %v", artifactUUID)
+			}
+
+			if r.Method == http.MethodGet {
+				ohttp.WriteData(ctx, w, r, artifact)
+				return nil
+			}
+
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			// Never remove the working accident, which is still recording.
+			if task := v.QueryTask(artifactUUID); task != nil {
+				return errors.Errorf("artifact %v is working", artifactUUID)
+			}
+
+			if err := removeArtifact(ctx, artifactUUID); err != nil {
+				return errors.Wrapf(err, "remove artifact %v", artifactUUID)
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "artifact: remove %v", artifact.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var categoryRegistry *CategoryRegistry
+
+// Category is a category of model, which raises an accident of type in API.
+type Category struct {
+	// The category id of model, the category_id of COCO result.
+	ID int `json:"id"`
+	// The accident type of API, such as FALL.
+	Type string `json:"type"`
+	// Whether raise accident for this category.
+	Enabled bool `json:"enabled"`
+	// The minimum score of detection, use ACCIDENT_MIN_SCORE if zero.
+	MinScore float64 `json:"minScore,omitempty"`
+	// The minimum area of bounding box in pixels of image, such as 640x640, ignore if zero.
+	MinArea float64 `json:"minArea,omitempty"`
+	// Confirm accident by Hits detections in Window segments, use ACCIDENT_CONFIRM_HITS and
+	// ACCIDENT_CONFIRM_WINDOW if zero.
+	Hits   int `json:"hits,omitempty"`
+	Window int `json:"window,omitempty"`
+}
+
+func (v *Category) String() string {
+	return fmt.Sprintf("id=%v, type=%v, enabled=%v, score=%v, area=%v, hits=%v, window=%v",
+		v.ID, v.Type, v.Enabled, v.MinScore, v.MinArea, v.Hits, v.Window,
+	)
+}
+
+// Match whether the detection is accepted by category, by score and area of box.
+func (v *Category) Match(policy *AccidentPolicy, result *ProcessDetectResult) bool {
+	if result.Category != v.ID || result.Score < policy.MinScore {
+		return false
+	}
+
+	// The bbox of COCO is [x, y, width, height].
+	if v.MinArea > 0 && (len(result.BBox) < 4 || result.BBox[2]*result.BBox[3] < v.MinArea) {
+		return false
+	}
+
+	return true
+}
+
+// CategoryRegistry is the categories loaded from redis, which is editable by HTTP API without restart.
+type CategoryRegistry struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The categories, key is category id.
+	categories map[int]*Category
+	// The default policy, from env.
+	policy *AccidentPolicy
+
+	// To protect the fields.
+	lock sync.RWMutex
+}
+
+func NewCategoryRegistry() *CategoryRegistry {
+	return &CategoryRegistry{
+		categories: make(map[int]*Category),
+		policy:     NewAccidentPolicy(),
+	}
+}
+
+// defaultCategories is the categories of model, which is used when redis is empty.
+func defaultCategories() []*Category {
+	return []*Category{
+		{ID: 1, Type: "NON_SAFETY_HELMET", Enabled: true},
+		{ID: 2, Type: "NON_SAFETY_VEST", Enabled: true},
+		{ID: 7, Type: "FALL", Enabled: true},
+		{ID: 8, Type: "USE_PHONE_WHILE_WORKING", Enabled: true},
+		{ID: 9, Type: "SOS_REQUEST", Enabled: true},
+	}
+}
+
+func (v *CategoryRegistry) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *CategoryRegistry) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "category: start registry")
+
+	// Initialize redis by default categories.
+	if n, err := rdb.HLen(ctx, SRS_ACCIDENT_CATEGORY).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hlen %v", SRS_ACCIDENT_CATEGORY)
+	} else if n == 0 {
+		for _, c := range defaultCategories() {
+			if err := v.save(ctx, c); err != nil {
+				return errors.Wrapf(err, "save %v", c.String())
+			}
+		}
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		return errors.Wrapf(err, "refresh")
+	}
+
+	// Reload categories from redis, which might be changed by other tools.
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+				if err := v.refresh(ctx); err != nil {
+					logger.Wf(ctx, "category: ignore refresh err %+v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// refresh load all categories from redis.
+func (v *CategoryRegistry) refresh(ctx context.Context) error {
+	objs, err := rdb.HGetAll(ctx, SRS_ACCIDENT_CATEGORY).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_ACCIDENT_CATEGORY)
+	}
+
+	categories := make(map[int]*Category)
+	for id, obj := range objs {
+		var c Category
+		if err := json.Unmarshal([]byte(obj), &c); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+		categories[c.ID] = &c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.categories = categories
+	return nil
+}
+
+func (v *CategoryRegistry) save(ctx context.Context, c *Category) error {
+	if b, err := json.Marshal(c); err != nil {
+		return errors.Wrapf(err, "marshal %v", c.String())
+	} else if err = rdb.HSet(ctx, SRS_ACCIDENT_CATEGORY, fmt.Sprintf("%v", c.ID), string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_ACCIDENT_CATEGORY, c.ID, string(b))
+	}
+	return nil
+}
+
+// Query the category by id, return nil if not exists.
+func (v *CategoryRegistry) Query(id int) *Category {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if c, ok := v.categories[id]; ok {
+		r := *c
+		return &r
+	}
+	return nil
+}
+
+// Categories return all categories, ordered by id.
+func (v *CategoryRegistry) Categories() []*Category {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	var categories []*Category
+	for _, c := range v.categories {
+		r := *c
+		categories = append(categories, &r)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].ID < categories[j].ID
+	})
+	return categories
+}
+
+// Policy return the policy of category, use the default policy if not set.
+func (v *CategoryRegistry) Policy(c *Category) *AccidentPolicy {
+	policy := *v.policy
+	if c.MinScore > 0 {
+		policy.MinScore = c.MinScore
+	}
+	if c.Hits > 0 {
+		policy.Hits = c.Hits
+	}
+	if c.Window > 0 {
+		policy.Window = c.Window
+	}
+	if policy.Window < policy.Hits {
+		policy.Window = policy.Hits
+	}
+	return &policy
+}
+
+func (v *CategoryRegistry) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/accident/categories"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if r.Method == http.MethodGet {
+				ohttp.WriteData(ctx, w, r, v.Categories())
+				return nil
+			}
+
+			if r.Method != http.MethodPost {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			var c Category
+			if err := ParseBody(ctx, r.Body, &c); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+			if c.ID <= 0 || c.Type == "" {
+				return errors.Errorf("invalid category %v", c.String())
+			}
+			if c.MinScore < 0 || c.MinArea < 0 || c.Hits < 0 || c.Window < 0 {
+				return errors.Errorf("invalid category %v", c.String())
+			}
+
+			if err := v.save(ctx, &c); err != nil {
+				return errors.Wrapf(err, "save %v", c.String())
+			}
+			if err := v.refresh(ctx); err != nil {
+				return errors.Wrapf(err, "refresh")
+			}
+
+			ohttp.WriteData(ctx, w, r, &c)
+			logger.Tf(ctx, "category: update %v", c.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/accident/categories/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Format is /accident/categories/:id
+			id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, ep))
+			if err != nil {
+				return errors.Wrapf(err, "invalid id of %v", r.URL.Path)
+			}
+
+			if r.Method == http.MethodGet {
+				c := v.Query(id)
+				if c == nil {
+					return errors.Errorf("no category %v", id)
+				}
+				ohttp.WriteData(ctx, w, r, c)
+				return nil
+			}
+
+			if r.Method != http.MethodDelete {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			if err := rdb.HDel(ctx, SRS_ACCIDENT_CATEGORY, fmt.Sprintf("%v", id)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_ACCIDENT_CATEGORY, id)
+			}
+			if err := v.refresh(ctx); err != nil {
+				return errors.Wrapf(err, "refresh")
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "category: remove %v", id)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -5,17 +5,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/ossrs/go-oryx-lib/errors"
 	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
 
 	"github.com/google/uuid"
 )
@@ -36,6 +39,14 @@ type DetectWorker struct {
 
 	// The streams we're detecting, key is m3u8 URL in string, value is m3u8 object *DetectM3u8Stream.
 	workers sync.Map
+
+	// The publish generation of streams, increased when publish or unpublish, to fence the late on_hls
+	// messages of the previous publish.
+	generations map[string]uint64
+	// The unpublished streams, whose on_hls messages are dropped until published again.
+	unpublished map[string]bool
+	// To protect the generations, and never create worker for the unpublished stream.
+	lock sync.Mutex
 }
 
 func NewDetectWorker() *DetectWorker {
@@ -44,6 +55,9 @@ func NewDetectWorker() *DetectWorker {
 		msgs: make(chan *SrsOnHlsMessage, 1024),
 		// TS files.
 		tsfiles: make(chan *SrsOnHlsObject, 1024),
+		// The fence of streams.
+		generations: make(map[string]uint64),
+		unpublished: make(map[string]bool),
 	}
 }
 
@@ -61,6 +75,10 @@ func (v *DetectWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			}
 			stream := splits[0]
 
+			if err := verifyPlayback(r, fmt.Sprintf("%v%v/", prefix, stream)); err != nil {
+				return errors.Wrapf(err, "verify playback")
+			}
+
 			var processWorker *ProcessWorker
 
 			obj, ok := v.workers.Load(stream);
@@ -72,6 +90,22 @@ func (v *DetectWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 			processWorker = obj.(*ProcessWorker)
 			
+			// Format is :stream/master.m3u8, :stream/metadata.m3u8 or :stream/metadata/:tsid.vtt
+			if splits[1] == "master.m3u8" {
+				return processWorker.hlsMasterM3u8Handler(ctx, w, r)
+			} else if splits[1] == "metadata.m3u8" {
+				return processWorker.hlsMetadataM3u8Handler(ctx, w, r)
+			} else if splits[1] == "metadata" && strings.HasSuffix(r.URL.Path, ".vtt") {
+				return processWorker.hlsWebVTTHandler(ctx, w, r)
+			}
+
+			// Format is :stream/annotated.m3u8 or :stream/annotated/:tsid.ts
+			if splits[1] == "annotated.m3u8" {
+				return processWorker.hlsAnnotatedM3u8Handler(ctx, w, r)
+			} else if splits[1] == "annotated" && strings.HasSuffix(r.URL.Path, ".ts") {
+				return processWorker.hlsAnnotatedTsHandler(ctx, w, r)
+			}
+
 			if strings.HasSuffix(r.URL.Path, ".m3u8") {
 				return processWorker.hlsM3u8Handler(ctx, w, r)
 			} else if strings.HasSuffix(r.URL.Path, ".ts") {
@@ -86,32 +120,111 @@ func (v *DetectWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 	return nil
 }
+// OnHlsTsMessage feed the on_hls message without blocking the hook, and drop it if the worker is busy, or
+// the stream is unpublished.
 func (v *DetectWorker) OnHlsTsMessage(ctx context.Context, msg *SrsOnHlsMessage) error {
+	if ok := func() bool {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		msg.generation = v.generations[msg.Stream]
+		return !v.unpublished[msg.Stream]
+	}(); !ok {
+		logger.Wf(ctx, "detect: drop %v for stream is unpublished", msg.String())
+		return nil
+	}
+
 	select {
 	case <-ctx.Done():
 	case v.msgs <- msg:
+	default:
+		metricChannelDrops.Inc(metricLabels("worker", "detect", "channel", "msgs"))
+		logger.Wf(ctx, "detect: drop %v for msgs is full", msg.String())
 	}
 
 	return nil
 }
 
-func (v *DetectWorker) OnHlsTsMessageImpl(ctx context.Context, msg *SrsOnHlsMessage) error {
-	// Copy the ts file to temporary cache dir.
-	tsid := uuid.NewString()
-	tsfile := path.Join("detect", fmt.Sprintf("%v.ts", tsid))
+// stale whether the message is of the previous publish of stream, should be dropped.
+func (v *DetectWorker) stale(msg *SrsOnHlsMessage) bool {
+	return v.unpublished[msg.Stream] || msg.generation != v.generations[msg.Stream]
+}
+
+// generation return the current publish generation of stream.
+func (v *DetectWorker) generation(stream string) uint64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.generations[stream]
+}
+
+// OnStreamPublished start a new generation of stream, to accept the on_hls messages.
+func (v *DetectWorker) OnStreamPublished(ctx context.Context, stream string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.generations[stream]++
+	delete(v.unpublished, stream)
+}
+
+// OnStreamUnpublished fence the stream by a new generation, so the late on_hls messages of the previous
+// publish are dropped and never resurrect the worker, then tear down the worker and accidents without
+// blocking the hook.
+func (v *DetectWorker) OnStreamUnpublished(ctx context.Context, stream *SrsStream) {
+	var processWorker *ProcessWorker
+	var generation uint64
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		generation = v.generations[stream.Stream]
+		v.generations[stream.Stream]++
+		v.unpublished[stream.Stream] = true
+		if obj, ok := v.workers.LoadAndDelete(stream.Stream); ok {
+			processWorker = obj.(*ProcessWorker)
+		}
+	}()
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		// Stop the worker before ending accidents, so no segment is fed to accidents after ended. Only end
+		// the accidents of this generation, because the stream might be published again.
+		if processWorker != nil {
+			if err := v.closeWorker(ctx, processWorker); err != nil {
+				logger.Wf(ctx, "process: ignore close worker %v err %+v", stream.Stream, err)
+			}
+		}
+		if err := accidentWorker.OnStreamUnpublished(ctx, stream, generation); err != nil {
+			logger.Wf(ctx, "accident: ignore end accidents of %v err %+v", stream.Stream, err)
+		}
+	}()
+}
 
-	// Always use execFile when params contains user inputs, see https://auth0.com/blog/preventing-command-injection-attacks-in-node-js-apps/
-	// Note that should never use fs.copyFileSync(file, tsfile, fs.constants.COPYFILE_FICLONE_FORCE) which fails in macOS.
-	if err := exec.CommandContext(ctx, "cp", "-f", msg.File, tsfile).Run(); err != nil {
-		return errors.Wrapf(err, "copy file %v to %v", msg.File, tsfile)
+func (v *DetectWorker) OnHlsTsMessageImpl(ctx context.Context, msg *SrsOnHlsMessage) error {
+	// Ignore the message of previous publish, which is late.
+	if stale := func() bool {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		return v.stale(msg)
+	}(); stale {
+		logger.Wf(ctx, "detect: drop stale %v", msg.String())
+		return nil
 	}
 
-	// Get the file size.
+	// Get the file size, before acquiring the reference which must be released on error.
 	stats, err := os.Stat(msg.File)
 	if err != nil {
 		return errors.Wrapf(err, "stat file %v", msg.File)
 	}
 
+	// Ingest the ts file to segment store, the reference is held by the process task.
+	tsid := uuid.NewString()
+	tsfile, err := segmentStore.Acquire(ctx, msg.File)
+	if err != nil {
+		return errors.Wrapf(err, "ingest file %v", msg.File)
+	}
+
 	// Create a local ts file object.
 	tsFile := &TsFile{
 		TsID:     tsid,
@@ -122,13 +235,21 @@ func (v *DetectWorker) OnHlsTsMessageImpl(ctx context.Context, msg *SrsOnHlsMess
 		File:     tsfile,
 	}
 
-	// Notify worker asynchronously.
-	go func() {
-		select {
-		case <-ctx.Done():
-		case v.tsfiles <- &SrsOnHlsObject{Msg: msg, TsFile: tsFile}:
-		}
-	}()
+	// Parse the timing and keyframes, ignore if failed, and probe by ffprobe when detecting.
+	if err := demuxTsFile(tsFile); err != nil {
+		logger.Wf(ctx, "detect: ignore demux %v err %+v", tsFile.String(), err)
+	}
+
+	// Notify worker, and drop the ts file if the worker is busy.
+	select {
+	case <-ctx.Done():
+		segmentStore.Release(ctx, tsFile.File)
+	case v.tsfiles <- &SrsOnHlsObject{Msg: msg, TsFile: tsFile}:
+	default:
+		metricChannelDrops.Inc(metricLabels("worker", "detect", "channel", "tsfiles"))
+		segmentStore.Release(ctx, tsFile.File)
+		logger.Wf(ctx, "detect: drop %v for tsfiles is full", tsFile.String())
+	}
 	return nil
 }
 
@@ -140,6 +261,40 @@ func (v *DetectWorker) Close() error {
 	return nil
 }
 
+// removeWorker stop the process worker of stream, and dispose its task and files.
+func (v *DetectWorker) removeWorker(ctx context.Context, stream string) error {
+	obj, ok := func() (interface{}, bool) {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		return v.workers.LoadAndDelete(stream)
+	}()
+	if !ok {
+		return nil
+	}
+
+	return v.closeWorker(ctx, obj.(*ProcessWorker))
+}
+
+// closeWorker stop the process worker which is removed, and dispose its task and the pending files.
+func (v *DetectWorker) closeWorker(ctx context.Context, processWorker *ProcessWorker) error {
+	if err := processWorker.Close(); err != nil {
+		return errors.Wrapf(err, "close worker %v", processWorker.Stream)
+	}
+
+	// Release the ts files which are not consumed by the worker.
+	for len(processWorker.tsfiles) > 0 {
+		msg := <-processWorker.tsfiles
+		segmentStore.Release(ctx, msg.TsFile.File)
+	}
+
+	if err := processWorker.task.dispose(ctx); err != nil {
+		return errors.Wrapf(err, "dispose task %v", processWorker.task.String())
+	}
+
+	logger.Tf(ctx, "process: remove worker %v, task %v", processWorker.Stream, processWorker.task.String())
+	return nil
+}
+
 func (v *DetectWorker) QueryTask(uuid string) *ProcessWorker {
 	var target *ProcessWorker
 	v.workers.Range(func(key, value interface{}) bool {
@@ -161,15 +316,33 @@ func (v *DetectWorker) Start(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "Record: start a worker")
 
+	// Restore the process workers of active streams, before consuming any message.
+	if err := v.restoreWorkers(ctx); err != nil {
+		return errors.Wrapf(err, "restore workers")
+	}
+
 	// Create M3u8 object from message.
 	createWorker := func(ctx context.Context, msg *SrsOnHlsObject) error {
-		// Load stream local object.
+		// Load stream local object, never create worker for the message of previous publish.
 		var processWorker *ProcessWorker
-		var freshObject bool
-		if obj, loaded := v.workers.LoadOrStore(msg.Msg.Stream, &ProcessWorker{
-			Stream: msg.Msg.Stream, UUID: uuid.NewString(), detectWorker: v,
-		}); true {
-			processWorker, freshObject = obj.(*ProcessWorker), !loaded
+		var freshObject, stale bool
+		func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			if stale = v.stale(msg.Msg); stale {
+				return
+			}
+			if obj, loaded := v.workers.LoadOrStore(msg.Msg.Stream, &ProcessWorker{
+				Stream: msg.Msg.Stream, UUID: uuid.NewString(), detectWorker: v,
+			}); true {
+				processWorker, freshObject = obj.(*ProcessWorker), !loaded
+			}
+		}()
+		if stale {
+			segmentStore.Release(ctx, msg.TsFile.File)
+			logger.Wf(ctx, "detect: drop stale %v", msg.TsFile.String())
+			return nil
 		}
 
 		// Initialize the fresh object.
@@ -225,4 +398,96 @@ func (v *DetectWorker) Start(ctx context.Context) error {
 	}()
 
 	return nil
-}
\ No newline at end of file
+}
+
+// restoreWorkers load the process tasks from redis, restore the worker for each active stream, and dispose
+// the tasks of inactive streams. The files in process directory which are not used by any task are removed,
+// before starting the workers.
+func (v *DetectWorker) restoreWorkers(ctx context.Context) error {
+	objs, err := rdb.HGetAll(ctx, PROCESS_TASK).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", PROCESS_TASK)
+	}
+
+	activeStreams, err := queryActiveStreams(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query active streams")
+	}
+
+	var files []string
+	var workers []*ProcessWorker
+	for taskUUID, obj := range objs {
+		task := NewProcessTask()
+		if err := json.Unmarshal([]byte(obj), task); err != nil {
+			logger.Wf(ctx, "process: drop invalid task %v %v err %+v", taskUUID, obj, err)
+			if err := rdb.HDel(ctx, PROCESS_TASK, taskUUID).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", PROCESS_TASK, taskUUID)
+			}
+			continue
+		}
+		task.UUID = taskUUID
+
+		// For the task without stream, try to use the stream of segments.
+		for _, queue := range []*ProcessQueue{task.LiveQueue, task.DetectQueue, task.FinishQueue} {
+			for _, segment := range queue.Segments {
+				if task.Stream == "" && segment.Msg != nil {
+					task.Stream = segment.Msg.Stream
+				}
+			}
+		}
+
+		// Dispose the task if stream is not active, or there is already a task for stream.
+		stream, active := activeStreams[task.Stream]
+		if _, exists := v.workers.Load(task.Stream); !active || exists {
+			if err := task.dispose(ctx); err != nil {
+				return errors.Wrapf(err, "dispose task %v", task.String())
+			}
+			logger.Tf(ctx, "process: dispose task %v, active=%v, exists=%v", task.String(), active, exists)
+			continue
+		}
+
+		processWorker := &ProcessWorker{Stream: task.Stream, UUID: uuid.NewString(), detectWorker: v}
+		if err := processWorker.Initialize(v); err != nil {
+			return errors.Wrapf(err, "init process worker")
+		}
+		if err := processWorker.Restore(ctx, task); err != nil {
+			return errors.Wrapf(err, "restore process worker")
+		}
+		task.inputStream = stream
+		task.notifyPersistence(ctx)
+
+		v.workers.Store(task.Stream, processWorker)
+		workers = append(workers, processWorker)
+
+		files = append(files, task.files()...)
+		logger.Tf(ctx, "process: restore task %v of %v", task.String(), stream.String())
+	}
+
+	// Cleanup the temporary files which are not used by any task. Must be done before starting workers, or
+	// the new files generated by workers are removed.
+	var removed int
+	if err := filepath.WalkDir("process/", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ext := path.Ext(p); ext != ".ts" && ext != ".jpg" {
+			return nil
+		}
+		if !slicesContains(files, p) {
+			os.Remove(p)
+			removed++
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "walk process")
+	}
+
+	for _, processWorker := range workers {
+		if _, err := StartWorker(processWorker, ctx); err != nil {
+			return errors.Wrapf(err, "start process worker %v", processWorker.Stream)
+		}
+	}
+
+	logger.Tf(ctx, "process: restore workers ok, tasks=%v, files=%v, removed=%v", len(objs), len(files), removed)
+	return nil
+}
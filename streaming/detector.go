@@ -0,0 +1,267 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// The detector backends.
+const (
+	// Post the image as base64 in a JSON body, the original protocol of AI server.
+	DetectorTypeHTTP = "http"
+	// Post the image as binary in a multipart form.
+	DetectorTypeMultipart = "multipart"
+	// Run a local plugin, write image to stdin and read results from stdout.
+	DetectorTypeExec = "exec"
+	// A deterministic detector without AI server, for test only.
+	DetectorTypeFake = "fake"
+)
+
+// Detector detects objects in an image file, and returns COCO-style results.
+type Detector interface {
+	Detect(ctx context.Context, image *TsFile) ([]ProcessDetectResult, error)
+}
+
+// DetectorConfig is the detector config for a stream, see PROCESS_DETECTOR.
+type DetectorConfig struct {
+	// The detector backend, such as http, multipart, exec or fake.
+	Type string `json:"type"`
+	// The url of AI server, for http and multipart.
+	URL string `json:"url,omitempty"`
+	// The form field of image, for multipart, default to image.
+	Field string `json:"field,omitempty"`
+	// The plugin to execute, for exec.
+	Command string `json:"command,omitempty"`
+	// The args of plugin, for exec.
+	Args []string `json:"args,omitempty"`
+	// The timeout in seconds for each image.
+	Timeout float64 `json:"timeout,omitempty"`
+	// The results to return, for fake.
+	Results []ProcessDetectResult `json:"results,omitempty"`
+	// Only return results for every N segments by seqno, for fake. Default to 1, every segment.
+	Every uint64 `json:"every,omitempty"`
+	// The latency budget in seconds of stream, default to PROCESS_LATENCY_BUDGET.
+	Budget float64 `json:"budget,omitempty"`
+}
+
+func (v *DetectorConfig) String() string {
+	return fmt.Sprintf("type=%v, url=%v, field=%v, command=%v, args=%v, timeout=%v, results=%v, every=%v, budget=%v",
+		v.Type, v.URL, v.Field, v.Command, v.Args, v.Timeout, len(v.Results), v.Every, v.Budget,
+	)
+}
+
+// The interval to reload the detector config of stream from redis.
+const detectorConfigReloadInterval = 10 * time.Second
+
+// loadDetectorConfig load the detector config of stream from redis, or use the default config from env.
+func loadDetectorConfig(ctx context.Context, stream string) (*DetectorConfig, error) {
+	c := &DetectorConfig{
+		Type: envDetectorType(), URL: envDetectorURL(), Command: envDetectorCommand(),
+	}
+	if args := envDetectorArgs(); args != "" {
+		c.Args = strings.Fields(args)
+	}
+
+	if value, err := rdb.HGet(ctx, PROCESS_DETECTOR, stream).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", PROCESS_DETECTOR, stream)
+	} else if value != "" {
+		if err = json.Unmarshal([]byte(value), c); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+
+	return c, nil
+}
+
+// NewDetector create a detector by config.
+func NewDetector(c *DetectorConfig) (Detector, error) {
+	timeout := time.Duration(c.Timeout * float64(time.Second))
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	switch c.Type {
+	case DetectorTypeHTTP, "":
+		if c.URL == "" {
+			return nil, errors.Errorf("no url for detector %v", c.String())
+		}
+		return &httpDetector{url: c.URL, timeout: timeout}, nil
+	case DetectorTypeMultipart:
+		if c.URL == "" {
+			return nil, errors.Errorf("no url for detector %v", c.String())
+		}
+		field := c.Field
+		if field == "" {
+			field = "image"
+		}
+		return &multipartDetector{url: c.URL, field: field, timeout: timeout}, nil
+	case DetectorTypeExec:
+		if c.Command == "" {
+			return nil, errors.Errorf("no command for detector %v", c.String())
+		}
+		return &execDetector{command: c.Command, args: c.Args, timeout: timeout}, nil
+	case DetectorTypeFake:
+		return &fakeDetector{results: c.Results, every: c.Every}, nil
+	}
+
+	return nil, errors.Errorf("invalid detector type %v", c.Type)
+}
+
+// httpDetector post the image in base64 to AI server, in JSON {content: base64}.
+type httpDetector struct {
+	url     string
+	timeout time.Duration
+}
+
+func (v *httpDetector) Detect(ctx context.Context, image *TsFile) ([]ProcessDetectResult, error) {
+	data, err := os.ReadFile(image.File)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read image from %v", image.File)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	var results []ProcessDetectResult
+	if err := postImageBase64(ctx, v.url, base64.StdEncoding.EncodeToString(data), &results); err != nil {
+		return nil, errors.Wrapf(err, "post image %v (%v)", image.File, len(data))
+	}
+	return results, nil
+}
+
+// multipartDetector post the image in binary to AI server, in a multipart form.
+type multipartDetector struct {
+	url     string
+	field   string
+	timeout time.Duration
+}
+
+func (v *multipartDetector) Detect(ctx context.Context, image *TsFile) ([]ProcessDetectResult, error) {
+	data, err := os.ReadFile(image.File)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read image from %v", image.File)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if fw, err := mw.CreateFormFile(v.field, path.Base(image.File)); err != nil {
+		return nil, errors.Wrapf(err, "create form file %v", v.field)
+	} else if _, err = fw.Write(data); err != nil {
+		return nil, errors.Wrapf(err, "write form file %v", v.field)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, errors.Wrapf(err, "close multipart")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	var results []ProcessDetectResult
+	if err := postDetectRequest(ctx, v.url, mw.FormDataContentType(), &body, &results); err != nil {
+		return nil, errors.Wrapf(err, "post image %v (%v)", image.File, len(data))
+	}
+	return results, nil
+}
+
+// execDetector run a local plugin, which reads the image from stdin, and writes results in JSON to stdout.
+type execDetector struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+func (v *execDetector) Detect(ctx context.Context, image *TsFile) ([]ProcessDetectResult, error) {
+	f, err := os.Open(image.File)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open image %v", image.File)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, v.command, v.args...)
+	cmd.Stdin, cmd.Stderr = f, &stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("DETECT_IMAGE_ID=%v", image.TsID))
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "exec %v %v, stderr is %v", v.command, v.args, stderr.String())
+	}
+
+	var results []ProcessDetectResult
+	if b := bytes.TrimSpace(stdout); len(b) > 0 {
+		if err := json.Unmarshal(b, &results); err != nil {
+			return nil, errors.Wrapf(err, "json unmarshal %v", string(b))
+		}
+	}
+	return results, nil
+}
+
+// fakeDetector always returns the configured results, without reading the image.
+type fakeDetector struct {
+	results []ProcessDetectResult
+	every   uint64
+}
+
+func (v *fakeDetector) Detect(ctx context.Context, image *TsFile) ([]ProcessDetectResult, error) {
+	if v.every > 1 && image.SeqNo%v.every != 0 {
+		return nil, nil
+	}
+
+	var results []ProcessDetectResult
+	for _, r := range v.results {
+		r.BBox = append([]float64{}, r.BBox...)
+		r.ImageId = image.TsID
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// postDetectRequest post the body to AI server, and parse the JSON response to v.
+func postDetectRequest(ctx context.Context, url, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return errors.Wrapf(err, "new request, url=%v", url)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "api post failed, url=%v", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("api returned non-200 status code, url=%v, status=%v", url, resp.Status)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "api read failed, url=%v", url)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrapf(err, "json unmarshal %v", string(b))
+	}
+
+	return nil
+}
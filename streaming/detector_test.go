@@ -0,0 +1,208 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestNewDetector(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config DetectorConfig
+		err    bool
+	}{
+		{name: "default to http", config: DetectorConfig{URL: "http://127.0.0.1/detect"}},
+		{name: "http", config: DetectorConfig{Type: DetectorTypeHTTP, URL: "http://127.0.0.1/detect"}},
+		{name: "http without url", config: DetectorConfig{Type: DetectorTypeHTTP}, err: true},
+		{name: "multipart", config: DetectorConfig{Type: DetectorTypeMultipart, URL: "http://127.0.0.1/detect"}},
+		{name: "multipart without url", config: DetectorConfig{Type: DetectorTypeMultipart}, err: true},
+		{name: "exec", config: DetectorConfig{Type: DetectorTypeExec, Command: "sh"}},
+		{name: "exec without command", config: DetectorConfig{Type: DetectorTypeExec}, err: true},
+		{name: "fake", config: DetectorConfig{Type: DetectorTypeFake}},
+		{name: "invalid type", config: DetectorConfig{Type: "grpc", URL: "http://127.0.0.1/detect"}, err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			detector, err := NewDetector(&c.config)
+			if c.err && err == nil {
+				t.Fatalf("expect error, got %+v", detector)
+			} else if !c.err && err != nil {
+				t.Fatalf("new detector err %+v", err)
+			}
+		})
+	}
+}
+
+func TestDetectorDetect(t *testing.T) {
+	image := []byte("jpeg image data")
+	results := []ProcessDetectResult{{BBox: []float64{1, 2, 3, 4}, Score: 0.9, Category: 1}}
+
+	// The AI server verifies the image in base64 JSON or multipart form, then responds the status and results.
+	var status int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data []byte
+		switch r.URL.Path {
+		case "/json":
+			var obj struct {
+				Content string `json:"content"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ = base64.StdEncoding.DecodeString(obj.Content)
+		case "/form":
+			f, _, err := r.FormFile("picture")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer f.Close()
+			data, _ = io.ReadAll(f)
+		}
+
+		if string(data) != string(image) {
+			http.Error(w, "invalid image", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(status)
+		if status == http.StatusOK || status == http.StatusCreated {
+			json.NewEncoder(w).Encode(results)
+		}
+	}))
+	defer server.Close()
+
+	file := path.Join(t.TempDir(), "1.jpg")
+	if err := os.WriteFile(file, image, 0644); err != nil {
+		t.Fatalf("write image err %+v", err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		config DetectorConfig
+		// The status of AI server.
+		status int
+		// The image to detect, default to the image file.
+		file  string
+		seqNo uint64
+		// The results, whose image id is the tsid if not empty.
+		results []ProcessDetectResult
+		err     bool
+	}{
+		{
+			name: "http", config: DetectorConfig{Type: DetectorTypeHTTP, URL: server.URL + "/json"},
+			status: http.StatusOK, results: results,
+		},
+		{
+			name: "http created", config: DetectorConfig{Type: DetectorTypeHTTP, URL: server.URL + "/json"},
+			status: http.StatusCreated, results: results,
+		},
+		{
+			name: "http server error", config: DetectorConfig{Type: DetectorTypeHTTP, URL: server.URL + "/json"},
+			status: http.StatusInternalServerError, err: true,
+		},
+		{
+			name: "http no image", config: DetectorConfig{Type: DetectorTypeHTTP, URL: server.URL + "/json"},
+			status: http.StatusOK, file: "/not/exists.jpg", err: true,
+		},
+		{
+			name:   "multipart",
+			config: DetectorConfig{Type: DetectorTypeMultipart, URL: server.URL + "/form", Field: "picture"},
+			status: http.StatusOK, results: results,
+		},
+		{
+			name: "multipart other field", config: DetectorConfig{Type: DetectorTypeMultipart, URL: server.URL + "/form"},
+			status: http.StatusOK, err: true,
+		},
+		{
+			name: "exec",
+			config: DetectorConfig{Type: DetectorTypeExec, Command: "sh", Args: []string{"-c",
+				`test "$(cat)" = "$0" && echo '[{"bbox":[1,2,3,4],"score":0.9,"category_id":1}]'`, string(image),
+			}},
+			results: results,
+		},
+		{
+			name: "exec image id",
+			config: DetectorConfig{Type: DetectorTypeExec, Command: "sh", Args: []string{"-c",
+				`cat >/dev/null; echo "[{\"score\":0.9,\"image_id\":\"$DETECT_IMAGE_ID\"}]"`,
+			}},
+			results: []ProcessDetectResult{{Score: 0.9, ImageId: "1"}},
+		},
+		{
+			name:   "exec no results",
+			config: DetectorConfig{Type: DetectorTypeExec, Command: "sh", Args: []string{"-c", "cat >/dev/null"}},
+		},
+		{
+			name:   "exec failed",
+			config: DetectorConfig{Type: DetectorTypeExec, Command: "sh", Args: []string{"-c", "exit 1"}},
+			err:    true,
+		},
+		{
+			name:   "exec invalid results",
+			config: DetectorConfig{Type: DetectorTypeExec, Command: "sh", Args: []string{"-c", "echo ok"}},
+			err:    true,
+		},
+		{
+			name: "exec timeout",
+			config: DetectorConfig{Type: DetectorTypeExec, Command: "sh", Args: []string{"-c", "exec sleep 3"},
+				Timeout: 0.1,
+			},
+			err: true,
+		},
+		{
+			name: "fake", config: DetectorConfig{Type: DetectorTypeFake, Results: results},
+			file: "/not/exists.jpg", results: []ProcessDetectResult{{
+				BBox: []float64{1, 2, 3, 4}, Score: 0.9, Category: 1, ImageId: "1",
+			}},
+		},
+		{
+			name: "fake every segment", config: DetectorConfig{Type: DetectorTypeFake, Results: results, Every: 2},
+			seqNo: 4, results: []ProcessDetectResult{{
+				BBox: []float64{1, 2, 3, 4}, Score: 0.9, Category: 1, ImageId: "1",
+			}},
+		},
+		{
+			name: "fake skip segment", config: DetectorConfig{Type: DetectorTypeFake, Results: results, Every: 2},
+			seqNo: 3,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			status = c.status
+
+			detector, err := NewDetector(&c.config)
+			if err != nil {
+				t.Fatalf("new detector err %+v", err)
+			}
+
+			tsFile := &TsFile{TsID: "1", File: file, SeqNo: c.seqNo}
+			if c.file != "" {
+				tsFile.File = c.file
+			}
+
+			r0, err := detector.Detect(context.Background(), tsFile)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expect error, got %+v", r0)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("detect err %+v", err)
+			}
+			if !reflect.DeepEqual(r0, c.results) {
+				t.Errorf("expect %+v, got %+v", c.results, r0)
+			}
+		})
+	}
+}
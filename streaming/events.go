@@ -0,0 +1,485 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+var eventHub *EventHub
+
+// The types of event.
+const (
+	// The detections of a segment, for every segment even not detected.
+	EventTypeDetect = "detect"
+	// The accident is confirmed and begin to record.
+	EventTypeAccidentBegin = "accident.begin"
+	// The accident is ended and recorded.
+	EventTypeAccidentEnd = "accident.end"
+)
+
+// The max number of events to keep, for client to resume by cursor.
+const maxEvents = 1024
+
+// The interval to send heartbeat to client, to keep the connection alive.
+const eventHeartbeat = 15 * time.Second
+
+// Event is a message pushed to clients by SSE or WebSocket.
+type Event struct {
+	// The sequence number of event, which is the cursor to resume.
+	Seq uint64 `json:"seq"`
+	// The type of event, see EventTypeDetect and so on.
+	Type string `json:"type"`
+	// The stream name.
+	Stream string `json:"stream"`
+	// The time of event, in RFC3339.
+	Time string `json:"time"`
+
+	// For detect event, the segment and its detections.
+	SeqNo    uint64                `json:"seqno,omitempty"`
+	TsID     string                `json:"tsid,omitempty"`
+	Duration float64               `json:"duration,omitempty"`
+	Results  []ProcessDetectResult `json:"results,omitempty"`
+
+	// For accident event, the category and accident.
+	Category     int    `json:"category,omitempty"`
+	AccidentType string `json:"accidentType,omitempty"`
+	AccidentId   int    `json:"accidentId,omitempty"`
+	UUID         string `json:"uuid,omitempty"`
+	SnapshotURL  string `json:"snapshotUrl,omitempty"`
+}
+
+func (v *Event) String() string {
+	return fmt.Sprintf("seq=%v, type=%v, stream=%v, seqno=%v, results=%v, category=%v, accident=%v, uuid=%v",
+		v.Seq, v.Type, v.Stream, v.SeqNo, len(v.Results), v.Category, v.AccidentId, v.UUID,
+	)
+}
+
+// filter the event by categories, return nil if not match. For detect event, only the matched results
+// are kept. All events match if no categories.
+func (v *Event) filter(categories map[int]bool) *Event {
+	if len(categories) == 0 {
+		return v
+	}
+
+	if v.Type != EventTypeDetect {
+		if categories[v.Category] {
+			return v
+		}
+		return nil
+	}
+
+	var results []ProcessDetectResult
+	for _, result := range v.Results {
+		if categories[result.Category] {
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	r := *v
+	r.Results = results
+	return &r
+}
+
+// EventHub keeps the latest events in memory, and notifies the clients when new event published.
+type EventHub struct {
+	// The sequence number of the last event.
+	seq uint64
+	// The latest events, ordered by seq.
+	events []*Event
+	// Closed when new event published, then replaced by a new channel.
+	notify chan struct{}
+	// Closed when hub closed.
+	done chan struct{}
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		notify: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (v *EventHub) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	select {
+	case <-v.done:
+	default:
+		close(v.done)
+	}
+	return nil
+}
+
+// Publish the event, the seq and time are set by hub.
+func (v *EventHub) Publish(ctx context.Context, event *Event) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.seq++
+	event.Seq = v.seq
+	if event.Time == "" {
+		event.Time = time.Now().Format(time.RFC3339)
+	}
+
+	v.events = append(v.events, event)
+	if len(v.events) > maxEvents {
+		v.events = append([]*Event{}, v.events[len(v.events)-maxEvents:]...)
+	}
+
+	close(v.notify)
+	v.notify = make(chan struct{})
+}
+
+// since return the events after cursor, and the channel to wait for new events. If cursor is larger than
+// the last seq, for example, the hub is restarted, return all events.
+func (v *EventHub) since(cursor uint64) ([]*Event, <-chan struct{}) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if cursor > v.seq {
+		cursor = 0
+	}
+
+	var events []*Event
+	for _, event := range v.events {
+		if event.Seq > cursor {
+			events = append(events, event)
+		}
+	}
+	return events, v.notify
+}
+
+// last return the seq of the last event.
+func (v *EventHub) last() uint64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.seq
+}
+
+// eventSubscriber is the stream, filter and cursor of a client.
+type eventSubscriber struct {
+	// The hub to subscribe.
+	hub *EventHub
+	// The stream to subscribe, all streams if empty.
+	stream string
+	// The categories to subscribe, all categories if empty.
+	categories map[int]bool
+	// The seq of the last event sent to client.
+	cursor uint64
+}
+
+// newEventSubscriber parse the subscriber from request, the format is:
+//
+//	/detect/events/:stream?category=1,7&cursor=100
+//
+// The cursor is also parsed from Last-Event-ID of SSE. Only new events are sent if no cursor.
+func newEventSubscriber(hub *EventHub, r *http.Request, prefix string) (*eventSubscriber, error) {
+	v := &eventSubscriber{
+		hub:        hub,
+		stream:     strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"),
+		categories: make(map[int]bool),
+		cursor:     hub.last(),
+	}
+
+	q := r.URL.Query()
+	if categories := q.Get("category"); categories != "" {
+		for _, category := range strings.Split(categories, ",") {
+			if id, err := strconv.Atoi(strings.TrimSpace(category)); err != nil {
+				return nil, errors.Wrapf(err, "invalid category %v", category)
+			} else {
+				v.categories[id] = true
+			}
+		}
+	}
+
+	cursor := q.Get("cursor")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		cursor = id
+	}
+	if cursor != "" {
+		if seq, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid cursor %v", cursor)
+		} else {
+			v.cursor = seq
+		}
+	}
+
+	return v, nil
+}
+
+// poll return the events for subscriber after its cursor, and move the cursor.
+func (v *eventSubscriber) poll() ([]*Event, <-chan struct{}) {
+	events, notify := v.hub.since(v.cursor)
+
+	var matched []*Event
+	for _, event := range events {
+		v.cursor = event.Seq
+		if v.stream != "" && event.Stream != v.stream {
+			continue
+		}
+		if event = event.filter(v.categories); event != nil {
+			matched = append(matched, event)
+		}
+	}
+	return matched, notify
+}
+
+func (v *EventHub) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/detect/events/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			subscriber, err := newEventSubscriber(v, r, ep)
+			if err != nil {
+				return errors.Wrapf(err, "parse subscriber")
+			}
+
+			if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				return v.serveWebSocket(ctx, w, r, subscriber)
+			}
+			return v.serveSSE(ctx, w, r, subscriber)
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+// serveSSE push events to client by Server-Sent Events, the id of event is the seq, so the browser
+// resumes by Last-Event-ID when reconnect.
+func (v *EventHub) serveSSE(ctx context.Context, w http.ResponseWriter, r *http.Request, subscriber *eventSubscriber) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.Errorf("not support flush")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logger.Tf(ctx, "event: sse subscribe stream=%v, categories=%v, cursor=%v",
+		subscriber.stream, len(subscriber.categories), subscriber.cursor)
+
+	for {
+		events, notify := subscriber.poll()
+		for _, event := range events {
+			b, err := json.Marshal(event)
+			if err != nil {
+				return errors.Wrapf(err, "marshal %v", event.String())
+			}
+			if _, err := fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %v\n\n", event.Seq, event.Type, string(b)); err != nil {
+				return nil
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-v.done:
+			return nil
+		case <-notify:
+		case <-time.After(eventHeartbeat):
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// The GUID to generate Sec-WebSocket-Accept, see RFC6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The opcodes of WebSocket frame, see RFC6455.
+const (
+	websocketOpText  = 0x1
+	websocketOpClose = 0x8
+	websocketOpPing  = 0x9
+	websocketOpPong  = 0xa
+)
+
+// serveWebSocket push events to client by WebSocket, each event is a text frame of JSON.
+func (v *EventHub) serveWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, subscriber *eventSubscriber) error {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return errors.Errorf("invalid websocket handshake")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.Errorf("not support hijack")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return errors.Wrapf(err, "hijack")
+	}
+	defer conn.Close()
+
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	if _, err := fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", accept); err != nil {
+		return nil
+	}
+	if err := rw.Flush(); err != nil {
+		return nil
+	}
+
+	logger.Tf(ctx, "event: websocket subscribe stream=%v, categories=%v, cursor=%v",
+		subscriber.stream, len(subscriber.categories), subscriber.cursor)
+
+	// The writer is shared by the reader for pong and close.
+	var lock sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := writeWebSocketFrame(rw.Writer, opcode, payload); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+
+	// Read the frames from client, to response ping and close.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := readWebSocketFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			if opcode == websocketOpPing {
+				write(websocketOpPong, payload)
+			} else if opcode == websocketOpClose {
+				write(websocketOpClose, payload)
+				return
+			}
+		}
+	}()
+
+	for {
+		events, notify := subscriber.poll()
+		for _, event := range events {
+			b, err := json.Marshal(event)
+			if err != nil {
+				return errors.Wrapf(err, "marshal %v", event.String())
+			}
+			if err := write(websocketOpText, b); err != nil {
+				return nil
+			}
+		}
+
+		select {
+		case <-closed:
+			return nil
+		case <-v.done:
+			write(websocketOpClose, nil)
+			return nil
+		case <-notify:
+		case <-time.After(eventHeartbeat):
+			if err := write(websocketOpPing, nil); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// writeWebSocketFrame write a final frame without mask, for server to client.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	if n := len(payload); n < 126 {
+		header = append(header, byte(n))
+	} else if n <= 0xffff {
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	} else {
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// The max payload of frame from client, which only sends control frames.
+const maxWebSocketPayload = 64 * 1024
+
+// readWebSocketFrame read a frame from client, which is always masked.
+func readWebSocketFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	size := uint64(header[1] & 0x7f)
+	if size == 126 {
+		b := make([]byte, 2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(b))
+	} else if size == 127 {
+		b := make([]byte, 8)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(b)
+	}
+	if size > maxWebSocketPayload {
+		err = errors.Errorf("payload %v too large", size)
+		return
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(r, mask); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		if masked {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The modes to sample frames from a segment.
+const (
+	// Sample frames evenly spaced by duration of segment.
+	FrameModeEven = "even"
+	// Sample the keyframes of segment.
+	FrameModeKeyframe = "keyframe"
+)
+
+// The methods to aggregate the detections of frames.
+const (
+	// Use the frame with max score for each category.
+	FrameAggregateMax = "max"
+	// Same to max, but only if the category is detected in most of frames.
+	FrameAggregateVote = "vote"
+)
+
+// ProcessFrame is a frame sampled from segment, and the detections of it.
+type ProcessFrame struct {
+	// The extracted image file.
+	ImageFile *TsFile `json:"image,omitempty"`
+	// The offset in seconds from the start of segment.
+	Offset float64 `json:"offset"`
+	// The detections of this frame.
+	BoundingBox []ProcessDetectResult `json:"bounding,omitempty"`
+}
+
+func (v *ProcessFrame) String() string {
+	return fmt.Sprintf("image=%v, offset=%v, bounding=%v", v.ImageFile.File, v.Offset, len(v.BoundingBox))
+}
+
+// FrameSampler samples frames from a segment, and aggregates the detections of frames.
+type FrameSampler struct {
+	// The number of frames for each segment.
+	Frames int
+	// The mode to sample frames, even or keyframe.
+	Mode string
+	// The method to aggregate detections, max or vote.
+	Aggregate string
+}
+
+// NewFrameSampler create the sampler from env.
+func NewFrameSampler() *FrameSampler {
+	v := &FrameSampler{Frames: 1, Mode: FrameModeEven, Aggregate: FrameAggregateMax}
+	if n, err := strconv.Atoi(envProcessFrames()); err == nil && n > 0 {
+		v.Frames = n
+	}
+	if mode := envProcessFrameMode(); mode == FrameModeKeyframe {
+		v.Mode = mode
+	}
+	if aggregate := envProcessFrameAggregate(); aggregate == FrameAggregateVote {
+		v.Aggregate = aggregate
+	}
+	return v
+}
+
+// WithFrames return a copy of sampler, which samples n frames.
+func (v *FrameSampler) WithFrames(n int) *FrameSampler {
+	return &FrameSampler{Frames: n, Mode: v.Mode, Aggregate: v.Aggregate}
+}
+
+func (v *FrameSampler) String() string {
+	return fmt.Sprintf("frames=%v, mode=%v, aggregate=%v", v.Frames, v.Mode, v.Aggregate)
+}
+
+// Extract the frames from ts file, to images in 640x640, the id of image is prefix-N.
+func (v *FrameSampler) Extract(ctx context.Context, tsFile *TsFile, prefix string) ([]*ProcessFrame, error) {
+	var frames []*ProcessFrame
+	var err error
+	if v.Mode == FrameModeKeyframe && len(tsFile.Keyframes) > 0 {
+		frames, err = v.extractKeyframesAt(ctx, tsFile, prefix)
+	} else if v.Mode == FrameModeKeyframe {
+		frames, err = v.extractKeyframes(ctx, tsFile, prefix)
+	} else {
+		frames, err = v.extractEven(ctx, tsFile, prefix)
+	}
+
+	// Cleanup the extracted images if failed.
+	if err == nil && len(frames) == 0 {
+		err = errors.Errorf("no frame in %v", tsFile.File)
+	}
+	if err != nil {
+		for _, frame := range frames {
+			os.Remove(frame.ImageFile.File)
+		}
+		return nil, err
+	}
+
+	for _, frame := range frames {
+		if stats, err := os.Stat(frame.ImageFile.File); err != nil {
+			return nil, errors.Wrapf(err, "stat file %v", frame.ImageFile.File)
+		} else {
+			frame.ImageFile.Size = uint64(stats.Size())
+		}
+	}
+	return frames, nil
+}
+
+func (v *FrameSampler) newFrame(tsFile *TsFile, prefix string, index int, offset float64) *ProcessFrame {
+	imageFile := &TsFile{
+		TsID:     fmt.Sprintf("%v-%v", prefix, index),
+		URL:      tsFile.URL,
+		SeqNo:    tsFile.SeqNo,
+		Duration: tsFile.Duration,
+	}
+	imageFile.File = path.Join("process", fmt.Sprintf("%v.jpg", imageFile.TsID))
+	return &ProcessFrame{ImageFile: imageFile, Offset: offset}
+}
+
+// extractEven seek to each offset evenly spaced, and extract a frame. Note that the first frame is always
+// at the start of segment.
+func (v *FrameSampler) extractEven(ctx context.Context, tsFile *TsFile, prefix string) ([]*ProcessFrame, error) {
+	var frames []*ProcessFrame
+	for i := 0; i < v.Frames; i++ {
+		offset := tsFile.Duration * float64(i) / float64(v.Frames)
+		frame := v.newFrame(tsFile, prefix, i, offset)
+
+		args := []string{
+			"-ss", fmt.Sprintf("%.3f", offset),
+			"-i", tsFile.File,
+			"-frames:v", "1", "-q:v", "10",
+			"-vf", "scale=640:640",
+			"-y", frame.ImageFile.File,
+		}
+		if err := exec.CommandContext(ctx, "ffmpeg", args...).Run(); err != nil {
+			return frames, errors.Wrapf(err, "transcode %v", args)
+		}
+
+		// Ignore if seek out of segment, which generates no image.
+		if _, err := os.Stat(frame.ImageFile.File); err != nil && i > 0 {
+			break
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// extractKeyframesAt seek to the keyframes parsed by demuxer, and extract N keyframes evenly spaced. It's
+// fast because each seek lands on a keyframe, without decoding the other frames.
+func (v *FrameSampler) extractKeyframesAt(ctx context.Context, tsFile *TsFile, prefix string) ([]*ProcessFrame, error) {
+	var frames []*ProcessFrame
+	n := v.Frames
+	if n > len(tsFile.Keyframes) {
+		n = len(tsFile.Keyframes)
+	}
+	for i := 0; i < n; i++ {
+		offset := tsFile.Keyframes[i*len(tsFile.Keyframes)/n]
+		frame := v.newFrame(tsFile, prefix, i, offset)
+
+		args := []string{
+			"-ss", fmt.Sprintf("%.3f", offset),
+			"-i", tsFile.File,
+			"-frames:v", "1", "-q:v", "10",
+			"-vf", "scale=640:640",
+			"-y", frame.ImageFile.File,
+		}
+		if err := exec.CommandContext(ctx, "ffmpeg", args...).Run(); err != nil {
+			return frames, errors.Wrapf(err, "transcode %v", args)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// The pts_time of showinfo filter, for example, "n:   0 pts:  12000 pts_time:0.133333 ...".
+var showinfoPtsTime = regexp.MustCompile(`\sn:\s*(\d+)\s.*\spts_time:([-\d.]+)`)
+
+// extractKeyframes decode only the keyframes, and extract the first N keyframes. The offset of keyframe
+// is parsed from the showinfo filter.
+func (v *FrameSampler) extractKeyframes(ctx context.Context, tsFile *TsFile, prefix string) ([]*ProcessFrame, error) {
+	pattern := path.Join("process", fmt.Sprintf("%v-%%d.jpg", prefix))
+	args := []string{
+		"-skip_frame", "nokey",
+		"-i", tsFile.File,
+		"-frames:v", fmt.Sprintf("%v", v.Frames), "-q:v", "10",
+		"-vf", "scale=640:640,showinfo", "-vsync", "vfr",
+		"-start_number", "0",
+		"-y", pattern,
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	// Note that showinfo might print more frames than the output images, so check the image file.
+	var frames []*ProcessFrame
+	for _, match := range showinfoPtsTime.FindAllStringSubmatch(stderr.String(), -1) {
+		index, _ := strconv.Atoi(match[1])
+		offset, _ := strconv.ParseFloat(match[2], 64)
+		frame := v.newFrame(tsFile, prefix, index, offset)
+		if _, err := os.Stat(frame.ImageFile.File); err == nil && len(frames) < v.Frames {
+			frames = append(frames, frame)
+		}
+	}
+	if err != nil {
+		return frames, errors.Wrapf(err, "transcode %v", args)
+	}
+	return frames, nil
+}
+
+// Merge the detections of frames to the detections of segment. For each category, use the boxes of frame
+// which has the max score, with the offset of frame. For vote, the category is dropped if not detected by
+// most of frames.
+func (v *FrameSampler) Merge(frames []*ProcessFrame) []ProcessDetectResult {
+	type categoryFrame struct {
+		frame *ProcessFrame
+		score float64
+		votes int
+	}
+
+	categories := make(map[int]*categoryFrame)
+	for _, frame := range frames {
+		scores := make(map[int]float64)
+		for _, box := range frame.BoundingBox {
+			if score, ok := scores[box.Category]; !ok || box.Score > score {
+				scores[box.Category] = box.Score
+			}
+		}
+
+		for category, score := range scores {
+			if cf, ok := categories[category]; !ok {
+				categories[category] = &categoryFrame{frame: frame, score: score, votes: 1}
+			} else {
+				cf.votes++
+				if score > cf.score {
+					cf.frame, cf.score = frame, score
+				}
+			}
+		}
+	}
+
+	var results []ProcessDetectResult
+	for category, cf := range categories {
+		if v.Aggregate == FrameAggregateVote && cf.votes*2 <= len(frames) {
+			continue
+		}
+
+		for _, box := range cf.frame.BoundingBox {
+			if box.Category == category {
+				box.Offset, box.Frames = cf.frame.Offset, cf.votes
+				results = append(results, box)
+			}
+		}
+	}
+
+	// Keep the results in stable order, by offset and category.
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Offset != results[j].Offset {
+			return results[i].Offset < results[j].Offset
+		}
+		return results[i].Category < results[j].Category
+	})
+	return results
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrameSamplerMerge(t *testing.T) {
+	box := func(category int, score float64) ProcessDetectResult {
+		return ProcessDetectResult{Category: category, Score: score, BBox: []float64{0, 0, 1, 1}}
+	}
+	merged := func(category int, score, offset float64, frames int) ProcessDetectResult {
+		r := box(category, score)
+		r.Offset, r.Frames = offset, frames
+		return r
+	}
+
+	for _, c := range []struct {
+		name      string
+		aggregate string
+		frames    []*ProcessFrame
+		results   []ProcessDetectResult
+	}{
+		{
+			name: "no frames", aggregate: FrameAggregateMax,
+		},
+		{
+			name: "no detections", aggregate: FrameAggregateMax,
+			frames: []*ProcessFrame{{Offset: 0}, {Offset: 1}},
+		},
+		{
+			name: "max score frame", aggregate: FrameAggregateMax,
+			frames: []*ProcessFrame{
+				{Offset: 0, BoundingBox: []ProcessDetectResult{box(1, 0.6)}},
+				{Offset: 1, BoundingBox: []ProcessDetectResult{box(1, 0.9), box(1, 0.3)}},
+				{Offset: 2, BoundingBox: []ProcessDetectResult{box(1, 0.7)}},
+			},
+			results: []ProcessDetectResult{merged(1, 0.9, 1, 3), merged(1, 0.3, 1, 3)},
+		},
+		{
+			name: "categories in different frames", aggregate: FrameAggregateMax,
+			frames: []*ProcessFrame{
+				{Offset: 0, BoundingBox: []ProcessDetectResult{box(2, 0.8), box(1, 0.2)}},
+				{Offset: 1, BoundingBox: []ProcessDetectResult{box(1, 0.9)}},
+			},
+			results: []ProcessDetectResult{merged(2, 0.8, 0, 1), merged(1, 0.9, 1, 2)},
+		},
+		{
+			name: "vote by most frames", aggregate: FrameAggregateVote,
+			frames: []*ProcessFrame{
+				{Offset: 0, BoundingBox: []ProcessDetectResult{box(1, 0.6), box(2, 0.9)}},
+				{Offset: 1, BoundingBox: []ProcessDetectResult{box(1, 0.7)}},
+				{Offset: 2},
+			},
+			results: []ProcessDetectResult{merged(1, 0.7, 1, 2)},
+		},
+		{
+			name: "vote drops half", aggregate: FrameAggregateVote,
+			frames: []*ProcessFrame{
+				{Offset: 0, BoundingBox: []ProcessDetectResult{box(1, 0.6)}},
+				{Offset: 1},
+			},
+		},
+		{
+			name: "max keeps minority", aggregate: FrameAggregateMax,
+			frames: []*ProcessFrame{
+				{Offset: 0, BoundingBox: []ProcessDetectResult{box(1, 0.6)}},
+				{Offset: 1},
+			},
+			results: []ProcessDetectResult{merged(1, 0.6, 0, 1)},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sampler := &FrameSampler{Frames: len(c.frames), Mode: FrameModeEven, Aggregate: c.aggregate}
+			if results := sampler.Merge(c.frames); !reflect.DeepEqual(results, c.results) {
+				t.Errorf("expect %+v, got %+v", c.results, results)
+			}
+		})
+	}
+}
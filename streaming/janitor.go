@@ -0,0 +1,456 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+var janitorWorker *JanitorWorker
+
+// Never remove the file younger than this, which might be copied but not in queue yet.
+const janitorGrace = time.Minute
+
+// The temporary files in accident directory, which are not used by any accident, are removed after this.
+const janitorOrphanAge = time.Hour
+
+// JanitorRule is the retention of a directory, ignore if zero.
+type JanitorRule struct {
+	// The directory, such as detect.
+	Dir string `json:"dir"`
+	// Remove the files older than this.
+	MaxAge time.Duration `json:"maxAge"`
+	// Remove the oldest files if total bytes exceed this.
+	MaxBytes int64 `json:"maxBytes"`
+	// Keep the newest N entries, only for accident directory.
+	Keep int `json:"keep,omitempty"`
+}
+
+func (v *JanitorRule) String() string {
+	return fmt.Sprintf("dir=%v, age=%v, bytes=%v, keep=%v", v.Dir, v.MaxAge, v.MaxBytes, v.Keep)
+}
+
+// JanitorPolicy is the retention of all directories.
+type JanitorPolicy struct {
+	// The interval to cleanup.
+	Interval time.Duration
+	// The rules of detect, process and accident directory.
+	Detect, Process, Accident *JanitorRule
+}
+
+func (v *JanitorPolicy) String() string {
+	return fmt.Sprintf("interval=%v, detect(%v), process(%v), accident(%v)",
+		v.Interval, v.Detect.String(), v.Process.String(), v.Accident.String(),
+	)
+}
+
+// NewJanitorPolicy create the policy from env.
+func NewJanitorPolicy() *JanitorPolicy {
+	seconds := func(value string, defaultValue time.Duration) time.Duration {
+		if f, err := strconv.ParseFloat(value, 64); err == nil && f >= 0 {
+			return time.Duration(f * float64(time.Second))
+		}
+		return defaultValue
+	}
+	bytes := func(value string) int64 {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		return 0
+	}
+
+	v := &JanitorPolicy{
+		Interval: seconds(envJanitorInterval(), time.Minute),
+		Detect: &JanitorRule{
+			Dir: "detect", MaxAge: seconds(envJanitorDetectMaxAge(), 10*time.Minute),
+			MaxBytes: bytes(envJanitorDetectMaxBytes()),
+		},
+		Process: &JanitorRule{
+			Dir: "process", MaxAge: seconds(envJanitorProcessMaxAge(), 10*time.Minute),
+			MaxBytes: bytes(envJanitorProcessMaxBytes()),
+		},
+		Accident: &JanitorRule{
+			Dir: "accident", MaxAge: seconds(envJanitorAccidentMaxAge(), 30*24*time.Hour),
+			MaxBytes: bytes(envJanitorAccidentMaxBytes()),
+		},
+	}
+	if v.Interval <= 0 {
+		v.Interval = time.Minute
+	}
+	if n, err := strconv.Atoi(envJanitorAccidentKeep()); err == nil && n > 0 {
+		v.Accident.Keep = n
+	}
+	return v
+}
+
+// JanitorDirReport is what reclaimed in a directory.
+type JanitorDirReport struct {
+	// The directory, such as detect.
+	Dir string `json:"dir"`
+	// The number and bytes of files or accidents, before cleanup.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// The number of protected files or accidents, which are in use.
+	Protected int `json:"protected"`
+	// The number and bytes of removed files or accidents.
+	Removed   int   `json:"removed"`
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+func (v *JanitorDirReport) String() string {
+	return fmt.Sprintf("dir=%v, files=%v, bytes=%v, protected=%v, removed=%v, reclaimed=%v",
+		v.Dir, v.Files, v.Bytes, v.Protected, v.Removed, v.Reclaimed,
+	)
+}
+
+// JanitorReport is what reclaimed by a cleanup.
+type JanitorReport struct {
+	// The time of cleanup.
+	Time string `json:"time"`
+	// The cost of cleanup.
+	Cost string `json:"cost"`
+	// The report of each directory.
+	Dirs []*JanitorDirReport `json:"dirs"`
+}
+
+// JanitorWorker removes the expired files of detect, process and accident directory, by retention policy.
+// The files used by process tasks, accident rings and working accidents are protected. The leaked files of
+// segment store are also removed.
+type JanitorWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The retention policy.
+	policy *JanitorPolicy
+
+	// The last report.
+	report *JanitorReport
+	// The total number and bytes removed since start.
+	removed   int
+	reclaimed int64
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewJanitorWorker() *JanitorWorker {
+	return &JanitorWorker{policy: NewJanitorPolicy()}
+}
+
+func (v *JanitorWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *JanitorWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "janitor: start worker, policy is %v", v.policy.String())
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(v.policy.Interval):
+				if err := v.cleanup(ctx); err != nil {
+					logger.Wf(ctx, "janitor: ignore cleanup err %+v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// cleanup remove the expired files of all directories, and report what reclaimed.
+func (v *JanitorWorker) cleanup(ctx context.Context) error {
+	starttime := time.Now()
+	files, accidents, err := janitorProtected(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query protected")
+	}
+
+	report := &JanitorReport{Time: starttime.Format(time.RFC3339)}
+	for _, rule := range []*JanitorRule{v.policy.Detect, v.policy.Process} {
+		r, err := v.cleanupFiles(ctx, rule, files)
+		if err != nil {
+			return errors.Wrapf(err, "cleanup %v", rule.String())
+		}
+		report.Dirs = append(report.Dirs, r)
+	}
+
+	r, err := v.cleanupAccidents(ctx, v.policy.Accident, files, accidents)
+	if err != nil {
+		return errors.Wrapf(err, "cleanup %v", v.policy.Accident.String())
+	}
+	report.Dirs = append(report.Dirs, r)
+
+	// The files of segment store are removed when released, so only sweep the leaked ones.
+	if r, err = segmentStore.sweep(ctx, janitorGrace); err != nil {
+		return errors.Wrapf(err, "sweep segment store")
+	}
+	report.Dirs = append(report.Dirs, r)
+	report.Cost = time.Since(starttime).String()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.report = report
+	for _, r := range report.Dirs {
+		v.removed += r.Removed
+		v.reclaimed += r.Reclaimed
+		if r.Removed > 0 {
+			logger.Tf(ctx, "janitor: cleanup %v", r.String())
+		}
+	}
+	return nil
+}
+
+// janitorFile is a file or an accident directory to cleanup.
+type janitorFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// cleanupFiles remove the files which are not protected, older than max age, or the oldest files if exceed
+// max bytes.
+func (v *JanitorWorker) cleanupFiles(ctx context.Context, rule *JanitorRule, protected map[string]bool) (*JanitorDirReport, error) {
+	report := &JanitorDirReport{Dir: rule.Dir}
+
+	// Note that the directory might be a symbolic link, so we walk it with a slash.
+	var files []*janitorFile
+	if err := filepath.WalkDir(rule.Dir+"/", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		report.Files++
+		report.Bytes += info.Size()
+		if protected[p] {
+			report.Protected++
+			return nil
+		}
+		files = append(files, &janitorFile{path: p, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "walk %v", rule.Dir)
+	}
+
+	// Remove the oldest files first.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	now, total := time.Now(), report.Bytes
+	for _, file := range files {
+		age := now.Sub(file.modTime)
+		if age < janitorGrace {
+			continue
+		}
+
+		expired := rule.MaxAge > 0 && age > rule.MaxAge
+		exceeded := rule.MaxBytes > 0 && total > rule.MaxBytes
+		if !expired && !exceeded {
+			continue
+		}
+
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			logger.Wf(ctx, "janitor: ignore remove %v err %+v", file.path, err)
+			continue
+		}
+		total -= file.size
+		report.Removed++
+		report.Reclaimed += file.size
+	}
+
+	return report, nil
+}
+
+// cleanupAccidents remove the accidents which are not protected, older than max age, or exceed the max bytes
+// or the newest N. The temporary files which are not used by any accident are also removed.
+func (v *JanitorWorker) cleanupAccidents(ctx context.Context, rule *JanitorRule, protectedFiles, protectedAccidents map[string]bool) (*JanitorDirReport, error) {
+	report := &JanitorDirReport{Dir: rule.Dir}
+
+	entries, err := os.ReadDir(rule.Dir + "/")
+	if err != nil && os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "read %v", rule.Dir)
+	}
+
+	now := time.Now()
+	var accidents []*janitorFile
+	for _, entry := range entries {
+		p := path.Join(rule.Dir, entry.Name())
+
+		// The temporary files copied for working accidents.
+		if !entry.IsDir() {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			report.Files++
+			report.Bytes += info.Size()
+			if protectedFiles[p] {
+				report.Protected++
+			} else if now.Sub(info.ModTime()) > janitorOrphanAge {
+				if err := os.Remove(p); err == nil {
+					report.Removed++
+					report.Reclaimed += info.Size()
+				}
+			}
+			continue
+		}
+
+		// Ignore the directory which is not accident.
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+
+		// Only count the own files of accident, never the ts files in segment store, which are shared by other
+		// accidents and reported by the sweep of store, or removing an accident might reclaim nothing.
+		accident := &janitorFile{path: entry.Name()}
+		filepath.WalkDir(p, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				accident.size += info.Size()
+				if info.ModTime().After(accident.modTime) {
+					accident.modTime = info.ModTime()
+				}
+			}
+			return nil
+		})
+
+		report.Files++
+		report.Bytes += accident.size
+		if protectedAccidents[accident.path] {
+			report.Protected++
+			continue
+		}
+		accidents = append(accidents, accident)
+	}
+
+	// Keep the newest accidents first.
+	sort.Slice(accidents, func(i, j int) bool {
+		return accidents[i].modTime.After(accidents[j].modTime)
+	})
+
+	var kept int
+	var total int64
+	for _, accident := range accidents {
+		expired := rule.MaxAge > 0 && now.Sub(accident.modTime) > rule.MaxAge
+		exceeded := rule.MaxBytes > 0 && total+accident.size > rule.MaxBytes
+		overflow := rule.Keep > 0 && kept >= rule.Keep
+		if !expired && !exceeded && !overflow {
+			kept++
+			total += accident.size
+			continue
+		}
+
+		if err := removeArtifact(ctx, accident.path); err != nil {
+			logger.Wf(ctx, "janitor: ignore remove accident %v err %+v", accident.path, err)
+			continue
+		}
+		report.Removed++
+		report.Reclaimed += accident.size
+		logger.Tf(ctx, "janitor: remove accident %v, size=%v, update=%v, expired=%v, exceeded=%v, overflow=%v",
+			accident.path, accident.size, accident.modTime.Format(time.RFC3339), expired, exceeded, overflow)
+	}
+
+	return report, nil
+}
+
+// janitorProtected return the files used by process tasks and accidents, and the uuid of accidents which
+// are working or processing.
+func janitorProtected(ctx context.Context) (files, accidents map[string]bool, err error) {
+	files, accidents = make(map[string]bool), make(map[string]bool)
+
+	detectWorker.workers.Range(func(key, value interface{}) bool {
+		if worker := value.(*ProcessWorker); worker.task != nil {
+			for _, file := range worker.task.files() {
+				files[file] = true
+			}
+		}
+		return true
+	})
+
+	for _, file := range accidentWorker.files() {
+		files[file] = true
+	}
+	for _, accidentUUID := range accidentWorker.uuids() {
+		accidents[accidentUUID] = true
+	}
+
+	// The artifact which is still processing, for example, the working object is not restored yet.
+	artifacts, err := queryArtifacts(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "query artifacts")
+	}
+	for _, artifact := range artifacts {
+		if artifact.Processing {
+			accidents[artifact.UUID] = true
+		}
+	}
+
+	return files, accidents, nil
+}
+
+func (v *JanitorWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/janitor/report"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Policy    *JanitorPolicy `json:"policy"`
+				Report    *JanitorReport `json:"report"`
+				Removed   int            `json:"removed"`
+				Reclaimed int64          `json:"reclaimed"`
+			}{
+				Policy: v.policy, Report: v.report, Removed: v.removed, Reclaimed: v.reclaimed,
+			})
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -101,10 +101,83 @@ func doMain(ctx context.Context) error {
 	setEnvDefault("RTMP_PORT", "1935")
 	setEnvDefault("HTTP_PORT", "")
 
+	// For detector, the default backend for all streams, see PROCESS_DETECTOR for each stream.
+	setEnvDefault("DETECTOR_TYPE", DetectorTypeHTTP)
+	setEnvDefault("DETECTOR_URL", "http://121.78.254.27:10080/ai")
+
+	// For process, sample frames from each segment, even or keyframe, and merge detections by max or vote.
+	setEnvDefault("PROCESS_FRAMES", "1")
+	setEnvDefault("PROCESS_FRAME_MODE", FrameModeEven)
+	setEnvDefault("PROCESS_FRAME_AGGREGATE", FrameAggregateMax)
+
+	// For accident, confirm by 2 detections in 3 segments, and end when quiet for 30s.
+	setEnvDefault("ACCIDENT_CONFIRM_HITS", "2")
+	setEnvDefault("ACCIDENT_CONFIRM_WINDOW", "3")
+	setEnvDefault("ACCIDENT_MIN_SCORE", "0.5")
+	setEnvDefault("ACCIDENT_QUIET_PERIOD", "30")
+	// For accident, the pre-roll and post-roll in seconds.
+	setEnvDefault("ACCIDENT_PREROLL", "10")
+	setEnvDefault("ACCIDENT_POSTROLL", "10")
+	// Whether generate the annotated HLS, which draws the detections on video.
+	setEnvDefault("PROCESS_ANNOTATE", "off")
+	// For janitor, the interval and max age in seconds, the max bytes and keep 0 means unlimited.
+	setEnvDefault("JANITOR_INTERVAL", "60")
+	setEnvDefault("JANITOR_DETECT_MAX_AGE", "600")
+	setEnvDefault("JANITOR_DETECT_MAX_BYTES", "0")
+	setEnvDefault("JANITOR_PROCESS_MAX_AGE", "600")
+	setEnvDefault("JANITOR_PROCESS_MAX_BYTES", "0")
+	setEnvDefault("JANITOR_ACCIDENT_MAX_AGE", "2592000")
+	setEnvDefault("JANITOR_ACCIDENT_MAX_BYTES", "0")
+	setEnvDefault("JANITOR_ACCIDENT_KEEP", "0")
+	// For SRS hooks, the SRS_HOOK_SECRET must be the secret in hook urls of SRS config, such as
+	// /hooks/srs/hls?secret=xxx, see containers/conf/srs.release.conf. It defaults to the publish secret, then
+	// API_SECRET, and the hooks are rejected if no secret.
+	// For callbacks to API server.
+	setEnvDefault("API_BASE_URL", "http://127.0.0.1:5000")
+	setEnvDefault("CALLBACK_MAX_ATTEMPTS", "10")
+	// For object storage, upload the accident to S3-compatible bucket if endpoint and bucket are set.
+	setEnvDefault("S3_REGION", "us-east-1")
+	setEnvDefault("S3_PATH_STYLE", "on")
+	setEnvDefault("S3_PREFIX", "accident")
+	setEnvDefault("S3_PRESIGN_EXPIRES", "604800")
+	setEnvDefault("S3_PART_SIZE", "8388608")
+	setEnvDefault("S3_RETRIES", "3")
+	setEnvDefault("PLAYBACK_TOKEN", "off")
+	setEnvDefault("PLAYBACK_TOKEN_TTL", "3600")
+	setEnvDefault("SRS_API_URL", "http://127.0.0.1:1985")
+	setEnvDefault("SRS_RECONCILE_INTERVAL", "30")
+	setEnvDefault("SRS_RECONCILE_GRACE", "30")
+	setEnvDefault("SCHEDULER_FFMPEG", "4")
+	setEnvDefault("SCHEDULER_DETECTOR", "2")
+	setEnvDefault("SCHEDULER_FFPROBE", "4")
+	setEnvDefault("PROCESS_LATENCY_BUDGET", "30")
+
 	logger.Tf(ctx, "load .env as GO_PPROF=%v, API_SECRET=%vB, SOURCE=%v, REDIS_DATABASE=%v, REDIS_HOST=%v, REDIS_PASSWORD=%vB, REDIS_PORT=%v, "+
-		"RTMP_PORT=%v, PUBLIC_URL=%v, BUILD_PATH=%v, PLATFORM_LISTEN=%v, HTTP_PORT=%v, HTTPS_LISTEN=%v, MGMT_LISTEN=%v",
+		"RTMP_PORT=%v, PUBLIC_URL=%v, BUILD_PATH=%v, PLATFORM_LISTEN=%v, HTTP_PORT=%v, HTTPS_LISTEN=%v, MGMT_LISTEN=%v, "+
+		"DETECTOR_TYPE=%v, DETECTOR_URL=%v, DETECTOR_COMMAND=%v, ACCIDENT_CONFIRM_HITS=%v, ACCIDENT_CONFIRM_WINDOW=%v, "+
+		"ACCIDENT_MIN_SCORE=%v, ACCIDENT_QUIET_PERIOD=%v, PROCESS_FRAMES=%v, PROCESS_FRAME_MODE=%v, PROCESS_FRAME_AGGREGATE=%v, "+
+		"ACCIDENT_PREROLL=%v, ACCIDENT_POSTROLL=%v, PROCESS_ANNOTATE=%v, PROCESS_ANNOTATE_FONT=%v, "+
+		"JANITOR_INTERVAL=%v, JANITOR_DETECT_MAX_AGE=%v, JANITOR_DETECT_MAX_BYTES=%v, JANITOR_PROCESS_MAX_AGE=%v, "+
+		"JANITOR_PROCESS_MAX_BYTES=%v, JANITOR_ACCIDENT_MAX_AGE=%v, JANITOR_ACCIDENT_MAX_BYTES=%v, JANITOR_ACCIDENT_KEEP=%v, "+
+		"S3_ENDPOINT=%v, S3_REGION=%v, S3_BUCKET=%v, S3_ACCESS_KEY=%vB, S3_SECRET_KEY=%vB, S3_PATH_STYLE=%v, S3_PREFIX=%v, "+
+		"S3_PUBLIC_URL=%v, S3_PRESIGN_EXPIRES=%v, S3_PART_SIZE=%v, S3_RETRIES=%v, "+
+		"API_BASE_URL=%v, CALLBACK_MAX_ATTEMPTS=%v, CALLBACK_SECRET=%vB, SRS_HOOK_SECRET=%vB, SRS_HLS_ROOT=%v, "+
+		"PLAYBACK_TOKEN=%v, PLAYBACK_SECRET=%vB, PLAYBACK_TOKEN_TTL=%v, "+
+		"SRS_API_URL=%v, SRS_RECONCILE_INTERVAL=%v, SRS_RECONCILE_GRACE=%v, "+
+		"SCHEDULER_FFMPEG=%v, SCHEDULER_DETECTOR=%v, SCHEDULER_FFPROBE=%v, PROCESS_LATENCY_BUDGET=%v",
 		envGoPprof(), len(envApiSecret()), envSource(), envRedisDatabase(), envRedisHost(), len(envRedisPassword()), envRedisPort(),
 		envRtmpPort(), envPublicUrl(), envBuildPath(), envPlatformListen(), envHttpPort(), envHttpListen(), envMgmtListen(),
+		envDetectorType(), envDetectorURL(), envDetectorCommand(), envAccidentConfirmHits(), envAccidentConfirmWindow(),
+		envAccidentMinScore(), envAccidentQuietPeriod(), envProcessFrames(), envProcessFrameMode(), envProcessFrameAggregate(),
+		envAccidentPreroll(), envAccidentPostroll(), envProcessAnnotate(), envProcessAnnotateFont(),
+		envJanitorInterval(), envJanitorDetectMaxAge(), envJanitorDetectMaxBytes(), envJanitorProcessMaxAge(),
+		envJanitorProcessMaxBytes(), envJanitorAccidentMaxAge(), envJanitorAccidentMaxBytes(), envJanitorAccidentKeep(),
+		envS3Endpoint(), envS3Region(), envS3Bucket(), len(envS3AccessKey()), len(envS3SecretKey()), envS3PathStyle(), envS3Prefix(),
+		envS3PublicUrl(), envS3PresignExpires(), envS3PartSize(), envS3Retries(),
+		envApiBaseUrl(), envCallbackMaxAttempts(), len(envCallbackSecret()), len(envSrsHookSecret()), envSrsHlsRoot(),
+		envPlaybackToken(), len(envPlaybackSecret()), envPlaybackTokenTTL(),
+		envSrsApiUrl(), envSrsReconcileInterval(), envSrsReconcileGrace(),
+		envSchedulerFFmpeg(), envSchedulerDetector(), envSchedulerFFprobe(), envProcessLatencyBudget(),
 	)
 
 	// Start the Go pprof if enabled.
@@ -127,6 +200,51 @@ func doMain(ctx context.Context) error {
 		return errors.Wrapf(err, "init os")
 	}
 
+	// Never serve the media by forgeable token, the token is rejected if no secret.
+	if playbackEnabled() && playbackSecret() == "" {
+		logger.Ef(ctx, "PLAYBACK_TOKEN is on but no PLAYBACK_SECRET or API_SECRET, all playback requests are rejected")
+	}
+
+	// Never allow to manage the categories, artifacts and callbacks without secret.
+	if envApiSecret() == "" {
+		logger.Ef(ctx, "no API_SECRET, all management requests are rejected")
+	}
+
+	if err := initSignatureSecrets(ctx); err != nil {
+		return errors.Wrapf(err, "init signature secrets")
+	}
+
+	eventHub = NewEventHub()
+	defer eventHub.Close()
+
+	categoryRegistry = NewCategoryRegistry()
+	defer categoryRegistry.Close()
+	if err := categoryRegistry.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start category registry")
+	}
+
+	outboxWorker = NewOutboxWorker()
+	defer outboxWorker.Close()
+	if err := outboxWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start outbox worker")
+	}
+
+	// Create the client of object storage, nil if not configured.
+	if s3Client = NewS3Client(); s3Client != nil {
+		logger.Tf(ctx, "s3: upload accident to %v", s3Client.String())
+	}
+
+	scheduler = NewScheduler()
+	defer scheduler.Close()
+	if err := scheduler.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start scheduler")
+	}
+
+	segmentStore = NewSegmentStore()
+	if err := segmentStore.Rebuild(ctx); err != nil {
+		return errors.Wrapf(err, "rebuild segment store")
+	}
+
 	accidentWorker = NewAccidentWorker()
 	defer accidentWorker.Close()
 	if err := accidentWorker.Start(ctx); err != nil {
@@ -139,6 +257,18 @@ func doMain(ctx context.Context) error {
 		return errors.Wrapf(err, "start detect worker")
 	}
 
+	janitorWorker = NewJanitorWorker()
+	defer janitorWorker.Close()
+	if err := janitorWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start janitor worker")
+	}
+
+	reconcileWorker = NewReconcileWorker()
+	defer reconcileWorker.Close()
+	if err := reconcileWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start reconcile worker")
+	}
+
 	// Run HTTP service.
 	httpService := NewHTTPService()
 	defer httpService.Close()
@@ -162,6 +292,7 @@ func initialize(ctx context.Context) error {
 	// and mount it if they wish to save recordings to cloud storage.
 	for _, dir := range []string{
 		"containers/data/record", "containers/data/config", "containers/data/accident", "containers/data/detect", "containers/data/process",
+		"containers/data/segment",
 		// "containers/data/dvr", "containers/data/vod",
 		// "containers/data/upload", "containers/data/vlive", "containers/data/signals",
 		// "containers/data/lego", "containers/data/.well-known",
@@ -0,0 +1,99 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The content type of media files, by extension.
+var mediaContentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".vtt":  "text/vtt",
+}
+
+// mediaContentType return the content type of file, empty if not media file.
+func mediaContentType(name string) string {
+	return mediaContentTypes[strings.ToLower(path.Ext(name))]
+}
+
+// mediaCacheControl return the cache control of file. The playlist and snapshot might change, so the client
+// should always revalidate them by ETag, while the mp4 and ts never change once generated.
+func mediaCacheControl(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u8", ".jpg", ".png", ".vtt":
+		return "no-cache"
+	default:
+		return "public, max-age=600"
+	}
+}
+
+// parseMediaPath parse the path such as /accident/hls/:uuid/:name to the directory and name, and return error
+// if not a media file directly under the directory, to avoid path traversal.
+func parseMediaPath(urlPath, prefix string) (dir, name string, err error) {
+	filename := strings.TrimPrefix(urlPath, prefix)
+	if filename == urlPath {
+		return "", "", errors.Errorf("invalid prefix %v of %v", prefix, urlPath)
+	}
+
+	dir, name = path.Dir(filename), path.Base(filename)
+	if dir == "." || dir == ".." || strings.Contains(dir, "/") {
+		return "", "", errors.Errorf("invalid dir %v of %v", dir, urlPath)
+	}
+	if name == "" || strings.HasPrefix(name, ".") || path.Join(dir, name) != filename {
+		return "", "", errors.Errorf("invalid name %v of %v", name, urlPath)
+	}
+	if mediaContentType(name) == "" {
+		return "", "", errors.Errorf("invalid media %v of %v", name, urlPath)
+	}
+	return dir, name, nil
+}
+
+// serveMediaFile serve the media file by http.ServeContent, which supports RFC 7233 range requests, such as
+// suffix, open-ended and multiple ranges, and the conditional requests by ETag and Last-Modified.
+func serveMediaFile(ctx context.Context, w http.ResponseWriter, r *http.Request, file string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil && os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "open file %v", file)
+	}
+	defer f.Close()
+
+	stats, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat file %v", file)
+	} else if stats.IsDir() {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	// The ETag is generated by size and modify time, which changes when file is regenerated.
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stats.Size(), stats.ModTime().UnixNano()))
+	w.Header().Set("Content-Type", mediaContentType(file))
+	w.Header().Set("Cache-Control", mediaCacheControl(file))
+
+	http.ServeContent(w, r, path.Base(file), stats.ModTime(), f)
+	logger.Tf(ctx, "media serve %v ok, size=%v, range=%v", file, stats.Size(), r.Header.Get("Range"))
+	return nil
+}
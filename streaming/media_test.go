@@ -0,0 +1,50 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"testing"
+)
+
+func TestParseMediaPath(t *testing.T) {
+	prefix := "/accident/hls/"
+	for _, c := range []struct {
+		name      string
+		urlPath   string
+		dir, file string
+		err       bool
+	}{
+		{name: "mp4", urlPath: "/accident/hls/uuid/index.mp4", dir: "uuid", file: "index.mp4"},
+		{name: "playlist", urlPath: "/accident/hls/uuid/index.m3u8", dir: "uuid", file: "index.m3u8"},
+		{name: "upper ext", urlPath: "/accident/hls/uuid/snapshot.JPG", dir: "uuid", file: "snapshot.JPG"},
+		{name: "other prefix", urlPath: "/detect/hls/uuid/index.mp4", err: true},
+		{name: "no dir", urlPath: "/accident/hls/index.mp4", err: true},
+		{name: "no name", urlPath: "/accident/hls/uuid/", err: true},
+		{name: "parent dir", urlPath: "/accident/hls/../index.mp4", err: true},
+		{name: "parent name", urlPath: "/accident/hls/uuid/..", err: true},
+		{name: "traversal", urlPath: "/accident/hls/uuid/../../etc/passwd.mp4", err: true},
+		{name: "nested dir", urlPath: "/accident/hls/uuid/sub/index.mp4", err: true},
+		{name: "double slash", urlPath: "/accident/hls/uuid//index.mp4", err: true},
+		{name: "dot dir", urlPath: "/accident/hls/./index.mp4", err: true},
+		{name: "hidden file", urlPath: "/accident/hls/uuid/.index.mp4", err: true},
+		{name: "not media", urlPath: "/accident/hls/uuid/concat.txt", err: true},
+		{name: "no ext", urlPath: "/accident/hls/uuid/index", err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir, file, err := parseMediaPath(c.urlPath, prefix)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expect error, got dir=%v, name=%v", dir, file)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse err %+v", err)
+			}
+			if dir != c.dir || file != c.file {
+				t.Errorf("expect dir=%v, name=%v, got dir=%v, name=%v", c.dir, c.file, dir, file)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The buckets in seconds of latency histograms, from ffmpeg extraction to callbacks.
+var metricLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// The metrics of pipeline, exposed in Prometheus text format by /metrics.
+var (
+	metricHookEvents = NewMetricCounter("streaming_hook_events_total",
+		"The number of SRS hook events by action.")
+	metricChannelDrops = NewMetricCounter("streaming_channel_drops_total",
+		"The number of messages dropped because the channel of worker is full.")
+	metricDetections = NewMetricCounter("streaming_detections_total",
+		"The number of detections by stream and category.")
+	metricAccidentsOpened = NewMetricCounter("streaming_accidents_opened_total",
+		"The number of accidents opened by stream and category.")
+	metricAccidentsClosed = NewMetricCounter("streaming_accidents_closed_total",
+		"The number of accidents closed by stream and category.")
+	metricExtractSeconds = NewMetricHistogram("streaming_extract_seconds",
+		"The latency of ffmpeg to extract frames from segment.", metricLatencyBuckets)
+	metricDetectorSeconds = NewMetricHistogram("streaming_detector_seconds",
+		"The latency of detector to detect a frame.", metricLatencyBuckets)
+	metricCallbackSeconds = NewMetricHistogram("streaming_callback_seconds",
+		"The latency of callbacks to API server by type and result.", metricLatencyBuckets)
+	metricSchedulerGranted = NewMetricCounter("streaming_scheduler_granted_total",
+		"The number of jobs granted a slot by class.")
+	metricSchedulerWaitSeconds = NewMetricHistogram("streaming_scheduler_wait_seconds",
+		"The latency of jobs waiting for a slot by class.", metricLatencyBuckets)
+	metricSegmentsSkipped = NewMetricCounter("streaming_segments_skipped_total",
+		"The number of segments skipped by load shedding, not analysed, by stream and reason.")
+)
+
+// metricLabels format the label pairs, such as metricLabels("stream", "livestream") to stream="livestream".
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf(`%v="%v"`, pairs[i], value))
+	}
+	return strings.Join(labels, ",")
+}
+
+// metricSample format a sample line, with optional labels.
+func metricSample(name, labels string, value float64) string {
+	if labels == "" {
+		return fmt.Sprintf("%v %v\n", name, metricValue(value))
+	}
+	return fmt.Sprintf("%v{%v} %v\n", name, labels, metricValue(value))
+}
+
+func metricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(value)
+}
+
+// MetricCounter is a counter with labels, which only increases.
+type MetricCounter struct {
+	name   string
+	help   string
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+func NewMetricCounter(name, help string) *MetricCounter {
+	return &MetricCounter{name: name, help: help, values: make(map[string]float64)}
+}
+
+// Add the delta to counter of labels.
+func (v *MetricCounter) Add(labels string, delta float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[labels] += delta
+}
+
+// Inc increase the counter of labels by one.
+func (v *MetricCounter) Inc(labels string) {
+	v.Add(labels, 1)
+}
+
+func (v *MetricCounter) write(sb *strings.Builder) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	sb.WriteString(fmt.Sprintf("# HELP %v %v\n# TYPE %v counter\n", v.name, v.help, v.name))
+	keys := make([]string, 0, len(v.values))
+	for labels := range v.values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		sb.WriteString(metricSample(v.name, labels, v.values[labels]))
+	}
+}
+
+// metricHistogramValue is the observations of a histogram with labels.
+type metricHistogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// MetricHistogram is a histogram with labels, observes the latency in seconds.
+type MetricHistogram struct {
+	name    string
+	help    string
+	buckets []float64
+	values  map[string]*metricHistogramValue
+	lock    sync.Mutex
+}
+
+func NewMetricHistogram(name, help string, buckets []float64) *MetricHistogram {
+	return &MetricHistogram{
+		name: name, help: help, buckets: buckets, values: make(map[string]*metricHistogramValue),
+	}
+}
+
+// Observe the duration for labels.
+func (v *MetricHistogram) Observe(labels string, d time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	value, ok := v.values[labels]
+	if !ok {
+		value = &metricHistogramValue{counts: make([]uint64, len(v.buckets))}
+		v.values[labels] = value
+	}
+
+	seconds := d.Seconds()
+	for i, bucket := range v.buckets {
+		if seconds <= bucket {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.sum += seconds
+}
+
+func (v *MetricHistogram) write(sb *strings.Builder) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	sb.WriteString(fmt.Sprintf("# HELP %v %v\n# TYPE %v histogram\n", v.name, v.help, v.name))
+	keys := make([]string, 0, len(v.values))
+	for labels := range v.values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		value := v.values[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+
+		for i, bucket := range v.buckets {
+			le := fmt.Sprintf(`%vle="%v"`, prefix, metricValue(bucket))
+			sb.WriteString(metricSample(v.name+"_bucket", le, float64(value.counts[i])))
+		}
+		le := fmt.Sprintf(`%vle="+Inf"`, prefix)
+		sb.WriteString(metricSample(v.name+"_bucket", le, float64(value.count)))
+		sb.WriteString(metricSample(v.name+"_sum", labels, value.sum))
+		sb.WriteString(metricSample(v.name+"_count", labels, float64(value.count)))
+	}
+}
+
+// writeQueueMetrics write the depth of queues of every stream, which is collected when scraping.
+func writeQueueMetrics(sb *strings.Builder) {
+	name := "streaming_queue_depth"
+	sb.WriteString(fmt.Sprintf("# HELP %v The number of segments in queue of stream.\n# TYPE %v gauge\n", name, name))
+
+	var lines []string
+	detectWorker.workers.Range(func(key, value interface{}) bool {
+		task := value.(*ProcessWorker).task
+		if task == nil {
+			return true
+		}
+
+		for _, queue := range []struct {
+			name  string
+			queue *ProcessQueue
+		}{
+			{"live", task.LiveQueue}, {"detect", task.DetectQueue}, {"finish", task.FinishQueue},
+		} {
+			labels := metricLabels("stream", key.(string), "queue", queue.name)
+			lines = append(lines, metricSample(name, labels, float64(queue.queue.count())))
+		}
+		return true
+	})
+
+	sort.Strings(lines)
+	sb.WriteString(strings.Join(lines, ""))
+}
+
+// writeShedMetrics write the load shedding level and the lag of segment of every stream.
+func writeShedMetrics(sb *strings.Builder) {
+	levelName, lagName := "streaming_shed_level", "streaming_segment_lag_seconds"
+
+	var levels, lags []string
+	detectWorker.workers.Range(func(key, value interface{}) bool {
+		task := value.(*ProcessWorker).task
+		if task == nil {
+			return true
+		}
+
+		level, lag := task.shedder.Level()
+		labels := metricLabels("stream", key.(string))
+		levels = append(levels, metricSample(levelName, labels, float64(level)))
+		lags = append(lags, metricSample(lagName, labels, lag.Seconds()))
+		return true
+	})
+
+	sort.Strings(levels)
+	sort.Strings(lags)
+	sb.WriteString(fmt.Sprintf("# HELP %v The load shedding level of stream, 0 is normal.\n# TYPE %v gauge\n", levelName, levelName))
+	sb.WriteString(strings.Join(levels, ""))
+	sb.WriteString(fmt.Sprintf("# HELP %v The lag of the last segment of stream.\n# TYPE %v gauge\n", lagName, lagName))
+	sb.WriteString(strings.Join(lags, ""))
+}
+
+// handleMetricsService handle the metrics for Prometheus, authenticated by the bearer token if API_SECRET
+// is set, which is supported by the scrape config.
+func handleMetricsService(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/metrics"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			var sb strings.Builder
+			for _, counter := range []*MetricCounter{
+				metricHookEvents, metricChannelDrops, metricDetections, metricAccidentsOpened, metricAccidentsClosed,
+				metricSchedulerGranted, metricSegmentsSkipped,
+			} {
+				counter.write(&sb)
+			}
+			for _, histogram := range []*MetricHistogram{
+				metricExtractSeconds, metricDetectorSeconds, metricCallbackSeconds, metricSchedulerWaitSeconds,
+			} {
+				histogram.write(&sb)
+			}
+			writeQueueMetrics(&sb)
+			writeShedMetrics(&sb)
+			writeSchedulerMetrics(&sb)
+
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			w.Write([]byte(sb.String()))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,562 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The size of MPEG-TS packet.
+const tsPacketSize = 188
+
+// The sync byte of MPEG-TS packet.
+const tsSyncByte = 0x47
+
+// The clock rate of PTS, DTS and PCR base.
+const tsClockRate = 90000
+
+// The PTS is 33 bits, which wraps around about every 26.5 hours.
+const tsPtsWrap = int64(1) << 33
+
+// The stream types of PMT, see ISO/IEC 13818-1 Table 2-34.
+const (
+	tsStreamTypeH264 = 0x1b
+	tsStreamTypeH265 = 0x24
+)
+
+// The codecs of video, named same to ffprobe.
+const (
+	TsCodecH264 = "h264"
+	TsCodecH265 = "hevc"
+)
+
+// TsDemuxer parses the MPEG-TS packets, to discover the timing and keyframes of segment, without ffprobe.
+// It parses the PAT and PMT for the elementary streams, the PCR of adaptation field, the PTS of PES, and
+// the SPS and IDR of H.264 or H.265 video.
+type TsDemuxer struct {
+	// The PID of PMT, parsed from PAT.
+	pmtPIDs map[int]bool
+	// The stream type of elementary streams, parsed from PMT.
+	streams map[int]uint8
+	// The PES packets in assembling, by PID.
+	pes map[int][]byte
+
+	// The PID and codec of video stream.
+	videoPID int
+	codec    string
+	// The resolution of video, parsed from SPS.
+	width, height int
+
+	// The first PCR, which is used if there is no PTS.
+	pcr    int64
+	hasPCR bool
+	// The first PTS, to unwrap the PTS which wraps around.
+	firstPTS int64
+	hasPTS   bool
+	// The min and max PTS of all streams.
+	startPTS, endPTS int64
+	// The PTS of keyframes.
+	keyframes []int64
+}
+
+func NewTsDemuxer() *TsDemuxer {
+	return &TsDemuxer{
+		pmtPIDs: make(map[int]bool), streams: make(map[int]uint8), pes: make(map[int][]byte), videoPID: -1,
+	}
+}
+
+func (v *TsDemuxer) String() string {
+	return fmt.Sprintf("codec=%v, width=%v, height=%v, start=%v, end=%v, keyframes=%v",
+		v.codec, v.width, v.height, v.startPTS, v.endPTS, len(v.keyframes),
+	)
+}
+
+// Parse all packets in b, which should be the whole segment.
+func (v *TsDemuxer) Parse(b []byte) error {
+	for len(b) >= tsPacketSize {
+		if b[0] != tsSyncByte {
+			return errors.Errorf("invalid sync byte 0x%x", b[0])
+		}
+		if err := v.parsePacket(b[:tsPacketSize]); err != nil {
+			return errors.Wrapf(err, "parse packet")
+		}
+		b = b[tsPacketSize:]
+	}
+
+	// Flush the last PES of each stream, in order of PID.
+	pids := make([]int, 0, len(v.pes))
+	for pid := range v.pes {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		v.flushPES(pid)
+	}
+	return nil
+}
+
+func (v *TsDemuxer) parsePacket(p []byte) error {
+	pusi := p[1]&0x40 != 0
+	pid := int(p[1]&0x1f)<<8 | int(p[2])
+	afc := (p[3] >> 4) & 0x03
+
+	payload := p[4:]
+	if afc&0x02 != 0 {
+		afLength := int(payload[0])
+		if afLength+1 > len(payload) {
+			return errors.Errorf("invalid adaptation field length %v of pid %v", afLength, pid)
+		}
+		if af := payload[1 : 1+afLength]; len(af) >= 7 && af[0]&0x10 != 0 && !v.hasPCR {
+			v.pcr = int64(af[1])<<25 | int64(af[2])<<17 | int64(af[3])<<9 | int64(af[4])<<1 | int64(af[5])>>7
+			v.hasPCR = true
+		}
+		payload = payload[1+afLength:]
+	}
+	if afc&0x01 == 0 || len(payload) == 0 {
+		return nil
+	}
+
+	if pid == 0 {
+		return v.parsePAT(pusi, payload)
+	}
+	if v.pmtPIDs[pid] {
+		return v.parsePMT(pusi, payload)
+	}
+	if _, ok := v.streams[pid]; ok {
+		if pusi {
+			v.flushPES(pid)
+			v.pes[pid] = append([]byte{}, payload...)
+		} else if pes, ok := v.pes[pid]; ok {
+			v.pes[pid] = append(pes, payload...)
+		}
+	}
+	return nil
+}
+
+// tsSection return the section of PSI, ignore the pointer field. Note that we only parse the section in
+// one packet, which is enough for PAT and PMT of live streams.
+func tsSection(pusi bool, payload []byte) ([]byte, error) {
+	if !pusi {
+		return nil, nil
+	}
+
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, errors.Errorf("invalid pointer field %v", pointer)
+	}
+	section := payload[1+pointer:]
+
+	sectionLength := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+sectionLength > len(section) || sectionLength < 9 {
+		return nil, errors.Errorf("invalid section length %v", sectionLength)
+	}
+	// Drop the header and the CRC32.
+	return section[8 : 3+sectionLength-4], nil
+}
+
+func (v *TsDemuxer) parsePAT(pusi bool, payload []byte) error {
+	section, err := tsSection(pusi, payload)
+	if err != nil {
+		return errors.Wrapf(err, "parse PAT")
+	}
+
+	for ; len(section) >= 4; section = section[4:] {
+		program := int(section[0])<<8 | int(section[1])
+		pid := int(section[2]&0x1f)<<8 | int(section[3])
+		// The program 0 is the network PID, not PMT.
+		if program != 0 {
+			v.pmtPIDs[pid] = true
+		}
+	}
+	return nil
+}
+
+func (v *TsDemuxer) parsePMT(pusi bool, payload []byte) error {
+	section, err := tsSection(pusi, payload)
+	if err != nil {
+		return errors.Wrapf(err, "parse PMT")
+	}
+	if len(section) < 4 {
+		return nil
+	}
+
+	programInfoLength := int(section[2]&0x0f)<<8 | int(section[3])
+	if 4+programInfoLength > len(section) {
+		return errors.Errorf("invalid program info length %v", programInfoLength)
+	}
+	section = section[4+programInfoLength:]
+
+	for len(section) >= 5 {
+		streamType := section[0]
+		pid := int(section[1]&0x1f)<<8 | int(section[2])
+		esInfoLength := int(section[3]&0x0f)<<8 | int(section[4])
+		if 5+esInfoLength > len(section) {
+			return errors.Errorf("invalid es info length %v", esInfoLength)
+		}
+		section = section[5+esInfoLength:]
+
+		v.streams[pid] = streamType
+		if v.videoPID < 0 && (streamType == tsStreamTypeH264 || streamType == tsStreamTypeH265) {
+			v.videoPID = pid
+			if streamType == tsStreamTypeH264 {
+				v.codec = TsCodecH264
+			} else {
+				v.codec = TsCodecH265
+			}
+		}
+	}
+	return nil
+}
+
+// flushPES parse the assembled PES of pid, for the PTS and the video NALUs.
+func (v *TsDemuxer) flushPES(pid int) {
+	pes, ok := v.pes[pid]
+	if !ok {
+		return
+	}
+	delete(v.pes, pid)
+
+	// Ignore the PES without start code or PTS.
+	if len(pes) < 14 || pes[0] != 0x00 || pes[1] != 0x00 || pes[2] != 0x01 {
+		return
+	}
+	headerLength := int(pes[8])
+	if 9+headerLength > len(pes) || pes[7]&0x80 == 0 {
+		return
+	}
+
+	p := pes[9:]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	pts = v.unwrap(pts)
+
+	if !v.hasPTS || pts < v.startPTS {
+		v.startPTS = pts
+	}
+	if !v.hasPTS || pts > v.endPTS {
+		v.endPTS = pts
+	}
+	v.hasPTS = true
+
+	if pid == v.videoPID {
+		v.parseVideo(pts, pes[9+headerLength:])
+	}
+}
+
+// unwrap the PTS which wraps around, by the first PTS.
+func (v *TsDemuxer) unwrap(pts int64) int64 {
+	if !v.hasPTS {
+		v.firstPTS = pts
+		return pts
+	}
+	if pts-v.firstPTS < -tsPtsWrap/2 {
+		return pts + tsPtsWrap
+	} else if pts-v.firstPTS > tsPtsWrap/2 {
+		return pts - tsPtsWrap
+	}
+	return pts
+}
+
+// parseVideo parse the NALUs of video frame in annexb, to discover the SPS and keyframes.
+func (v *TsDemuxer) parseVideo(pts int64, frame []byte) {
+	var keyframe bool
+	for _, nalu := range tsAnnexbNALUs(frame) {
+		if v.codec == TsCodecH264 {
+			switch nalu[0] & 0x1f {
+			case 5: // IDR
+				keyframe = true
+			case 7: // SPS
+				if v.width == 0 {
+					v.width, v.height, _ = parseAvcSPS(nalu)
+				}
+			}
+		} else if len(nalu) >= 2 {
+			switch t := (nalu[0] >> 1) & 0x3f; {
+			case t >= 16 && t <= 21: // BLA, IDR or CRA
+				keyframe = true
+			case t == 33: // SPS
+				if v.width == 0 {
+					v.width, v.height, _ = parseHevcSPS(nalu)
+				}
+			}
+		}
+	}
+
+	if keyframe {
+		v.keyframes = append(v.keyframes, pts)
+	}
+}
+
+// Fill the timing, keyframes, codec and resolution to ts file.
+func (v *TsDemuxer) Fill(tsFile *TsFile) error {
+	start, end := v.startPTS, v.endPTS
+	if !v.hasPTS {
+		if !v.hasPCR {
+			return errors.Errorf("no PTS or PCR")
+		}
+		start, end = v.pcr, v.pcr
+	}
+
+	tsFile.Start = float64(start) / tsClockRate
+	tsFile.End = float64(end) / tsClockRate
+	tsFile.Codec, tsFile.Width, tsFile.Height = v.codec, v.width, v.height
+
+	tsFile.Keyframes = nil
+	for _, pts := range v.keyframes {
+		tsFile.Keyframes = append(tsFile.Keyframes, float64(pts-start)/tsClockRate)
+	}
+	sort.Float64s(tsFile.Keyframes)
+	return nil
+}
+
+// demuxTsFile parse the ts file by demuxer, and fill the timing, keyframes, codec and resolution.
+func demuxTsFile(tsFile *TsFile) error {
+	b, err := os.ReadFile(tsFile.File)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", tsFile.File)
+	}
+
+	demuxer := NewTsDemuxer()
+	if err := demuxer.Parse(b); err != nil {
+		return errors.Wrapf(err, "demux %v", tsFile.File)
+	}
+	if err := demuxer.Fill(tsFile); err != nil {
+		return errors.Wrapf(err, "fill %v by %v", tsFile.File, demuxer.String())
+	}
+	return nil
+}
+
+// tsAnnexbNALUs split the frame in annexb format, by the start code 0x000001 or 0x00000001.
+func tsAnnexbNALUs(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0x00 || b[i+1] != 0x00 || b[i+2] != 0x01 {
+			continue
+		}
+
+		if start >= 0 {
+			end := i
+			// The 4 bytes start code.
+			if end > start && b[end-1] == 0x00 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, b[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return nalus
+}
+
+// tsRBSP remove the emulation prevention byte 0x03 of 0x000003.
+func tsRBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	var zeros int
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		rbsp = append(rbsp, b)
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return rbsp
+}
+
+// tsBitReader reads the bits and Exp-Golomb codes of RBSP.
+type tsBitReader struct {
+	b   []byte
+	pos int
+}
+
+// eof whether read beyond the end of bits.
+func (v *tsBitReader) eof() bool {
+	return v.pos > len(v.b)*8
+}
+
+// u read n bits, return zero if not enough bits.
+func (v *tsBitReader) u(n int) uint32 {
+	var value uint32
+	for i := 0; i < n; i++ {
+		var bit uint32
+		if v.pos < len(v.b)*8 {
+			bit = uint32(v.b[v.pos/8]>>(7-v.pos%8)) & 0x01
+		}
+		value = value<<1 | bit
+		v.pos++
+	}
+	return value
+}
+
+// ue read the unsigned Exp-Golomb code.
+func (v *tsBitReader) ue() uint32 {
+	var zeros int
+	for v.u(1) == 0 && !v.eof() && zeros < 32 {
+		zeros++
+	}
+	return (uint32(1)<<zeros - 1) + v.u(zeros)
+}
+
+// se read the signed Exp-Golomb code.
+func (v *tsBitReader) se() int32 {
+	value := v.ue()
+	if value&0x01 != 0 {
+		return int32((value + 1) / 2)
+	}
+	return -int32(value / 2)
+}
+
+// parseAvcSPS parse the resolution from H.264 SPS, see ISO/IEC 14496-10 7.3.2.1.1.
+func parseAvcSPS(nalu []byte) (width, height int, err error) {
+	r := &tsBitReader{b: tsRBSP(nalu[1:])}
+	profile := r.u(8)
+	r.u(16) // constraint_set_flags, level_idc
+	r.ue()  // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = r.ue(); chromaFormat == 3 {
+			r.u(1) // separate_colour_plane_flag
+		}
+		r.ue()           // bit_depth_luma_minus8
+		r.ue()           // bit_depth_chroma_minus8
+		r.u(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.u(1) != 0 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.u(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + r.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.u(1) // delta_pic_order_always_zero_flag
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		for i := r.ue(); i > 0 && !r.eof(); i-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := int(r.ue()) + 1
+	heightInMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.u(1))
+	if frameMbsOnly == 0 {
+		r.u(1) // mb_adaptive_frame_field_flag
+	}
+	r.u(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.u(1) != 0 {
+		cropLeft, cropRight, cropTop, cropBottom = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	if r.eof() {
+		return 0, 0, errors.Errorf("sps too short %v", len(nalu))
+	}
+
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	if chromaFormat == 1 || chromaFormat == 2 {
+		cropUnitX = 2
+	}
+	if chromaFormat == 1 {
+		cropUnitY *= 2
+	}
+
+	width = widthInMbs*16 - (cropLeft+cropRight)*cropUnitX
+	height = (2-frameMbsOnly)*heightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return width, height, nil
+}
+
+// parseHevcSPS parse the resolution from H.265 SPS, see ITU-T H.265 7.3.2.2.
+func parseHevcSPS(nalu []byte) (width, height int, err error) {
+	r := &tsBitReader{b: tsRBSP(nalu[2:])}
+	r.u(4) // sps_video_parameter_set_id
+	maxSubLayers := int(r.u(3))
+	r.u(1) // sps_temporal_id_nesting_flag
+
+	// The profile_tier_level, general profile and level is 96 bits.
+	r.u(32)
+	r.u(32)
+	r.u(32)
+	profilePresent, levelPresent := make([]bool, maxSubLayers), make([]bool, maxSubLayers)
+	for i := 0; i < maxSubLayers; i++ {
+		profilePresent[i], levelPresent[i] = r.u(1) != 0, r.u(1) != 0
+	}
+	if maxSubLayers > 0 {
+		for i := maxSubLayers; i < 8; i++ {
+			r.u(2) // reserved_zero_2bits
+		}
+	}
+	for i := 0; i < maxSubLayers; i++ {
+		if profilePresent[i] {
+			r.u(32)
+			r.u(32)
+			r.u(24)
+		}
+		if levelPresent[i] {
+			r.u(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := r.ue()
+	if chromaFormat == 3 {
+		r.u(1) // separate_colour_plane_flag
+	}
+	width, height = int(r.ue()), int(r.ue())
+
+	if r.u(1) != 0 { // conformance_window_flag
+		subWidth, subHeight := 1, 1
+		if chromaFormat == 1 || chromaFormat == 2 {
+			subWidth = 2
+		}
+		if chromaFormat == 1 {
+			subHeight = 2
+		}
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		width -= subWidth * (left + right)
+		height -= subHeight * (top + bottom)
+	}
+	if r.eof() {
+		return 0, 0, errors.Errorf("sps too short %v", len(nalu))
+	}
+	return width, height, nil
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// tsBitWriter writes the bits and Exp-Golomb codes, to build the SPS of fixtures.
+type tsBitWriter struct {
+	b   []byte
+	pos int
+}
+
+func (v *tsBitWriter) u(n int, value uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if v.pos%8 == 0 {
+			v.b = append(v.b, 0)
+		}
+		if (value>>uint(i))&0x01 != 0 {
+			v.b[len(v.b)-1] |= 1 << uint(7-v.pos%8)
+		}
+		v.pos++
+	}
+}
+
+func (v *tsBitWriter) ue(value uint32) {
+	value++
+	var n int
+	for t := value; t > 1; t >>= 1 {
+		n++
+	}
+	v.u(n, 0)
+	v.u(n+1, value)
+}
+
+// testAvcSPS build the H.264 SPS of high profile, with 4:2:0 and progressive frames.
+func testAvcSPS(widthInMbs, heightInMbs, cropBottom uint32) []byte {
+	w := &tsBitWriter{}
+	w.u(8, 0x67)    // nal_unit_type 7
+	w.u(8, 100)     // profile_idc
+	w.u(16, 0x0028) // constraint_set_flags, level_idc
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(1)         // chroma_format_idc
+	w.ue(0)         // bit_depth_luma_minus8
+	w.ue(0)         // bit_depth_chroma_minus8
+	w.u(1, 0)       // qpprime_y_zero_transform_bypass_flag
+	w.u(1, 0)       // seq_scaling_matrix_present_flag
+	w.ue(0)         // log2_max_frame_num_minus4
+	w.ue(0)         // pic_order_cnt_type
+	w.ue(2)         // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(4)         // max_num_ref_frames
+	w.u(1, 0)       // gaps_in_frame_num_value_allowed_flag
+	w.ue(widthInMbs - 1)
+	w.ue(heightInMbs - 1)
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	if cropBottom > 0 {
+		w.u(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0) // vui_parameters_present_flag
+	w.u(1, 1) // rbsp_stop_one_bit
+	return w.b
+}
+
+// testHevcSPS build the H.265 SPS with one sub layer, and 4:2:0.
+func testHevcSPS(width, height, cropBottom uint32) []byte {
+	w := &tsBitWriter{}
+	w.u(16, 0x4201) // nal_unit_type 33
+	w.u(4, 0)       // sps_video_parameter_set_id
+	w.u(3, 1)       // sps_max_sub_layers_minus1
+	w.u(1, 1)       // sps_temporal_id_nesting_flag
+	w.u(32, 0x01600000)
+	w.u(32, 0)
+	w.u(32, 0x5d)
+	w.u(1, 1) // sub_layer_profile_present_flag
+	w.u(1, 1) // sub_layer_level_present_flag
+	for i := 1; i < 8; i++ {
+		w.u(2, 0)
+	}
+	w.u(32, 0)
+	w.u(32, 0)
+	w.u(24, 0)
+	w.u(8, 0)
+	w.ue(0) // sps_seq_parameter_set_id
+	w.ue(1) // chroma_format_idc
+	w.ue(width)
+	w.ue(height)
+	if cropBottom > 0 {
+		w.u(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(8, 0xff)
+	return w.b
+}
+
+// testPESPackets build the TS packets of a PES, stuffed by adaptation field.
+func testPESPackets(pid int, pts int64, es []byte, cc *int) []byte {
+	pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | (pts>>29)&0x0e), byte(pts >> 22), byte((pts>>14)&0xfe | 1), byte(pts >> 7), byte(pts<<1 | 1),
+	}
+	pes = append(pes, es...)
+
+	var b []byte
+	for first := true; len(pes) > 0; first = false {
+		p := make([]byte, tsPacketSize)
+		p[0], p[1], p[2] = tsSyncByte, byte(pid>>8), byte(pid)
+		if first {
+			p[1] |= 0x40
+		}
+
+		n := tsPacketSize - 4
+		if len(pes) < n {
+			af := n - len(pes)
+			p[3], p[4] = 0x30|byte(*cc&0x0f), byte(af-1)
+			for i := 6; i < 4+af; i++ {
+				p[i] = 0xff
+			}
+			n = len(pes)
+			copy(p[4+af:], pes)
+		} else {
+			p[3] = 0x10 | byte(*cc&0x0f)
+			copy(p[4:], pes[:n])
+		}
+
+		*cc++
+		pes = pes[n:]
+		b = append(b, p...)
+	}
+	return b
+}
+
+// testPSIPacket build the TS packet of PSI section.
+func testPSIPacket(pid int, section []byte) []byte {
+	p := make([]byte, tsPacketSize)
+	for i := range p {
+		p[i] = 0xff
+	}
+	p[0], p[1], p[2], p[3], p[4] = tsSyncByte, 0x40|byte(pid>>8), byte(pid), 0x10, 0
+	copy(p[5:], section)
+	return p
+}
+
+// testTsSegment build a segment of 50 video frames at 25fps and AAC audio, whose PTS wraps around. There is
+// a SPS and IDR every 25 frames, so the keyframes are at 0.02s and 1.02s, after the first audio frame, and the
+// last frame is at 1.98s.
+func testTsSegment(streamType byte, sps, idr []byte) []byte {
+	pat := []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xe1, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0x02, 0xb0, 23, 0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0,
+		streamType, 0xe1, 0x01, 0xf0, 0,
+		0x0f, 0xe1, 0x02, 0xf0, 0,
+		0, 0, 0, 0,
+	}
+
+	b := append(testPSIPacket(0, pat), testPSIPacket(0x100, pmt)...)
+	var cc int
+	base := tsPtsWrap - tsClockRate
+	for i := 0; i < 50; i++ {
+		pts := (base + int64(i)*3600) % tsPtsWrap
+
+		var es []byte
+		if i%25 == 0 {
+			es = append(append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 1), idr...)
+			es = append(es, make([]byte, 400)...)
+		} else {
+			es = append([]byte{0, 0, 0, 1, 0x41, 0x9a}, make([]byte, 50)...)
+		}
+		es[len(es)-1] = 0x01
+		b = append(b, testPESPackets(0x101, pts, es, &cc)...)
+
+		if i%3 == 0 {
+			b = append(b, testPESPackets(0x102, (pts+tsPtsWrap-1800)%tsPtsWrap, []byte{0xff, 0xf1, 1, 2}, &cc)...)
+		}
+	}
+	return b
+}
+
+func TestTsDemuxerParse(t *testing.T) {
+	invalid := testTsSegment(tsStreamTypeH264, testAvcSPS(120, 68, 4), []byte{0x65, 0x88})
+	invalid[tsPacketSize*3] = 0x48
+
+	for _, c := range []struct {
+		name          string
+		b             []byte
+		codec         string
+		width, height int
+		duration      float64
+		keyframes     []float64
+		err           bool
+	}{
+		{
+			name: "h264", b: testTsSegment(tsStreamTypeH264, testAvcSPS(120, 68, 4), []byte{0x65, 0x88}),
+			codec: TsCodecH264, width: 1920, height: 1080, duration: 1.98, keyframes: []float64{0.02, 1.02},
+		},
+		{
+			name: "h265", b: testTsSegment(tsStreamTypeH265, testHevcSPS(1280, 728, 4), []byte{0x26, 0x01}),
+			codec: TsCodecH265, width: 1280, height: 720, duration: 1.98, keyframes: []float64{0.02, 1.02},
+		},
+		{
+			name: "no video", b: testTsSegment(0x0f, nil, nil), duration: 1.98,
+		},
+		{
+			name: "invalid sync byte", b: invalid, err: true,
+		},
+		{
+			name: "no pts", b: testPSIPacket(0, []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xe1, 0x00, 0, 0, 0, 0}),
+			err: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			demuxer, tsFile := NewTsDemuxer(), &TsFile{}
+			err := demuxer.Parse(c.b)
+			if err == nil {
+				err = demuxer.Fill(tsFile)
+			}
+			if c.err {
+				if err == nil {
+					t.Fatalf("expect error, got %v", demuxer.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("demux err %+v", err)
+			}
+
+			if tsFile.Codec != c.codec || tsFile.Width != c.width || tsFile.Height != c.height {
+				t.Errorf("expect %v %vx%v, got %v %vx%v", c.codec, c.width, c.height, tsFile.Codec, tsFile.Width, tsFile.Height)
+			}
+			if duration := tsFile.End - tsFile.Start; math.Abs(duration-c.duration) > 0.001 {
+				t.Errorf("expect duration %v, got %v", c.duration, duration)
+			}
+			if len(tsFile.Keyframes) != len(c.keyframes) {
+				t.Fatalf("expect keyframes %v, got %v", c.keyframes, tsFile.Keyframes)
+			}
+			for i, keyframe := range c.keyframes {
+				if math.Abs(tsFile.Keyframes[i]-keyframe) > 0.001 {
+					t.Errorf("expect keyframes %v, got %v", c.keyframes, tsFile.Keyframes)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAvcSPS(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		nalu          []byte
+		width, height int
+		err           bool
+	}{
+		{name: "1080p cropped", nalu: testAvcSPS(120, 68, 4), width: 1920, height: 1080},
+		{name: "720p", nalu: testAvcSPS(80, 45, 0), width: 1280, height: 720},
+		{name: "cif", nalu: testAvcSPS(22, 18, 0), width: 352, height: 288},
+		{name: "truncated", nalu: testAvcSPS(120, 68, 4)[:4], err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			width, height, err := parseAvcSPS(c.nalu)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expect error, got %vx%v", width, height)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse err %+v", err)
+			}
+			if width != c.width || height != c.height {
+				t.Errorf("expect %vx%v, got %vx%v", c.width, c.height, width, height)
+			}
+		})
+	}
+}
+
+func TestParseHevcSPS(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		nalu          []byte
+		width, height int
+		err           bool
+	}{
+		{name: "720p cropped", nalu: testHevcSPS(1280, 728, 4), width: 1280, height: 720},
+		{name: "1080p cropped", nalu: testHevcSPS(1920, 1088, 4), width: 1920, height: 1080},
+		{name: "4k", nalu: testHevcSPS(3840, 2160, 0), width: 3840, height: 2160},
+		{name: "truncated", nalu: testHevcSPS(1280, 728, 4)[:16], err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			width, height, err := parseHevcSPS(c.nalu)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expect error, got %vx%v", width, height)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse err %+v", err)
+			}
+			if width != c.width || height != c.height {
+				t.Errorf("expect %vx%v, got %vx%v", c.width, c.height, width, height)
+			}
+		})
+	}
+}
+
+func TestTsRBSP(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		nalu, rbsp []byte
+	}{
+		{name: "no emulation", nalu: []byte{1, 2, 3}, rbsp: []byte{1, 2, 3}},
+		{name: "emulation", nalu: []byte{1, 0, 0, 3, 1}, rbsp: []byte{1, 0, 0, 1}},
+		{name: "continuous", nalu: []byte{0, 0, 3, 0, 0, 3, 1}, rbsp: []byte{0, 0, 0, 0, 1}},
+		{name: "trailing", nalu: []byte{1, 0, 0, 3}, rbsp: []byte{1, 0, 0}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if rbsp := tsRBSP(c.nalu); string(rbsp) != string(c.rbsp) {
+				t.Errorf("expect %v, got %v", c.rbsp, rbsp)
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var outboxWorker *OutboxWorker
+
+// The types of callback message.
+const (
+	// Notify the API server that an accident begins, which responds the accident id.
+	OutboxTypeAccidentBegin = "accident/begin"
+	// Notify the API server that an accident ends, which depends on the accident id of begin.
+	OutboxTypeAccidentEnd = "accident/end"
+	// Notify the API server that a stream is unpublished.
+	OutboxTypeStreamEnd = "stream/end"
+)
+
+// The backoff of retry, which is doubled for each attempt.
+const (
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+// OutboxMessage is a callback to API server, which is saved in redis and delivered at least once. The API
+// server should identify the duplicated message by the Idempotency-Key header, which is the id of message.
+type OutboxMessage struct {
+	// The id of message, also the idempotency key.
+	ID string `json:"id"`
+	// The type of message, such as accident/begin.
+	Type string `json:"type"`
+	// The path of API, such as /accident.
+	Path string `json:"path"`
+	// The request body in json.
+	Body json.RawMessage `json:"body"`
+
+	// The message to wait for, which should be delivered before this message.
+	DependsOn string `json:"dependsOn,omitempty"`
+	// The uuid of accident, to bind the accident id of begin, or to resolve the accident id for end.
+	AccidentUUID string `json:"accident,omitempty"`
+
+	// The number of attempts.
+	Attempts int `json:"attempts"`
+	// The create time, and the next attempt time.
+	Create string `json:"create"`
+	Next   string `json:"next,omitempty"`
+	// The error of the last attempt.
+	LastError string `json:"error,omitempty"`
+}
+
+func (v *OutboxMessage) String() string {
+	return fmt.Sprintf("id=%v, type=%v, path=%v, depends=%v, accident=%v, attempts=%v, next=%v, error=%v",
+		v.ID, v.Type, v.Path, v.DependsOn, v.AccidentUUID, v.Attempts, v.Next, v.LastError,
+	)
+}
+
+// NewOutboxMessage create a callback message of type to path, with body marshaled to json.
+func NewOutboxMessage(msgType, path string, body interface{}) (*OutboxMessage, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal %v", body)
+	}
+
+	return &OutboxMessage{
+		ID: uuid.NewString(), Type: msgType, Path: path, Body: b, Create: time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+// outboxError is the error of delivery, which is not retried if permanent.
+type outboxError struct {
+	err       error
+	permanent bool
+}
+
+func (v *outboxError) Error() string {
+	return v.err.Error()
+}
+
+// OutboxWorker delivers the callback messages in redis, retries with exponential backoff, and moves the
+// message to dead letter if exceed the max attempts or rejected by API server.
+type OutboxWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The max number of attempts before dead letter.
+	maxAttempts int
+	// To wakeup the worker when enqueue a message.
+	notify chan struct{}
+}
+
+func NewOutboxWorker() *OutboxWorker {
+	v := &OutboxWorker{maxAttempts: 10, notify: make(chan struct{}, 1)}
+	if n, err := strconv.Atoi(envCallbackMaxAttempts()); err == nil && n > 0 {
+		v.maxAttempts = n
+	}
+	return v
+}
+
+func (v *OutboxWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *OutboxWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "outbox: start worker, api=%v, attempts=%v", envApiBaseUrl(), v.maxAttempts)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.deliverDue(ctx); err != nil {
+				logger.Wf(ctx, "outbox: ignore deliver err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.notify:
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Enqueue save the message to redis, which is delivered by worker later.
+func (v *OutboxWorker) Enqueue(ctx context.Context, msg *OutboxMessage) error {
+	if err := v.schedule(ctx, msg, time.Now()); err != nil {
+		return errors.Wrapf(err, "schedule %v", msg.String())
+	}
+
+	select {
+	case v.notify <- struct{}{}:
+	default:
+	}
+
+	logger.Tf(ctx, "outbox: enqueue %v", msg.String())
+	return nil
+}
+
+// schedule save the message and the time of next attempt.
+func (v *OutboxWorker) schedule(ctx context.Context, msg *OutboxMessage, next time.Time) error {
+	msg.Next = next.Format(time.RFC3339)
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", msg.String())
+	}
+
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, CALLBACK_OUTBOX, msg.ID, string(b))
+		pipe.ZAdd(ctx, CALLBACK_OUTBOX_SCHEDULE, redis.Z{Score: float64(next.UnixMilli()), Member: msg.ID})
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "save %v", msg.String())
+	}
+	return nil
+}
+
+// deliverDue deliver the messages which are due, in order of schedule.
+func (v *OutboxWorker) deliverDue(ctx context.Context) error {
+	ids, err := rdb.ZRangeByScore(ctx, CALLBACK_OUTBOX_SCHEDULE, &redis.ZRangeBy{
+		Min: "-inf", Max: fmt.Sprint(time.Now().UnixMilli()), Count: 32,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "zrangebyscore %v", CALLBACK_OUTBOX_SCHEDULE)
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		obj, err := rdb.HGet(ctx, CALLBACK_OUTBOX, id).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hget %v %v", CALLBACK_OUTBOX, id)
+		}
+
+		msg := &OutboxMessage{}
+		if obj == "" || json.Unmarshal([]byte(obj), msg) != nil {
+			logger.Wf(ctx, "outbox: drop invalid message %v %v", id, obj)
+			rdb.ZRem(ctx, CALLBACK_OUTBOX_SCHEDULE, id)
+			continue
+		}
+
+		if err := v.deliverMessage(ctx, msg); err != nil {
+			return errors.Wrapf(err, "deliver %v", msg.String())
+		}
+	}
+
+	return nil
+}
+
+// deliverMessage deliver the message, then remove, retry or move it to dead letter.
+func (v *OutboxWorker) deliverMessage(ctx context.Context, msg *OutboxMessage) error {
+	// Wait for the message it depends on, without counting the attempts.
+	if msg.DependsOn != "" {
+		if ok, err := rdb.HExists(ctx, CALLBACK_OUTBOX, msg.DependsOn).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hexists %v %v", CALLBACK_OUTBOX, msg.DependsOn)
+		} else if ok {
+			return v.schedule(ctx, msg, time.Now().Add(outboxMinBackoff))
+		}
+
+		if ok, err := rdb.HExists(ctx, CALLBACK_OUTBOX_DEAD, msg.DependsOn).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hexists %v %v", CALLBACK_OUTBOX_DEAD, msg.DependsOn)
+		} else if ok {
+			msg.LastError = fmt.Sprintf("depends on dead message %v", msg.DependsOn)
+			return v.bury(ctx, msg)
+		}
+	}
+
+	starttime := time.Now()
+	res, err := v.post(ctx, msg)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricCallbackSeconds.Observe(metricLabels("type", msg.Type, "result", result), time.Since(starttime))
+
+	// Retry the message if failed to handle the response, such as no accident id, because the message
+	// depends on it is not able to be delivered without it.
+	if err == nil {
+		if r0 := v.onDelivered(ctx, msg, res); r0 != nil {
+			err = errors.Wrapf(r0, "handle response")
+		}
+	}
+
+	if err == nil {
+		if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, CALLBACK_OUTBOX, msg.ID)
+			pipe.ZRem(ctx, CALLBACK_OUTBOX_SCHEDULE, msg.ID)
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "remove %v", msg.String())
+		}
+
+		logger.Tf(ctx, "outbox: deliver %v ok", msg.String())
+		return nil
+	}
+
+	msg.Attempts++
+	msg.LastError = err.Error()
+	if r, ok := err.(*outboxError); (ok && r.permanent) || msg.Attempts >= v.maxAttempts {
+		return v.bury(ctx, msg)
+	}
+
+	backoff := time.Duration(math.Min(
+		float64(outboxMinBackoff)*math.Pow(2, float64(msg.Attempts-1)), float64(outboxMaxBackoff),
+	))
+	logger.Wf(ctx, "outbox: retry %v after %v", msg.String(), backoff)
+	return v.schedule(ctx, msg, time.Now().Add(backoff))
+}
+
+// bury move the message to dead letter, for user to inspect and retry.
+func (v *OutboxWorker) bury(ctx context.Context, msg *OutboxMessage) error {
+	msg.Next = ""
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", msg.String())
+	}
+
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, CALLBACK_OUTBOX_DEAD, msg.ID, string(b))
+		pipe.HDel(ctx, CALLBACK_OUTBOX, msg.ID)
+		pipe.ZRem(ctx, CALLBACK_OUTBOX_SCHEDULE, msg.ID)
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "bury %v", msg.String())
+	}
+
+	logger.Wf(ctx, "outbox: dead message %v", msg.String())
+	return nil
+}
+
+// post the message to API server, and return the response body.
+func (v *OutboxWorker) post(ctx context.Context, msg *OutboxMessage) ([]byte, error) {
+	body := []byte(msg.Body)
+
+	// Resolve the accident id of end message, which is responded by the begin message.
+	if msg.Type == OutboxTypeAccidentEnd && msg.AccidentUUID != "" {
+		id, err := rdb.HGet(ctx, SRS_ACCIDENT_ID, msg.AccidentUUID).Int()
+		if err != nil || id == 0 {
+			return nil, &outboxError{err: errors.Errorf("no accident id of %v, err %v", msg.AccidentUUID, err), permanent: true}
+		}
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return nil, &outboxError{err: errors.Wrapf(err, "unmarshal %v", string(body)), permanent: true}
+		}
+		obj["id"] = id
+		if body, err = json.Marshal(obj); err != nil {
+			return nil, &outboxError{err: errors.Wrapf(err, "marshal %v", obj), permanent: true}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	api := fmt.Sprintf("%v%v", strings.TrimSuffix(envApiBaseUrl(), "/"), msg.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api, bytes.NewReader(body))
+	if err != nil {
+		return nil, &outboxError{err: errors.Wrapf(err, "new request %v", api), permanent: true}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.ID)
+	if err := signCallback(req, body); err != nil {
+		return nil, errors.Wrapf(err, "sign %v", api)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "post %v", api)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", api)
+	}
+
+	// Retry for server error, timeout or throttled, while other client errors are permanent.
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err := errors.Errorf("post %v status %v, body %v", api, res.StatusCode, string(b))
+		permanent := res.StatusCode >= 400 && res.StatusCode < 500 &&
+			res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests
+		return nil, &outboxError{err: err, permanent: permanent}
+	}
+
+	return b, nil
+}
+
+// onDelivered bind the accident id responded by begin message, error if no accident id.
+func (v *OutboxWorker) onDelivered(ctx context.Context, msg *OutboxMessage, res []byte) error {
+	if msg.Type != OutboxTypeAccidentBegin || msg.AccidentUUID == "" {
+		return nil
+	}
+
+	var obj struct {
+		AccidentId int `json:"accidentId"`
+	}
+	if err := json.Unmarshal(res, &obj); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(res))
+	}
+	if obj.AccidentId == 0 {
+		return errors.Errorf("no accident id in %v", string(res))
+	}
+
+	if err := rdb.HSet(ctx, SRS_ACCIDENT_ID, msg.AccidentUUID, obj.AccidentId).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_ACCIDENT_ID, msg.AccidentUUID, obj.AccidentId)
+	}
+
+	if err := accidentWorker.OnAccidentId(ctx, msg.AccidentUUID, obj.AccidentId); err != nil {
+		return errors.Wrapf(err, "bind accident id %v to %v", obj.AccidentId, msg.AccidentUUID)
+	}
+	return nil
+}
+
+// queryMessages load all messages of hash key, ordered by create time.
+func (v *OutboxWorker) queryMessages(ctx context.Context, key string) ([]*OutboxMessage, error) {
+	objs, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", key)
+	}
+
+	msgs := []*OutboxMessage{}
+	for id, obj := range objs {
+		msg := &OutboxMessage{}
+		if err := json.Unmarshal([]byte(obj), msg); err != nil {
+			logger.Wf(ctx, "outbox: ignore invalid %v %v err %+v", id, obj, err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if msgs[i].Create != msgs[j].Create {
+			return msgs[i].Create < msgs[j].Create
+		}
+		return msgs[i].ID < msgs[j].ID
+	})
+	return msgs, nil
+}
+
+func (v *OutboxWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/callbacks/outbox"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			msgs, err := v.queryMessages(ctx, CALLBACK_OUTBOX)
+			if err != nil {
+				return errors.Wrapf(err, "query outbox")
+			}
+
+			ohttp.WriteData(ctx, w, r, msgs)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/callbacks/dead"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			msgs, err := v.queryMessages(ctx, CALLBACK_OUTBOX_DEAD)
+			if err != nil {
+				return errors.Wrapf(err, "query dead")
+			}
+
+			ohttp.WriteData(ctx, w, r, msgs)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/callbacks/dead/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Format is /callbacks/dead/:id, POST to retry, DELETE to drop.
+			id := strings.TrimPrefix(r.URL.Path, ep)
+			obj, err := rdb.HGet(ctx, CALLBACK_OUTBOX_DEAD, id).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", CALLBACK_OUTBOX_DEAD, id)
+			} else if obj == "" {
+				return errors.Errorf("no message %v", id)
+			}
+
+			msg := &OutboxMessage{}
+			if err := json.Unmarshal([]byte(obj), msg); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", obj)
+			}
+
+			switch r.Method {
+			case http.MethodPost:
+				msg.Attempts, msg.LastError = 0, ""
+				if err := v.Enqueue(ctx, msg); err != nil {
+					return errors.Wrapf(err, "enqueue %v", msg.String())
+				}
+			case http.MethodDelete:
+			default:
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			if err := rdb.HDel(ctx, CALLBACK_OUTBOX_DEAD, id).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", CALLBACK_OUTBOX_DEAD, id)
+			}
+
+			ohttp.WriteData(ctx, w, r, msg)
+			logger.Tf(ctx, "outbox: %v dead message %v", r.Method, msg.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
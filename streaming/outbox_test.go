@@ -0,0 +1,385 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeApiServer is the API server to receive callbacks, which responds the status and body in order, and
+// keeps responding the last one.
+type fakeApiServer struct {
+	lock      sync.Mutex
+	responses []fakeApiResponse
+	// The requests received, formatted as "path body".
+	requests []string
+}
+
+type fakeApiResponse struct {
+	status int
+	body   string
+}
+
+// newFakeApiServer start a fake API server, and set the API_BASE_URL and callback secret to it.
+func newFakeApiServer(t *testing.T, responses ...fakeApiResponse) *fakeApiServer {
+	v := &fakeApiServer{responses: responses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.requests = append(v.requests, fmt.Sprintf("%v %v", r.URL.Path, string(b)))
+
+		res := fakeApiResponse{status: http.StatusOK, body: "{}"}
+		if len(v.responses) > 0 {
+			res = v.responses[0]
+		}
+		if len(v.responses) > 1 {
+			v.responses = v.responses[1:]
+		}
+
+		w.WriteHeader(res.status)
+		fmt.Fprint(w, res.body)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := callbackSecret
+	callbackSecret = "secret"
+	t.Cleanup(func() { callbackSecret = previous })
+	t.Setenv("API_BASE_URL", server.URL)
+	return v
+}
+
+func (v *fakeApiServer) Requests() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return append([]string{}, v.requests...)
+}
+
+// queryOutboxMessage load the message from outbox or dead letter, nil if not found.
+func queryOutboxMessage(t *testing.T, ctx context.Context, key, id string) *OutboxMessage {
+	obj, err := rdb.HGet(ctx, key, id).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		t.Fatalf("hget %v %v err %+v", key, id, err)
+	}
+
+	msg := &OutboxMessage{}
+	if err := json.Unmarshal([]byte(obj), msg); err != nil {
+		t.Fatalf("unmarshal %v err %+v", obj, err)
+	}
+	return msg
+}
+
+func TestOutboxDeliverMessage(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// The message to deliver, and the attempts before.
+		msgType  string
+		accident bool
+		attempts int
+		// The max attempts, default to 10.
+		maxAttempts int
+		// The message it depends on, which is pending in outbox or dead.
+		depends string
+		// The accident id responded by begin message.
+		accidentId int
+		// The response of API server.
+		response fakeApiResponse
+		// Whether posted, and the state of message after delivered. The message is retried after backoff if
+		// not delivered or dead.
+		posted, delivered, dead bool
+		backoff                 time.Duration
+	}{
+		{
+			name: "delivered", msgType: OutboxTypeStreamEnd,
+			response: fakeApiResponse{status: http.StatusOK}, posted: true, delivered: true,
+		},
+		{
+			name: "first retry", msgType: OutboxTypeStreamEnd,
+			response: fakeApiResponse{status: http.StatusServiceUnavailable}, posted: true, backoff: time.Second,
+		},
+		{
+			name: "double backoff", msgType: OutboxTypeStreamEnd, attempts: 3,
+			response: fakeApiResponse{status: http.StatusInternalServerError}, posted: true, backoff: 8 * time.Second,
+		},
+		{
+			name: "max backoff", msgType: OutboxTypeStreamEnd, attempts: 12, maxAttempts: 100,
+			response: fakeApiResponse{status: http.StatusBadGateway}, posted: true, backoff: outboxMaxBackoff,
+		},
+		{
+			name: "retry throttled", msgType: OutboxTypeStreamEnd,
+			response: fakeApiResponse{status: http.StatusTooManyRequests}, posted: true, backoff: time.Second,
+		},
+		{
+			name: "retry timeout", msgType: OutboxTypeStreamEnd,
+			response: fakeApiResponse{status: http.StatusRequestTimeout}, posted: true, backoff: time.Second,
+		},
+		{
+			name: "permanent rejected", msgType: OutboxTypeStreamEnd,
+			response: fakeApiResponse{status: http.StatusBadRequest}, posted: true, dead: true,
+		},
+		{
+			name: "exceed max attempts", msgType: OutboxTypeStreamEnd, attempts: 9,
+			response: fakeApiResponse{status: http.StatusServiceUnavailable}, posted: true, dead: true,
+		},
+		{
+			name: "begin with accident id", msgType: OutboxTypeAccidentBegin, accident: true,
+			response: fakeApiResponse{status: http.StatusCreated, body: `{"accidentId":42}`},
+			posted:   true, delivered: true, accidentId: 42,
+		},
+		{
+			name: "begin without accident id", msgType: OutboxTypeAccidentBegin, accident: true,
+			response: fakeApiResponse{status: http.StatusCreated, body: `{}`}, posted: true, backoff: time.Second,
+		},
+		{
+			name: "begin with zero accident id", msgType: OutboxTypeAccidentBegin, accident: true,
+			response: fakeApiResponse{status: http.StatusCreated, body: `{"accidentId":0}`}, posted: true,
+			backoff: time.Second,
+		},
+		{
+			name: "begin with invalid response", msgType: OutboxTypeAccidentBegin, accident: true, attempts: 1,
+			response: fakeApiResponse{status: http.StatusCreated, body: `OK`}, posted: true, backoff: 2 * time.Second,
+		},
+		{
+			name: "end without accident id", msgType: OutboxTypeAccidentEnd, accident: true,
+			response: fakeApiResponse{status: http.StatusOK}, dead: true,
+		},
+		{
+			name: "wait for pending dependency", msgType: OutboxTypeAccidentEnd, depends: CALLBACK_OUTBOX,
+			response: fakeApiResponse{status: http.StatusOK}, backoff: outboxMinBackoff,
+		},
+		{
+			name: "wait without attempts", msgType: OutboxTypeAccidentEnd, depends: CALLBACK_OUTBOX, attempts: 9,
+			response: fakeApiResponse{status: http.StatusOK}, backoff: outboxMinBackoff,
+		},
+		{
+			name: "dead dependency", msgType: OutboxTypeAccidentEnd, depends: CALLBACK_OUTBOX_DEAD,
+			response: fakeApiResponse{status: http.StatusOK}, dead: true,
+		},
+		{
+			name: "delivered dependency", msgType: OutboxTypeAccidentEnd, depends: "-",
+			response: fakeApiResponse{status: http.StatusOK}, posted: true, delivered: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			newFakeRedis(t)
+			api := newFakeApiServer(t, c.response)
+
+			previous := accidentWorker
+			accidentWorker = NewAccidentWorker()
+			t.Cleanup(func() { accidentWorker = previous })
+
+			v := NewOutboxWorker()
+			if c.maxAttempts > 0 {
+				v.maxAttempts = c.maxAttempts
+			}
+
+			msg, err := NewOutboxMessage(c.msgType, "/callback", map[string]string{"streamKey": "livestream"})
+			if err != nil {
+				t.Fatalf("new message err %+v", err)
+			}
+			msg.Attempts = c.attempts
+			if c.accident {
+				msg.AccidentUUID = "accident"
+			}
+
+			// The dependency is in the outbox or dead letter, or delivered if not found.
+			if c.depends != "" {
+				dependency, err := NewOutboxMessage(OutboxTypeAccidentBegin, "/callback", nil)
+				if err != nil {
+					t.Fatalf("new dependency err %+v", err)
+				}
+				if c.depends != "-" {
+					if err := rdb.HSet(ctx, c.depends, dependency.ID, "{}").Err(); err != nil {
+						t.Fatalf("hset dependency err %+v", err)
+					}
+				}
+				msg.DependsOn = dependency.ID
+			}
+
+			if err := v.schedule(ctx, msg, time.Now()); err != nil {
+				t.Fatalf("schedule err %+v", err)
+			}
+			starttime := time.Now()
+			if err := v.deliverMessage(ctx, msg); err != nil {
+				t.Fatalf("deliver err %+v", err)
+			}
+
+			if posted := len(api.Requests()) > 0; posted != c.posted {
+				t.Fatalf("expect posted %v, got %v", c.posted, api.Requests())
+			}
+
+			pending := queryOutboxMessage(t, ctx, CALLBACK_OUTBOX, msg.ID)
+			dead := queryOutboxMessage(t, ctx, CALLBACK_OUTBOX_DEAD, msg.ID)
+			if c.delivered && (pending != nil || dead != nil) {
+				t.Fatalf("expect delivered, got pending %v, dead %v", pending, dead)
+			} else if c.dead && (pending != nil || dead == nil) {
+				t.Fatalf("expect dead, got pending %v, dead %v", pending, dead)
+			}
+
+			if score, err := rdb.ZScore(ctx, CALLBACK_OUTBOX_SCHEDULE, msg.ID).Result(); err != redis.Nil {
+				if c.delivered || c.dead {
+					t.Fatalf("expect unscheduled, got score %v, err %v", score, err)
+				}
+			}
+
+			if !c.delivered && !c.dead {
+				if pending == nil || dead != nil {
+					t.Fatalf("expect retry, got pending %v, dead %v", pending, dead)
+				}
+
+				// Waiting for the dependency is not counted as an attempt.
+				attempts := c.attempts + 1
+				if c.depends != "" {
+					attempts = c.attempts
+				}
+				if pending.Attempts != attempts {
+					t.Errorf("expect attempts %v, got %v", attempts, pending.Attempts)
+				}
+
+				score, err := rdb.ZScore(ctx, CALLBACK_OUTBOX_SCHEDULE, msg.ID).Result()
+				if err != nil {
+					t.Fatalf("zscore err %+v", err)
+				}
+				backoff := time.Duration(int64(score)-starttime.UnixMilli()) * time.Millisecond
+				if backoff < c.backoff || backoff > c.backoff+time.Second {
+					t.Errorf("expect backoff %v, got %v", c.backoff, backoff)
+				}
+			}
+
+			if c.accidentId > 0 {
+				if id, err := rdb.HGet(ctx, SRS_ACCIDENT_ID, msg.AccidentUUID).Int(); err != nil || id != c.accidentId {
+					t.Errorf("expect accident id %v, got %v, err %v", c.accidentId, id, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxDependsOnOrder(t *testing.T) {
+	ctx := context.Background()
+	newFakeRedis(t)
+
+	previous := accidentWorker
+	accidentWorker = NewAccidentWorker()
+	t.Cleanup(func() { accidentWorker = previous })
+
+	for _, c := range []struct {
+		name string
+		// The responses of API server in order.
+		responses []fakeApiResponse
+		// The requests of each round to deliver the due messages.
+		rounds [][]string
+		// Whether the begin and end message are dead finally.
+		dead bool
+	}{
+		{
+			name: "end after begin",
+			responses: []fakeApiResponse{
+				{status: http.StatusCreated, body: `{"accidentId":42}`},
+				{status: http.StatusOK},
+			},
+			rounds: [][]string{
+				{`/accident {"streamKey":"livestream"}`},
+				{`/accident/end {"id":42,"streamKey":"livestream"}`},
+			},
+		},
+		{
+			name: "end waits for retried begin",
+			responses: []fakeApiResponse{
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusCreated, body: `{}`},
+				{status: http.StatusCreated, body: `{"accidentId":42}`},
+				{status: http.StatusOK},
+			},
+			rounds: [][]string{
+				{`/accident {"streamKey":"livestream"}`},
+				{`/accident {"streamKey":"livestream"}`},
+				{`/accident {"streamKey":"livestream"}`},
+				{`/accident/end {"id":42,"streamKey":"livestream"}`},
+			},
+		},
+		{
+			name: "end buried with begin",
+			responses: []fakeApiResponse{
+				{status: http.StatusForbidden},
+			},
+			rounds: [][]string{
+				{`/accident {"streamKey":"livestream"}`},
+				{},
+			},
+			dead: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			api := newFakeApiServer(t, c.responses...)
+			v := NewOutboxWorker()
+
+			accidentUUID := fmt.Sprintf("accident-%v", c.name)
+			body := map[string]string{"streamKey": "livestream"}
+			begin, err := NewOutboxMessage(OutboxTypeAccidentBegin, "/accident", body)
+			if err != nil {
+				t.Fatalf("new begin err %+v", err)
+			}
+			end, err := NewOutboxMessage(OutboxTypeAccidentEnd, "/accident/end", body)
+			if err != nil {
+				t.Fatalf("new end err %+v", err)
+			}
+			begin.AccidentUUID, end.AccidentUUID, end.DependsOn = accidentUUID, accidentUUID, begin.ID
+
+			// Schedule the end before the begin, to verify the end waits for the begin.
+			if err := v.schedule(ctx, end, time.Now().Add(-2*time.Second)); err != nil {
+				t.Fatalf("schedule end err %+v", err)
+			}
+			if err := v.schedule(ctx, begin, time.Now().Add(-time.Second)); err != nil {
+				t.Fatalf("schedule begin err %+v", err)
+			}
+
+			var requests []string
+			for i, round := range c.rounds {
+				// Make the pending messages due, keeping the end before the begin.
+				for j, id := range []string{end.ID, begin.ID} {
+					if ok, err := rdb.HExists(ctx, CALLBACK_OUTBOX, id).Result(); err != nil {
+						t.Fatalf("hexists err %+v", err)
+					} else if !ok {
+						continue
+					}
+					if err := rdb.ZAdd(ctx, CALLBACK_OUTBOX_SCHEDULE, redis.Z{Score: float64(j), Member: id}).Err(); err != nil {
+						t.Fatalf("zadd err %+v", err)
+					}
+				}
+
+				if err := v.deliverDue(ctx); err != nil {
+					t.Fatalf("round %v: deliver err %+v", i, err)
+				}
+
+				requests = append(requests, round...)
+				if got := api.Requests(); fmt.Sprint(got) != fmt.Sprint(requests) {
+					t.Fatalf("round %v: expect requests %q, got %q", i, requests, got)
+				}
+			}
+
+			for _, msg := range []*OutboxMessage{begin, end} {
+				pending := queryOutboxMessage(t, ctx, CALLBACK_OUTBOX, msg.ID)
+				dead := queryOutboxMessage(t, ctx, CALLBACK_OUTBOX_DEAD, msg.ID)
+				if pending != nil || (dead != nil) != c.dead {
+					t.Errorf("expect %v dead %v, got pending %v, dead %v", msg.Type, c.dead, pending, dead)
+				}
+			}
+		})
+	}
+}
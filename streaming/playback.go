@@ -0,0 +1,267 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The query parameters of playback token.
+const (
+	playbackTokenParam   = "token"
+	playbackExpiresParam = "expires"
+	playbackViewerParam  = "viewer"
+)
+
+// PlaybackToken authorizes to play the media files under a path prefix, such as /detect/hls/livestream/,
+// until expires. The viewer is optional, to identify who is watching.
+type PlaybackToken struct {
+	// The path prefix, such as /detect/hls/livestream/ or /accident/hls/:uuid/
+	Prefix string `json:"prefix"`
+	// The expire time in unix seconds.
+	Expires int64 `json:"expires"`
+	// The id of viewer, optional.
+	Viewer string `json:"viewer,omitempty"`
+	// The HMAC of prefix, expires and viewer, in hex.
+	Token string `json:"token"`
+}
+
+// playbackEnabled whether the media requires playback token.
+func playbackEnabled() bool {
+	return envPlaybackToken() == "on"
+}
+
+// playbackSecret return the secret to sign the token, use API_SECRET if not set.
+func playbackSecret() string {
+	if secret := envPlaybackSecret(); secret != "" {
+		return secret
+	}
+	return envApiSecret()
+}
+
+// playbackTTL return the default ttl of token.
+func playbackTTL() time.Duration {
+	if n, err := strconv.Atoi(envPlaybackTokenTTL()); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Hour
+}
+
+// signPlayback return the HMAC of prefix, expires and viewer, error if no secret, because anyone is able to
+// forge the token signed by an empty secret.
+func signPlayback(prefix string, expires int64, viewer string) (string, error) {
+	secret := playbackSecret()
+	if secret == "" {
+		return "", errors.Errorf("no secret for playback token, please set PLAYBACK_SECRET or API_SECRET")
+	}
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(fmt.Sprintf("%v\n%v\n%v", prefix, expires, viewer)))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NewPlaybackToken create the token for prefix, valid for ttl.
+func NewPlaybackToken(prefix, viewer string, ttl time.Duration) (*PlaybackToken, error) {
+	expires := time.Now().Add(ttl).Unix()
+	token, err := signPlayback(prefix, expires, viewer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sign %v", prefix)
+	}
+	return &PlaybackToken{Prefix: prefix, Expires: expires, Viewer: viewer, Token: token}, nil
+}
+
+// Query return the query string to append to url.
+func (v *PlaybackToken) Query() string {
+	q := url.Values{}
+	q.Set(playbackTokenParam, v.Token)
+	q.Set(playbackExpiresParam, fmt.Sprint(v.Expires))
+	if v.Viewer != "" {
+		q.Set(playbackViewerParam, v.Viewer)
+	}
+	return q.Encode()
+}
+
+// verifyPlayback verify the token of request for the path prefix, ignore if playback token is disabled.
+func verifyPlayback(r *http.Request, prefix string) error {
+	if !playbackEnabled() {
+		return nil
+	}
+
+	q := r.URL.Query()
+	token, viewer := q.Get(playbackTokenParam), q.Get(playbackViewerParam)
+	if token == "" {
+		return errors.Errorf("no token for %v", r.URL.Path)
+	}
+
+	expires, err := strconv.ParseInt(q.Get(playbackExpiresParam), 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid expires for %v", r.URL.Path)
+	}
+	if time.Now().Unix() > expires {
+		return errors.Errorf("token expired at %v for %v", expires, r.URL.Path)
+	}
+
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return errors.Errorf("invalid prefix %v for %v", prefix, r.URL.Path)
+	}
+	expect, err := signPlayback(prefix, expires, viewer)
+	if err != nil {
+		return errors.Wrapf(err, "sign %v", prefix)
+	}
+	if !hmac.Equal([]byte(token), []byte(expect)) {
+		return errors.Errorf("invalid token for %v", r.URL.Path)
+	}
+	return nil
+}
+
+// playbackQuery return the token query of request, to propagate to the urls in playlist, empty if disabled
+// or no token.
+func playbackQuery(r *http.Request) string {
+	if !playbackEnabled() {
+		return ""
+	}
+
+	q, signed := r.URL.Query(), url.Values{}
+	for _, k := range []string{playbackTokenParam, playbackExpiresParam, playbackViewerParam} {
+		if value := q.Get(k); value != "" {
+			signed.Set(k, value)
+		}
+	}
+	return signed.Encode()
+}
+
+// playbackPlaylist append the token query of request to the urls in playlist, including the segments and
+// the URI attribute of tags, so the player is able to fetch them with the same token.
+func playbackPlaylist(r *http.Request, m3u8Body string) string {
+	query := playbackQuery(r)
+	if query == "" {
+		return m3u8Body
+	}
+
+	withQuery := func(u string) string {
+		if strings.Contains(u, "?") {
+			return fmt.Sprintf("%v&%v", u, query)
+		}
+		return fmt.Sprintf("%v?%v", u, query)
+	}
+
+	lines := strings.Split(m3u8Body, "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			lines[i] = withQuery(line)
+		} else if start := strings.Index(line, `URI="`); start >= 0 {
+			start += len(`URI="`)
+			if end := strings.Index(line[start:], `"`); end >= 0 {
+				lines[i] = line[:start] + withQuery(line[start:start+end]) + line[start+end:]
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// servePlaybackPlaylist serve the playlist file, with the token of request appended to the urls.
+func servePlaybackPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil && os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "read file %v", file)
+	}
+
+	w.Header().Set("Content-Type", mediaContentType(file))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(playbackPlaylist(r, string(b))))
+	logger.Tf(ctx, "media serve %v ok, size=%v, signed playlist", file, len(b))
+	return nil
+}
+
+// signedURL append a token of the default ttl to url of prefix, for the url sent to API server, such as
+// the snapshot of accident. Return the url directly if disabled.
+func signedURL(u, prefix string) (string, error) {
+	if !playbackEnabled() {
+		return u, nil
+	}
+
+	token, err := NewPlaybackToken(prefix, "", playbackTTL())
+	if err != nil {
+		return "", errors.Wrapf(err, "token for %v", u)
+	}
+	return fmt.Sprintf("%v?%v", u, token.Query()), nil
+}
+
+// handlePlaybackService handle the internal API to mint the playback token.
+func handlePlaybackService(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/playback/tokens"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Format is ?stream=livestream or ?uuid=:uuid, with optional &viewer=xxx&ttl=3600
+			q := r.URL.Query()
+			var prefix string
+			if stream := q.Get("stream"); stream != "" {
+				if strings.ContainsAny(stream, "/?#") {
+					return errors.Errorf("invalid stream %v", stream)
+				}
+				prefix = fmt.Sprintf("/detect/hls/%v/", stream)
+			} else if accidentUUID := q.Get("uuid"); accidentUUID != "" {
+				if _, err := uuid.Parse(accidentUUID); err != nil {
+					return errors.Wrapf(err, "invalid uuid %v", accidentUUID)
+				}
+				prefix = fmt.Sprintf("/accident/hls/%v/", accidentUUID)
+			} else {
+				return errors.Errorf("no stream or uuid")
+			}
+
+			ttl := playbackTTL()
+			if value := q.Get("ttl"); value != "" {
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					return errors.Errorf("invalid ttl %v", value)
+				} else {
+					ttl = time.Duration(n) * time.Second
+				}
+			}
+
+			token, err := NewPlaybackToken(prefix, q.Get(playbackViewerParam), ttl)
+			if err != nil {
+				return errors.Wrapf(err, "mint token")
+			}
+			ohttp.WriteData(ctx, w, r, &struct {
+				*PlaybackToken
+				Query string `json:"query"`
+			}{
+				PlaybackToken: token, Query: token.Query(),
+			})
+			logger.Tf(ctx, "playback: mint token prefix=%v, viewer=%v, expires=%v", prefix, token.Viewer, token.Expires)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPlaybackToken(t *testing.T) {
+	prefix := "/detect/hls/livestream/"
+	for _, c := range []struct {
+		name string
+		// The env of playback token.
+		enabled bool
+		secret  string
+		// The token to mint, and the secret to verify it if not empty.
+		viewer       string
+		ttl          time.Duration
+		verifySecret string
+		// The request, and the changes of query.
+		path  string
+		query func(q url.Values)
+		// Whether failed to mint or verify.
+		signErr, verifyErr bool
+	}{
+		{
+			name: "valid", enabled: true, secret: "secret", ttl: time.Hour, path: prefix + "index.m3u8",
+		},
+		{
+			name: "valid with viewer", enabled: true, secret: "secret", viewer: "alice", ttl: time.Hour,
+			path: prefix + "1.ts",
+		},
+		{
+			name: "disabled without token", secret: "secret", ttl: time.Hour, path: prefix + "index.m3u8",
+			query: func(q url.Values) { q.Del(playbackTokenParam) },
+		},
+		{
+			name: "expired", enabled: true, secret: "secret", ttl: -time.Second, path: prefix + "index.m3u8",
+			verifyErr: true,
+		},
+		{
+			name: "extend expires", enabled: true, secret: "secret", ttl: time.Hour, path: prefix + "index.m3u8",
+			query: func(q url.Values) {
+				q.Set(playbackExpiresParam, fmt.Sprint(time.Now().Add(2*time.Hour).Unix()))
+			},
+			verifyErr: true,
+		},
+		{
+			name: "other prefix", enabled: true, secret: "secret", ttl: time.Hour,
+			path: "/detect/hls/other/index.m3u8", verifyErr: true,
+		},
+		{
+			name: "other viewer", enabled: true, secret: "secret", viewer: "alice", ttl: time.Hour,
+			path: prefix + "index.m3u8", query: func(q url.Values) { q.Set(playbackViewerParam, "bob") },
+			verifyErr: true,
+		},
+		{
+			name: "tampered token", enabled: true, secret: "secret", ttl: time.Hour, path: prefix + "index.m3u8",
+			query:     func(q url.Values) { q.Set(playbackTokenParam, q.Get(playbackTokenParam)[1:]+"0") },
+			verifyErr: true,
+		},
+		{
+			name: "no token", enabled: true, secret: "secret", ttl: time.Hour, path: prefix + "index.m3u8",
+			query: func(q url.Values) { q.Del(playbackTokenParam) }, verifyErr: true,
+		},
+		{
+			name: "other secret", enabled: true, secret: "secret", ttl: time.Hour, verifySecret: "other",
+			path: prefix + "index.m3u8", verifyErr: true,
+		},
+		{
+			name: "no secret", enabled: true, ttl: time.Hour, signErr: true,
+		},
+		{
+			name: "verify without secret", enabled: true, secret: "secret", ttl: time.Hour, verifySecret: "-",
+			path: prefix + "index.m3u8", verifyErr: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("PLAYBACK_TOKEN", "off")
+			if c.enabled {
+				t.Setenv("PLAYBACK_TOKEN", "on")
+			}
+			t.Setenv("API_SECRET", "")
+			t.Setenv("PLAYBACK_SECRET", c.secret)
+
+			token, err := NewPlaybackToken(prefix, c.viewer, c.ttl)
+			if c.signErr {
+				if err == nil {
+					t.Fatalf("expect error, got %+v", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mint err %+v", err)
+			}
+
+			q, err := url.ParseQuery(token.Query())
+			if err != nil {
+				t.Fatalf("parse %v err %+v", token.Query(), err)
+			}
+			if c.query != nil {
+				c.query(q)
+			}
+
+			if c.verifySecret == "-" {
+				t.Setenv("PLAYBACK_SECRET", "")
+			} else if c.verifySecret != "" {
+				t.Setenv("PLAYBACK_SECRET", c.verifySecret)
+			}
+
+			r := httptest.NewRequest("GET", fmt.Sprintf("%v?%v", c.path, q.Encode()), nil)
+			err = verifyPlayback(r, prefix)
+			if c.verifyErr && err == nil {
+				t.Fatalf("expect error, query %v", q.Encode())
+			} else if !c.verifyErr && err != nil {
+				t.Fatalf("verify err %+v", err)
+			}
+		})
+	}
+}
+
+func TestPlaybackSecret(t *testing.T) {
+	for _, c := range []struct {
+		name                           string
+		playbackSecret, apiSecret, use string
+	}{
+		{name: "playback secret", playbackSecret: "playback", apiSecret: "api", use: "playback"},
+		{name: "fallback to api secret", apiSecret: "api", use: "api"},
+		{name: "no secret"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("PLAYBACK_SECRET", c.playbackSecret)
+			t.Setenv("API_SECRET", c.apiSecret)
+			if secret := playbackSecret(); secret != c.use {
+				t.Errorf("expect %v, got %v", c.use, secret)
+			}
+		})
+	}
+}
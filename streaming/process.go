@@ -5,7 +5,6 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,9 +12,11 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// From ossrs.
@@ -37,9 +38,6 @@ type ProcessWorker struct {
 	// The global process task, only support one process task.
 	task *ProcessTask
 
-	// Use async goroutine to process on_hls messages.
-	msgs chan *SrsOnHlsMessage
-
 	// Got message from SRS, a new TS segment file is generated.
 	tsfiles chan *SrsOnHlsObject
 
@@ -47,12 +45,13 @@ type ProcessWorker struct {
 	detectWorker *DetectWorker
 	UUID string `json:"uuid"`
 	Stream string `json:"stream"`
+
+	// The last time in unix nanoseconds that got ts file, to check whether stream is dead.
+	lastUpdate atomic.Int64
 }
 
 func NewProcessWorker(d *DetectWorker) *ProcessWorker {
 	v := &ProcessWorker{
-		// Message on_hls.
-		msgs: make(chan *SrsOnHlsMessage, 1024),
 		// TS files.
 		tsfiles: make(chan *SrsOnHlsObject, 1024),
 		detectWorker: d,
@@ -63,13 +62,31 @@ func NewProcessWorker(d *DetectWorker) *ProcessWorker {
 }
 
 func (v *ProcessWorker) Initialize(d *DetectWorker) error {
-	v.msgs = make(chan *SrsOnHlsMessage, 1024)
 		// TS files.
 	v.tsfiles = make(chan *SrsOnHlsObject, 1024)
 	v.detectWorker = d
 	v.task = NewProcessTask()
+	v.task.Stream = v.Stream
 	v.task.processWorker = v
+	v.lastUpdate.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+// updated return the last time that got ts file.
+func (v *ProcessWorker) updated() time.Time {
+	return time.Unix(0, v.lastUpdate.Load())
+}
+
+// Restore the task which is loaded from redis, should be called after Initialize and before Start.
+func (v *ProcessWorker) Restore(ctx context.Context, task *ProcessTask) error {
+	task.Stream = v.Stream
+	task.processWorker = v
+	if err := task.restore(ctx); err != nil {
+		return errors.Wrapf(err, "restore task %v", task.String())
+	}
 
+	v.task = task
 	return nil
 }
 func StartWorker(worker *ProcessWorker, ctx context.Context) (*ProcessWorker, error) {
@@ -80,7 +97,10 @@ func StartWorker(worker *ProcessWorker, ctx context.Context) (*ProcessWorker, er
 			return worker, errors.Wrapf(err, "create dir %v", dir)
 		}
 	}
-	go worker.Start(ctx) // 워커 실행.
+	// Start in place, so the worker is able to be closed right after started.
+	if err := worker.Start(ctx); err != nil {
+		return worker, errors.Wrapf(err, "start worker %v", worker.Stream)
+	}
 	logger.Tf(ctx, "Worker %s started", worker.Stream)
 	return worker, nil
 }
@@ -95,9 +115,11 @@ func (v *ProcessWorker)	hlsM3u8Handler(ctx context.Context, w http.ResponseWrite
 
 	var metaData []string
 	var tsFiles []*TsFile
+	var skipped []string
 	segments := v.task.finishSegments()
 	for _, segment := range segments {
 		tsFiles = append(tsFiles, segment.TsFile)
+		skipped = append(skipped, segment.Skipped)
 
 		if b, err := json.Marshal(segment.BoundingBox); err != nil {
 			return errors.Wrapf(err, "marshal %v", segment.BoundingBox)
@@ -106,102 +128,180 @@ func (v *ProcessWorker)	hlsM3u8Handler(ctx context.Context, w http.ResponseWrite
 		}
 	}
 	contentType, m3u8Body, duration, err := buildLiveM3u8ForLocal(
-		ctx, tsFiles, false, fmt.Sprintf("/detect/hls/%v/", v.Stream), metaData,
+		ctx, tsFiles, false, fmt.Sprintf("/detect/hls/%v/", v.Stream), metaData, skipped,
 	)
 	if err != nil {
 		return errors.Wrapf(err, "build process m3u8 of %v", tsFiles)
 	}
 
 	w.Header().Set("Content-Type", contentType)
-	w.Write([]byte(m3u8Body))
+	w.Write([]byte(playbackPlaylist(r, m3u8Body)))
 	logger.Tf(ctx, "process generate m3u8 ok, stream=%v, duration=%v", v.Stream, duration)
 	return nil
 }
 
 func (v *ProcessWorker) hlsTsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	// Format is :uuid.ts
-	filename := r.URL.Path[len("/detect/hls/")+len(v.Stream)+1:]
-	fileBase := path.Base(filename)
-	uuid := fileBase[:len(fileBase)-len(path.Ext(fileBase))]
-	if len(uuid) == 0 {
-		return errors.Errorf("invalid uuid %v from %v of %v", uuid, fileBase, r.URL.Path)
+	// Format is /detect/hls/:stream/:tsid.ts
+	fileBase := path.Base(r.URL.Path)
+	tsid := fileBase[:len(fileBase)-len(path.Ext(fileBase))]
+	if len(tsid) == 0 {
+		return errors.Errorf("invalid tsid %v from %v of %v", tsid, fileBase, r.URL.Path)
 	}
 
-	tsFilePath := path.Join("detect", fmt.Sprintf("%v.ts", uuid))
-	if _, err := os.Stat(tsFilePath); err != nil {
-		return errors.Wrapf(err, "no ts file %v", tsFilePath)
+	// Note that we only serve the file of segment, never join the path from user.
+	var segmentFile *TsFile
+	for _, segment := range v.task.finishSegments() {
+		if segment.TsFile.TsID == tsid {
+			segmentFile = segment.TsFile
+			break
+		}
+	}
+	if segmentFile == nil {
+		return errors.Errorf("no ts %v of %v", tsid, v.Stream)
 	}
 
-	if tsFile, err := os.Open(tsFilePath); err != nil {
-		return errors.Wrapf(err, "open file %v", tsFilePath)
+	if tsFile, err := os.Open(segmentFile.File); err != nil {
+		return errors.Wrapf(err, "open file %v", segmentFile.File)
 	} else {
 		defer tsFile.Close()
-		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Content-Type", "video/mp2t")
 		io.Copy(w, tsFile)
 	}
 
-	logger.Tf(ctx, "process server ts file ok, uuid=%v, ts=%v", uuid, tsFilePath)
+	logger.Tf(ctx, "process server ts file ok, tsid=%v, ts=%v", tsid, segmentFile.File)
 	return nil
 }
 
-func (v *ProcessWorker) OnHlsTsMessage(ctx context.Context, msg *SrsOnHlsMessage) error {
-	select {
-	case <-ctx.Done():
-	case v.msgs <- msg:
+func (v *ProcessWorker) hlsMasterM3u8Handler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var tsFiles []*TsFile
+	for _, segment := range v.task.finishSegments() {
+		tsFiles = append(tsFiles, segment.TsFile)
 	}
 
+	contentType, m3u8Body := buildMasterM3u8(tsFiles, "index.m3u8", "metadata.m3u8")
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(playbackPlaylist(r, m3u8Body)))
+	logger.Tf(ctx, "process generate master m3u8 ok, stream=%v", v.Stream)
 	return nil
 }
-func (v *ProcessWorker) OnHlsTsObject(ctx context.Context, msg *SrsOnHlsObject) error {
-	select {
-	case <-ctx.Done():
-	case v.tsfiles <- msg:
+
+func (v *ProcessWorker) hlsMetadataM3u8Handler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var tsFiles []*TsFile
+	for _, segment := range v.task.finishSegments() {
+		tsFiles = append(tsFiles, segment.TsFile)
+	}
+
+	contentType, m3u8Body, err := buildWebVTTM3u8(tsFiles, fmt.Sprintf("/detect/hls/%v/metadata/", v.Stream))
+	if err != nil {
+		return errors.Wrapf(err, "build metadata m3u8 of %v", tsFiles)
 	}
 
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(playbackPlaylist(r, m3u8Body)))
+	logger.Tf(ctx, "process generate metadata m3u8 ok, stream=%v, segments=%v", v.Stream, len(tsFiles))
 	return nil
 }
 
-// task에 있는 hlstsmessage 처리
-// ts파일을 임시 파일로 복사함.
-// v.tsfiles에 notify
-func (v *ProcessWorker) OnHlsTsMessageImpl(ctx context.Context, msg *SrsOnHlsMessage) error {
-	// Ignore if not natch the task config.
-	if !v.task.match(msg) {
-		return nil
+func (v *ProcessWorker) hlsWebVTTHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	// Format is /detect/hls/:stream/metadata/:tsid.vtt
+	fileBase := path.Base(r.URL.Path)
+	tsid := fileBase[:len(fileBase)-len(path.Ext(fileBase))]
+	if len(tsid) == 0 {
+		return errors.Errorf("invalid tsid %v from %v of %v", tsid, fileBase, r.URL.Path)
 	}
 
-	// Copy the ts file to temporary cache dir.
-	tsid := fmt.Sprintf("%v-org-%v", msg.SeqNo, uuid.NewString())
-	tsfile := path.Join("process", fmt.Sprintf("%v.ts", tsid))
+	var segment *ProcessSegment
+	for _, s := range v.task.finishSegments() {
+		if s.TsFile.TsID == tsid {
+			segment = s
+			break
+		}
+	}
+	if segment == nil {
+		return errors.Errorf("no segment %v of %v", tsid, v.Stream)
+	}
 
-	if err := exec.CommandContext(ctx, "cp", "-f", msg.File, tsfile).Run(); err != nil {
-		return errors.Wrapf(err, "copy file %v to %v", msg.File, tsfile)
+	contentType, body, err := buildWebVTT(segment)
+	if err != nil {
+		return errors.Wrapf(err, "build webvtt of %v", segment.String())
 	}
 
-	// Get the file size.
-	stats, err := os.Stat(msg.File)
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(body))
+	logger.Tf(ctx, "process generate webvtt ok, stream=%v, tsid=%v", v.Stream, tsid)
+	return nil
+}
+
+func (v *ProcessWorker) hlsAnnotatedM3u8Handler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var metaData []string
+	var tsFiles []*TsFile
+	for _, segment := range v.task.finishSegments() {
+		// Ignore the segments not annotated yet, or failed.
+		if segment.AnnotatedFile == nil {
+			continue
+		}
+		tsFiles = append(tsFiles, segment.AnnotatedFile)
+
+		if b, err := json.Marshal(segment.BoundingBox); err != nil {
+			return errors.Wrapf(err, "marshal %v", segment.BoundingBox)
+		} else {
+			metaData = append(metaData, string(b))
+		}
+	}
+	contentType, m3u8Body, duration, err := buildLiveM3u8ForLocal(
+		ctx, tsFiles, false, fmt.Sprintf("/detect/hls/%v/annotated/", v.Stream), metaData, nil,
+	)
 	if err != nil {
-		return errors.Wrapf(err, "stat file %v", msg.File)
+		return errors.Wrapf(err, "build annotated m3u8 of %v", tsFiles)
 	}
 
-	// Create a local ts file object.
-	tsFile := &TsFile{
-		TsID:     tsid,
-		URL:      msg.URL,
-		SeqNo:    msg.SeqNo,
-		Duration: msg.Duration,
-		Size:     uint64(stats.Size()),
-		File:     tsfile,
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(playbackPlaylist(r, m3u8Body)))
+	logger.Tf(ctx, "process generate annotated m3u8 ok, stream=%v, duration=%v", v.Stream, duration)
+	return nil
+}
+
+func (v *ProcessWorker) hlsAnnotatedTsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	// Format is /detect/hls/:stream/annotated/:tsid.ts
+	fileBase := path.Base(r.URL.Path)
+	tsid := fileBase[:len(fileBase)-len(path.Ext(fileBase))]
+	if len(tsid) == 0 {
+		return errors.Errorf("invalid tsid %v from %v of %v", tsid, fileBase, r.URL.Path)
 	}
 
-	// Notify worker asynchronously.
-	// TODO: FIXME: Should cleanup the temporary file when restart.
-	go func() {
-		select {
-		case <-ctx.Done():
-		case v.tsfiles <- &SrsOnHlsObject{Msg: msg, TsFile: tsFile}:
+	// Note that we only serve the file of segment, never join the path from user.
+	var annotatedFile *TsFile
+	for _, segment := range v.task.finishSegments() {
+		if segment.AnnotatedFile != nil && segment.AnnotatedFile.TsID == tsid {
+			annotatedFile = segment.AnnotatedFile
+			break
 		}
-	}()
+	}
+	if annotatedFile == nil {
+		return errors.Errorf("no annotated ts %v of %v", tsid, v.Stream)
+	}
+
+	if tsFile, err := os.Open(annotatedFile.File); err != nil {
+		return errors.Wrapf(err, "open file %v", annotatedFile.File)
+	} else {
+		defer tsFile.Close()
+		w.Header().Set("Content-Type", "video/mp2t")
+		io.Copy(w, tsFile)
+	}
+
+	logger.Tf(ctx, "process server annotated ts file ok, tsid=%v, ts=%v", tsid, annotatedFile.File)
+	return nil
+}
+
+func (v *ProcessWorker) OnHlsTsObject(ctx context.Context, msg *SrsOnHlsObject) error {
+	v.lastUpdate.Store(time.Now().UnixNano())
+
+	select {
+	case <-ctx.Done():
+	case v.tsfiles <- msg:
+	}
+
 	return nil
 }
 
@@ -265,22 +365,6 @@ func (v *ProcessWorker) Start(ctx context.Context) error {
 		}
 	}()
 
-	// ts file 임시 파일로 복사
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		for ctx.Err() == nil {
-			select {
-			case <-ctx.Done():
-			case msg := <-v.msgs:
-				if err := v.OnHlsTsMessageImpl(ctx, msg); err != nil {
-					logger.Wf(ctx, "process: handle on hls message %v err %+v", msg.String(), err)
-				}
-			}
-		}
-	}()
-
 	// 복사한 이후 enqueue
 	wg.Add(1)
 	go func() {
@@ -362,6 +446,30 @@ func (v *ProcessWorker) Start(ctx context.Context) error {
 		}
 	}()
 
+	// 탐지 결과를 영상에 그려서 annotated HLS 생성
+	if envProcessAnnotate() == "on" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			task := v.task
+			for ctx.Err() == nil {
+				var duration time.Duration
+				if err := task.DriveAnnotateQueue(ctx); err != nil {
+					logger.Wf(ctx, "process: task %v drive annotate queue err %+v", task.String(), err)
+					duration = 10 * time.Second
+				} else {
+					duration = 200 * time.Millisecond
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(duration):
+				}
+			}
+		}()
+	}
+
 	return nil
 }
 
@@ -378,13 +486,17 @@ type ProcessDetectResult struct {
 	Score float64 `json:"score,omitempty"`
 	Category int `json:"category_id,omitempty"`
 	ImageId string `json:"image_id,omitempty"`
+	// The offset in seconds of frame from the start of segment.
+	Offset float64 `json:"offset,omitempty"`
+	// The number of frames detected this category in segment.
+	Frames int `json:"frames,omitempty"`
 	// The segments of the text.
 	Segments []ProcessDetectSegment `json:"segments,omitempty"`
 }
 
 func (v ProcessDetectResult) String() string {
-	return fmt.Sprintf("label=%v,x=%v,y=%v,width=%v,height=%v,score=%v,segments=%v",
-		v.Category, v.BBox, v.Score, len(v.Segments), 
+	return fmt.Sprintf("label=%v,bbox=%v,score=%v,segments=%v",
+		v.Category, v.BBox, v.Score, len(v.Segments),
 	)
 }
 type ProcessSegment struct {
@@ -392,10 +504,17 @@ type ProcessSegment struct {
 	Msg *SrsOnHlsMessage `json:"msg,omitempty"`
 	// The original source TS file.
 	TsFile *TsFile `json:"tsfile,omitempty"`
-	// The extracted image file.
+	// The extracted image file, the frame with max score, or the first frame if not detected.
 	ImageFile *TsFile `json:"image,omitempty"`
+	// The frames sampled from the TS file, and the detections of each frame.
+	Frames []*ProcessFrame `json:"frames,omitempty"`
 
+	// The detections merged from all frames.
 	BoundingBox []ProcessDetectResult `json:"bounding,omitempty"`
+	// The annotated TS file, which draws the detections on video, for annotated HLS.
+	AnnotatedFile *TsFile `json:"annotated,omitempty"`
+	// Whether annotated, to avoid annotating again if failed.
+	Annotated bool `json:"ant,omitempty"`
 	// The starttime for live stream to adjust the srt.
 	StreamStarttime time.Duration `json:"sst,omitempty"`
 
@@ -405,6 +524,13 @@ type ProcessSegment struct {
 	CostProcess time.Duration `json:"prc,omitempty"`
 	// The cost to callback the process result.
 	CostCallback time.Duration `json:"olc,omitempty"`
+	// The cost to annotate the TS file.
+	CostAnnotate time.Duration `json:"atc,omitempty"`
+
+	// The time when segment arrived, to check the lag.
+	Arrived time.Time `json:"arv,omitempty"`
+	// The reason if segment is skipped by load shedding, not analysed.
+	Skipped string `json:"skip,omitempty"`
 }
 
 func (v ProcessSegment) String() string {
@@ -426,20 +552,32 @@ func (v ProcessSegment) String() string {
 	return sb.String()
 }
 
-func (v *ProcessSegment) Dispose() error {
-	// Remove the original ts file.
+func (v *ProcessSegment) Dispose(ctx context.Context) error {
+	// Release the original ts file, which is removed if no accident holds it.
 	if v.TsFile != nil {
-		if _, err := os.Stat(v.TsFile.File); err == nil {
-			os.Remove(v.TsFile.File)
+		if err := segmentStore.Release(ctx, v.TsFile.File); err != nil {
+			logger.Wf(ctx, "ignore release %v err %+v", v.TsFile.File, err)
 		}
 	}
 
-	// Remove the pure audio mp4 file.
+	// Remove the image files.
 	if v.ImageFile != nil {
 		if _, err := os.Stat(v.ImageFile.File); err == nil {
 			os.Remove(v.ImageFile.File)
 		}
 	}
+	for _, frame := range v.Frames {
+		if _, err := os.Stat(frame.ImageFile.File); err == nil {
+			os.Remove(frame.ImageFile.File)
+		}
+	}
+
+	// Remove the annotated ts file.
+	if v.AnnotatedFile != nil {
+		if _, err := os.Stat(v.AnnotatedFile.File); err == nil {
+			os.Remove(v.AnnotatedFile.File)
+		}
+	}
 
 	return nil
 }
@@ -509,7 +647,7 @@ func (v *ProcessQueue) reset(ctx context.Context) error {
 	}()
 
 	for _, segment := range segments {
-		segment.Dispose()
+		segment.Dispose(ctx)
 	}
 
 	return nil
@@ -521,6 +659,8 @@ type ProcessTask struct {
 
 	// The input url.
 	Input string `json:"input,omitempty"`
+	// The stream name of task, to restore the task when restart.
+	Stream string `json:"stream,omitempty"`
 	// The input stream object, select the active stream.
 	inputStream *SrsStream
 
@@ -548,9 +688,23 @@ type ProcessTask struct {
 	signalPersistence chan bool
 	// The signal to change the active stream for task.
 	signalNewStream chan *SrsStream
+	// Whether the next segment is the first one of task, which is discontinuous with the previous publish.
+	discontinuity bool
 
 	// The process worker.
 	processWorker *ProcessWorker
+	// The sampler to extract frames from segment.
+	sampler *FrameSampler
+	// The load shedder to skip segments under backlog.
+	shedder *LoadShedder
+	// Whether the live queue waited for the detect queue which is full, since the last segment decided.
+	backlogged bool
+
+	// The cached detector config of stream, and the time when it's loaded from redis.
+	detectorConfig   *DetectorConfig
+	detectorLoadedAt time.Time
+	// To protect the detector config.
+	detectorLock sync.Mutex
 
 	// The context for current task.
 	cancel context.CancelFunc
@@ -575,12 +729,18 @@ func NewProcessTask() *ProcessTask {
 		signalPersistence: make(chan bool, 1),
 		// Create new stream signal.
 		signalNewStream: make(chan *SrsStream, 1),
+		// The sampler from env.
+		sampler: NewFrameSampler(),
+		// The load shedder of stream.
+		shedder: NewLoadShedder(),
+		// The first segment of task is discontinuous.
+		discontinuity: true,
 	}
 }
 
 func (v *ProcessTask) String() string {
-	return fmt.Sprintf("uuid=%v, live=%v, asr=%v, fix=%v, pat=%v, overlay=%v",
-		v.UUID, v.LiveQueue.String(), v.DetectQueue.String(), v.FixQueue.String(), v.PreviousDetectText,
+	return fmt.Sprintf("uuid=%v, stream=%v, live=%v, asr=%v, fix=%v, pat=%v, overlay=%v",
+		v.UUID, v.Stream, v.LiveQueue.String(), v.DetectQueue.String(), v.FixQueue.String(), v.PreviousDetectText,
 		v.FinishQueue.String(),
 	)
 }
@@ -645,9 +805,13 @@ func (v *ProcessTask) OnTsSegment(ctx context.Context, msg *SrsOnHlsObject) erro
 		v.lock.Lock()
 		v.lock.Unlock()
 
+		if v.discontinuity {
+			msg.TsFile.Discontinuity, v.discontinuity = true, false
+		}
 		v.LiveQueue.enqueue(&ProcessSegment{
-			Msg:    msg.Msg,
-			TsFile: msg.TsFile,
+			Msg:     msg.Msg,
+			TsFile:  msg.TsFile,
+			Arrived: time.Now(),
 		})
 	}()
 
@@ -656,6 +820,29 @@ func (v *ProcessTask) OnTsSegment(ctx context.Context, msg *SrsOnHlsObject) erro
 	return nil
 }
 
+// loadDetectorConfig return the cached detector config of stream, which is reloaded from redis after the
+// interval, because it might be changed by user. Use the cached config if failed to reload.
+func (v *ProcessTask) loadDetectorConfig(ctx context.Context) (*DetectorConfig, error) {
+	v.detectorLock.Lock()
+	defer v.detectorLock.Unlock()
+
+	if v.detectorConfig != nil && time.Since(v.detectorLoadedAt) < detectorConfigReloadInterval {
+		return v.detectorConfig, nil
+	}
+
+	c, err := loadDetectorConfig(ctx, v.processWorker.Stream)
+	if err != nil {
+		if v.detectorConfig == nil {
+			return nil, errors.Wrapf(err, "load detector of %v", v.processWorker.Stream)
+		}
+		logger.Wf(ctx, "process: ignore reload detector of %v err %+v", v.processWorker.Stream, err)
+		c = v.detectorConfig
+	}
+
+	v.detectorConfig, v.detectorLoadedAt = c, time.Now()
+	return c, nil
+}
+
 func (v *ProcessTask) DriveLiveQueue(ctx context.Context) error {
 	// Ignore if not enough segments.
 	if v.LiveQueue.count() <= 0 {
@@ -673,45 +860,69 @@ func (v *ProcessTask) DriveLiveQueue(ctx context.Context) error {
 			v.LiveQueue.dequeue(segment)
 		}()
 
-		segment.Dispose()
+		segment.Dispose(ctx)
 		logger.Tf(ctx, "process: remove not exist ts segment %v", segment.String())
 		return nil
 	}
 
-	// Wait if ASR queue is full.
+	// Wait if detect queue is full, and never decide the segment until there is room for it. Note that the
+	// lag grows when waiting, so the shedder raises the level.
 	if v.DetectQueue.count() >= maxFinishSegments+1 {
+		v.backlogged = true
 		return nil
 	}
 
-	// Transcode to image file, such as jpg.
-	imageFile := &TsFile{
-		TsID:     fmt.Sprintf("%v/%v-image-%v", v.processWorker.Stream, segment.TsFile.SeqNo, uuid.NewString()),
-		URL:      segment.TsFile.URL,
-		SeqNo:    segment.TsFile.SeqNo,
-		Duration: segment.TsFile.Duration,
+	// Decide whether to analyse the segment by the latency budget, only once for each segment. Note that
+	// the restored segment has no arrived time, so it's always analysed.
+	detectorConfig, err := v.loadDetectorConfig(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load detector of %v", v.processWorker.Stream)
+	}
+
+	var lag time.Duration
+	if !segment.Arrived.IsZero() {
+		lag = time.Since(segment.Arrived)
+	}
+	backlog := v.backlogged
+	v.backlogged = false
+	skip, framesN := v.shedder.Decide(lag, loadShedBudget(detectorConfig), backlog, v.sampler.Frames)
+
+	// Pass the skipped segment through detect queue without analysing, to keep it in order.
+	if skip != "" {
+		func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			v.LiveQueue.dequeue(segment)
+			segment.Skipped = skip
+			v.DetectQueue.enqueue(segment)
+		}()
+		metricSegmentsSkipped.Inc(metricLabels("stream", v.processWorker.Stream, "reason", skip))
+		logger.Tf(ctx, "process: skip %v segment %v, lag=%v, shedder is %v", skip, segment.TsFile.File, lag, v.shedder.String())
+		return nil
 	}
-	imageFile.File = path.Join("process", fmt.Sprintf("%v.jpg", imageFile.TsID))
 
-	// TODO: FIXME: We should generate a set of images and use the best one.
+	// Transcode to image files, such as jpg.
+	prefix := fmt.Sprintf("%v/%v-image-%v", v.processWorker.Stream, segment.TsFile.SeqNo, uuid.NewString())
+
 	var wg sync.WaitGroup
 	errCh := make(chan error, 2)
 
 	// 작업 1: 640x640 JPEG 이미지 생성
+	var frames []*ProcessFrame
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		args := []string{
-			"-i", segment.TsFile.File,
-			"-frames:v", "1", "-q:v", "10",
-			"-vf", "scale=640:640",
-			"-y", imageFile.File,
-		}
-		if err := exec.CommandContext(ctx, "ffmpeg", args...).Run(); err != nil {
-			errCh <- errors.Wrapf(err, "transcode %v", args)
+		sampler := v.sampler.WithFrames(framesN)
+		if err := scheduler.Run(ctx, SchedulerClassFFmpeg, v.processWorker.Stream, func() (err error) {
+			frames, err = sampler.Extract(ctx, segment.TsFile, prefix)
+			return
+		}); err != nil {
+			errCh <- errors.Wrapf(err, "extract frames by %v", sampler.String())
 		}
 	}()
 
-	// 작업 1: 640x640 JPEG 이미지 생성
+	// 작업 2: 썸네일 이미지 생성
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -724,7 +935,9 @@ func (v *ProcessTask) DriveLiveQueue(ctx context.Context) error {
 			"-s", "426x240",
 			"-y", thumbnailPath,
 		}
-		if err := exec.CommandContext(ctx, "ffmpeg", args...).Run(); err != nil {
+		if err := scheduler.Run(ctx, SchedulerClassFFmpeg, v.processWorker.Stream, func() error {
+			return exec.CommandContext(ctx, "ffmpeg", args...).Run()
+		}); err != nil {
 			errCh <- errors.Wrapf(err, "extract thumbnail %v", args)
 		}
 	}()
@@ -734,16 +947,12 @@ func (v *ProcessTask) DriveLiveQueue(ctx context.Context) error {
 
 	// 에러 처리
 	for err := range errCh {
+		for _, frame := range frames {
+			os.Remove(frame.ImageFile.File)
+		}
 		return err
 	}
-
-	// Update the size of image file.
-	stats, err := os.Stat(imageFile.File)
-	if err != nil {
-		// TODO: FIXME: Cleanup the failed file.
-		return errors.Wrapf(err, "stat file %v", imageFile.File)
-	}
-	imageFile.Size = uint64(stats.Size())
+	imageFile := frames[0].ImageFile
 
 	// Dequeue the segment from live queue and attach to asr queue.
 	func() {
@@ -752,11 +961,13 @@ func (v *ProcessTask) DriveLiveQueue(ctx context.Context) error {
 
 		v.LiveQueue.dequeue(segment)
 		segment.ImageFile = imageFile
+		segment.Frames = frames
 		segment.CostExtractImage = time.Since(starttime)
 		v.DetectQueue.enqueue(segment)
 	}()
-	logger.Tf(ctx, "process: extract image %v to %v, size=%v, cost=%v",
-		segment.TsFile.File, imageFile.File, imageFile.Size, segment.CostExtractImage)
+	metricExtractSeconds.Observe(metricLabels("stream", v.processWorker.Stream), segment.CostExtractImage)
+	logger.Tf(ctx, "process: extract image %v to %v, size=%v, frames=%v, cost=%v",
+		segment.TsFile.File, imageFile.File, imageFile.Size, len(frames), segment.CostExtractImage)
 
 	// Notify the main loop to persistent current task.
 	v.notifyPersistence(ctx)
@@ -772,6 +983,27 @@ func (v *ProcessTask) DriveDetectQueue(ctx context.Context) error {
 	segment := v.DetectQueue.first()
 	starttime := time.Now()
 
+	// The skipped segment is not analysed, but still fed to accident, to keep the footage continuous.
+	if segment.Skipped != "" {
+		if err := accidentWorker.OnDetectSegment(ctx, segment, &SrsStream{
+			Vhost:  segment.Msg.Vhost,
+			App:    segment.Msg.App,
+			Stream: segment.Msg.Stream,
+		}); err != nil {
+			logger.Wf(ctx, "ignore accident of %v err %+v", segment.String(), err)
+		}
+
+		func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			v.DetectQueue.dequeue(segment)
+			v.FinishQueue.enqueue(segment)
+		}()
+
+		v.notifyPersistence(ctx)
+		return nil
+	}
+
 	// Remove segment if file not exists.
 	if _, err := os.Stat(segment.ImageFile.File); err != nil && os.IsNotExist(err) {
 		func() {
@@ -779,53 +1011,68 @@ func (v *ProcessTask) DriveDetectQueue(ctx context.Context) error {
 			defer v.lock.Unlock()
 			v.DetectQueue.dequeue(segment)
 		}()
-		segment.Dispose()
+		segment.Dispose(ctx)
 		logger.Tf(ctx, "process: remove not exist audio segment %v", segment.String())
 		return nil
 	}
 
-	var imageData string
-	if data, err := os.ReadFile(segment.ImageFile.File); err != nil {
-		return errors.Wrapf(err, "read image from %v", segment.ImageFile.File)
+	// Discover the starttime of the segment, by the demuxer, or ffprobe if failed to demux. Note that it must be
+	// done before feeding the accident trackers, because the segment is retried if failed.
+	if segment.TsFile.Codec != "" {
+		segment.StreamStarttime = time.Duration(segment.TsFile.Start * float64(time.Second))
+	} else if starttime, err := probeStarttime(ctx, v.processWorker.Stream, segment.TsFile); err != nil {
+		return errors.Wrapf(err, "probe %v", segment.TsFile.File)
 	} else {
-		imageData = base64.StdEncoding.EncodeToString(data)
+		segment.StreamStarttime = starttime
 	}
-	
-	err := postImageBase64(ctx, "http://121.78.254.27:10080/ai", imageData, &segment.BoundingBox);
-	
+
+	// Load the detector for stream, which might be changed by user.
+	detectorConfig, err := v.loadDetectorConfig(ctx)
 	if err != nil {
-		logger.Wf(err, "post image %v (%v)", segment.ImageFile.File, len(imageData))
-	} else if len(segment.BoundingBox) > 0 {
-		for _, box := range segment.BoundingBox {
-			if _, exists := categories[box.Category]; exists {
-				accidentWorker.OnAccidentAdded(ctx, &box, segment.TsFile, &SrsStream{
-					Vhost: segment.Msg.Vhost,
-					App: segment.Msg.App,
-					Stream: segment.Msg.Stream,
-				})
-				logger.Tf(ctx, "boundingbox category %v %v", box.Category, v.inputStream)
-			}
-		}
+		return errors.Wrapf(err, "load detector of %v", v.processWorker.Stream)
 	}
-
-	// Discover the starttime of the segment.
-	stdout, err := exec.CommandContext(ctx, "ffprobe",
-		"-show_error", "-show_private_data", "-v", "quiet", "-find_stream_info", "-print_format", "json",
-		"-show_format", "-show_streams", segment.TsFile.File,
-	).Output()
+	detector, err := NewDetector(detectorConfig)
 	if err != nil {
-		return errors.Wrapf(err, "probe %v", segment.TsFile.File)
+		return errors.Wrapf(err, "create detector %v", detectorConfig.String())
 	}
 
-	format := struct {
-		Format FFprobeFormat `json:"format"`
-	}{}
-	if err = json.Unmarshal([]byte(stdout), &format); err != nil {
-		return errors.Wrapf(err, "parse format %v", stdout)
+	// The segment restored from previous version has no frames.
+	if len(segment.Frames) == 0 {
+		segment.Frames = []*ProcessFrame{{ImageFile: segment.ImageFile}}
 	}
 
-	if stv, err := strconv.ParseFloat(format.Format.Starttime, 10); err == nil {
-		segment.StreamStarttime = time.Duration(stv * float64(time.Second))
+	// Detect all frames, and merge the detections to segment.
+	for _, frame := range segment.Frames {
+		if err := scheduler.Run(ctx, SchedulerClassDetector, v.processWorker.Stream, func() (err error) {
+			detectStarttime := time.Now()
+			defer func() {
+				labels := metricLabels("stream", v.processWorker.Stream, "detector", detectorConfig.Type)
+				metricDetectorSeconds.Observe(labels, time.Since(detectStarttime))
+			}()
+
+			frame.BoundingBox, err = detector.Detect(ctx, frame.ImageFile)
+			return
+		}); err != nil {
+			logger.Wf(ctx, "detect image %v by %v err %+v", frame.ImageFile.File, detectorConfig.Type, err)
+		}
+
+		for i := range frame.BoundingBox {
+			frame.BoundingBox[i].Offset = frame.Offset
+		}
+	}
+	segment.BoundingBox = v.sampler.Merge(segment.Frames)
+	for _, box := range segment.BoundingBox {
+		metricDetections.Inc(metricLabels("stream", v.processWorker.Stream, "category", fmt.Sprint(box.Category)))
+	}
+
+	// Use the frame with max score as the image of segment.
+	var maxScore float64
+	for _, frame := range segment.Frames {
+		for _, box := range frame.BoundingBox {
+			if box.Score > maxScore {
+				maxScore, segment.ImageFile = box.Score, frame.ImageFile
+			}
+		}
 	}
 
 	// Dequeue the segment from asr queue and attach to correct queue.
@@ -847,11 +1094,58 @@ func (v *ProcessTask) DriveDetectQueue(ctx context.Context) error {
 	logger.Tf(ctx, "process: detect image=%v, cost=%v",
 		segment.ImageFile.File, segment.CostProcess)
 
+	// Push the detections of every segment to clients, once the segment is committed.
+	eventHub.Publish(ctx, &Event{
+		Type:     EventTypeDetect,
+		Stream:   v.processWorker.Stream,
+		SeqNo:    segment.TsFile.SeqNo,
+		TsID:     segment.TsFile.TsID,
+		Duration: segment.TsFile.Duration,
+		Results:  segment.BoundingBox,
+	})
+
+	// Feed all segments to accident trackers, even not detected, to confirm or end accident. Never feed the
+	// segment before committed, or it's counted again when retried.
+	if err := accidentWorker.OnDetectSegment(ctx, segment, &SrsStream{
+		Vhost:  segment.Msg.Vhost,
+		App:    segment.Msg.App,
+		Stream: segment.Msg.Stream,
+	}); err != nil {
+		logger.Wf(ctx, "ignore accident of %v err %+v", segment.String(), err)
+	}
+
 	// Notify the main loop to persistent current task.
 	v.notifyPersistence(ctx)
 	return nil
 }
 
+// probeStarttime discover the starttime of ts file by ffprobe, for the file which is not demuxed.
+func probeStarttime(ctx context.Context, stream string, tsFile *TsFile) (time.Duration, error) {
+	var stdout []byte
+	if err := scheduler.Run(ctx, SchedulerClassFFprobe, stream, func() (err error) {
+		stdout, err = exec.CommandContext(ctx, "ffprobe",
+			"-show_error", "-show_private_data", "-v", "quiet", "-find_stream_info", "-print_format", "json",
+			"-show_format", "-show_streams", tsFile.File,
+		).Output()
+		return
+	}); err != nil {
+		return 0, errors.Wrapf(err, "probe %v", tsFile.File)
+	}
+
+	format := struct {
+		Format FFprobeFormat `json:"format"`
+	}{}
+	if err := json.Unmarshal([]byte(stdout), &format); err != nil {
+		return 0, errors.Wrapf(err, "parse format %v", stdout)
+	}
+
+	var starttime time.Duration
+	if stv, err := strconv.ParseFloat(format.Format.Starttime, 10); err == nil {
+		starttime = time.Duration(stv * float64(time.Second))
+	}
+	return starttime, nil
+}
+
 func (v *ProcessTask) DriveFinishQueue(ctx context.Context) error {
 	// Ignore if not enough segments.
 	if v.FinishQueue.count() <= maxFinishSegments {
@@ -870,22 +1164,68 @@ func (v *ProcessTask) DriveFinishQueue(ctx context.Context) error {
 		v.FinishQueue.dequeue(segment)
 	}()
 	logger.Tf(ctx, "dispose %v", segment.TsFile.File)
-	defer segment.Dispose()
+	defer segment.Dispose(ctx)
 
 	// Notify the main loop to persistent current task.
 	v.notifyPersistence(ctx)
 	return nil
 }
 
-// TODO: FIXME: Should restart task when stream unpublish.
-func (v *ProcessTask) restart(ctx context.Context) error {
-	v.lock.Lock()
-	defer v.lock.Unlock()
+// DriveAnnotateQueue annotate the oldest segment in finish queue which is not annotated yet. Note that
+// the segment might be disposed by finish queue when annotating, so we check it after annotated.
+func (v *ProcessTask) DriveAnnotateQueue(ctx context.Context) error {
+	var segment *ProcessSegment
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
 
-	if v.cancel != nil {
-		v.cancel()
+		for _, s := range v.FinishQueue.Segments {
+			// Ignore the segment skipped by load shedding, which has no detections.
+			if !s.Annotated && s.Skipped == "" {
+				segment, s.Annotated = s, true
+				break
+			}
+		}
+	}()
+	if segment == nil {
+		return nil
+	}
+
+	starttime := time.Now()
+
+	annotatedFile, err := annotateSegment(ctx, v.processWorker.Stream, segment)
+	if err != nil {
+		return errors.Wrapf(err, "annotate %v", segment.String())
 	}
 
+	var disposed bool
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		disposed = true
+		for _, s := range v.FinishQueue.Segments {
+			if s == segment {
+				disposed = false
+				break
+			}
+		}
+		if !disposed {
+			segment.AnnotatedFile = annotatedFile
+			segment.CostAnnotate = time.Since(starttime)
+		}
+	}()
+	if disposed {
+		os.Remove(annotatedFile.File)
+		logger.Tf(ctx, "process: drop annotated %v of disposed segment", annotatedFile.File)
+		return nil
+	}
+
+	logger.Tf(ctx, "process: annotate %v to %v, size=%v, boxes=%v, cost=%v",
+		segment.TsFile.File, annotatedFile.File, annotatedFile.Size, len(segment.BoundingBox), segment.CostAnnotate)
+
+	// Notify the main loop to persistent current task.
+	v.notifyPersistence(ctx)
 	return nil
 }
 
@@ -928,6 +1268,123 @@ func (v *ProcessTask) reset(ctx context.Context) error {
 	return nil
 }
 
+// restore the queues of task loaded from redis, keep the segments whose files still exist, and dispose
+// the others. Note that a segment in detect queue is moved back to live queue if image is lost.
+func (v *ProcessTask) restore(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	exists := func(file *TsFile) bool {
+		if file == nil {
+			return false
+		}
+		_, err := os.Stat(file.File)
+		return err == nil
+	}
+
+	var live, detect, finish []*ProcessSegment
+	var disposed int
+	for _, segment := range v.LiveQueue.Segments {
+		if exists(segment.TsFile) {
+			live = append(live, segment)
+		} else {
+			segment.Dispose(ctx)
+			disposed++
+		}
+	}
+	for _, segment := range v.DetectQueue.Segments {
+		framesExist := exists(segment.ImageFile)
+		for _, frame := range segment.Frames {
+			framesExist = framesExist && exists(frame.ImageFile)
+		}
+
+		if exists(segment.TsFile) && framesExist {
+			detect = append(detect, segment)
+		} else if exists(segment.TsFile) {
+			if segment.ImageFile != nil {
+				os.Remove(segment.ImageFile.File)
+			}
+			for _, frame := range segment.Frames {
+				os.Remove(frame.ImageFile.File)
+			}
+			segment.ImageFile, segment.Frames, segment.CostExtractImage = nil, nil, 0
+			live = append(live, segment)
+		} else {
+			segment.Dispose(ctx)
+			disposed++
+		}
+	}
+	for _, segment := range v.FinishQueue.Segments {
+		// Annotate again if the annotated file is lost.
+		if segment.AnnotatedFile != nil && !exists(segment.AnnotatedFile) {
+			segment.AnnotatedFile, segment.Annotated = nil, false
+		}
+
+		if exists(segment.TsFile) {
+			finish = append(finish, segment)
+		} else {
+			segment.Dispose(ctx)
+			disposed++
+		}
+	}
+	for _, segment := range v.FixQueue.Segments {
+		segment.Dispose(ctx)
+		disposed++
+	}
+
+	// Note that the live queue should be ordered by seqno, because we might move segments from detect queue.
+	sort.SliceStable(live, func(i, j int) bool {
+		return live[i].TsFile.SeqNo < live[j].TsFile.SeqNo
+	})
+	v.LiveQueue.Segments, v.DetectQueue.Segments, v.FixQueue.Segments = live, detect, nil
+	v.FinishQueue.Segments = finish
+
+	logger.Tf(ctx, "process restore task %v, disposed=%v", v.String(), disposed)
+	return nil
+}
+
+// dispose all segments of task and remove it from redis, for the stream is not active.
+func (v *ProcessTask) dispose(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.LiveQueue.reset(ctx)
+	v.DetectQueue.reset(ctx)
+	v.FixQueue.reset(ctx)
+	v.FinishQueue.reset(ctx)
+
+	if err := rdb.HDel(ctx, PROCESS_TASK, v.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", PROCESS_TASK, v.UUID)
+	}
+
+	return nil
+}
+
+// files returns all files referenced by the segments of task.
+func (v *ProcessTask) files() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var files []string
+	for _, queue := range []*ProcessQueue{v.LiveQueue, v.DetectQueue, v.FixQueue, v.FinishQueue} {
+		for _, segment := range queue.Segments {
+			if segment.TsFile != nil {
+				files = append(files, segment.TsFile.File)
+			}
+			if segment.ImageFile != nil {
+				files = append(files, segment.ImageFile.File)
+			}
+			for _, frame := range segment.Frames {
+				files = append(files, frame.ImageFile.File)
+			}
+			if segment.AnnotatedFile != nil {
+				files = append(files, segment.AnnotatedFile.File)
+			}
+		}
+	}
+	return files
+}
+
 func (v *ProcessTask) match(msg *SrsOnHlsMessage) bool {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -0,0 +1,332 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var reconcileWorker *ReconcileWorker
+
+// The page size to query streams from SRS.
+const reconcilePageSize = 100
+
+// SrsApiStream is a stream of SRS HTTP API /api/v1/streams.
+type SrsApiStream struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Vhost string `json:"vhost"`
+	App   string `json:"app"`
+	// The publisher, which is active if publishing.
+	Publish struct {
+		Active bool   `json:"active"`
+		Cid    string `json:"cid"`
+	} `json:"publish"`
+}
+
+// ReconcileReport is what fixed by a reconcile.
+type ReconcileReport struct {
+	// The time of reconcile.
+	Time string `json:"time"`
+	// The number of streams publishing in SRS.
+	Publishing int `json:"publishing"`
+	// The stale streams removed from SRS_STREAM_ACTIVE, whose end callback is fired.
+	Ended []string `json:"ended,omitempty"`
+	// The missing streams added to SRS_STREAM_ACTIVE.
+	Added []string `json:"added,omitempty"`
+	// The process workers of dead streams, which are removed.
+	Workers []string `json:"workers,omitempty"`
+}
+
+func (v *ReconcileReport) String() string {
+	return fmt.Sprintf("publishing=%v, ended=%v, added=%v, workers=%v",
+		v.Publishing, v.Ended, v.Added, v.Workers,
+	)
+}
+
+// ReconcileWorker periodically queries the streams of SRS, to fix SRS_STREAM_ACTIVE which is only updated by
+// hooks and might be stale if platform or SRS crashed. For the streams disappeared, fire the missing end
+// callback and remove the process workers.
+type ReconcileWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The interval to reconcile.
+	interval time.Duration
+	// Never end the stream updated in this duration, because the hook is called before SRS publishing it.
+	grace time.Duration
+
+	// The last report.
+	report *ReconcileReport
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewReconcileWorker() *ReconcileWorker {
+	v := &ReconcileWorker{interval: 30 * time.Second, grace: 30 * time.Second}
+	if n, err := strconv.Atoi(envSrsReconcileInterval()); err == nil && n > 0 {
+		v.interval = time.Duration(n) * time.Second
+	}
+	if n, err := strconv.Atoi(envSrsReconcileGrace()); err == nil && n >= 0 {
+		v.grace = time.Duration(n) * time.Second
+	}
+	return v
+}
+
+func (v *ReconcileWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *ReconcileWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/reconcile/report"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Interval float64          `json:"interval"`
+				Grace    float64          `json:"grace"`
+				Report   *ReconcileReport `json:"report"`
+			}{
+				Interval: v.interval.Seconds(), Grace: v.grace.Seconds(), Report: v.report,
+			})
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+func (v *ReconcileWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "reconcile: start worker, api=%v, interval=%v, grace=%v", envSrsApiUrl(), v.interval, v.grace)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(v.interval):
+				if err := v.reconcile(ctx); err != nil {
+					logger.Wf(ctx, "reconcile: ignore err %+v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reconcile fix SRS_STREAM_ACTIVE and process workers by the streams of SRS. Note that we do nothing if
+// failed to query SRS, because we are not sure whether streams are dead.
+func (v *ReconcileWorker) reconcile(ctx context.Context) error {
+	vhosts, err := querySrsVhosts(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query vhosts")
+	}
+
+	streams, err := querySrsStreams(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query streams")
+	}
+
+	// The publishing streams of SRS, the key is the stream url, like the key of SRS_STREAM_ACTIVE.
+	publishing := make(map[string]*SrsStream)
+	names := make(map[string]bool)
+	for _, s := range streams {
+		if !s.Publish.Active {
+			continue
+		}
+
+		stream := &SrsStream{Vhost: s.Vhost, App: s.App, Stream: s.Name, Client: s.Publish.Cid}
+		if vhost, ok := vhosts[s.Vhost]; ok {
+			stream.Vhost = vhost
+		}
+		publishing[stream.StreamURL()] = stream
+		names[stream.Stream] = true
+	}
+
+	activeStreams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	report := &ReconcileReport{Time: time.Now().Format(time.RFC3339), Publishing: len(publishing)}
+
+	// End the stale streams, which are not publishing in SRS.
+	for streamURL, obj := range activeStreams {
+		if _, ok := publishing[streamURL]; ok {
+			continue
+		}
+
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(obj), &stream); err != nil {
+			logger.Wf(ctx, "reconcile: ignore invalid stream %v %v err %+v", streamURL, obj, err)
+			continue
+		}
+		if update, err := time.Parse(time.RFC3339, stream.Update); err == nil && time.Since(update) < v.grace {
+			continue
+		}
+
+		if err := endStream(ctx, &stream); err != nil {
+			return errors.Wrapf(err, "end stream %v", streamURL)
+		}
+		if err := accidentWorker.OnStreamUnpublished(ctx, &stream, detectWorker.generation(stream.Stream)); err != nil {
+			return errors.Wrapf(err, "end accidents of %v", streamURL)
+		}
+		report.Ended = append(report.Ended, streamURL)
+		logger.Tf(ctx, "reconcile: end stale stream %v", stream.String())
+	}
+
+	// Add the missing streams, which are publishing in SRS but the hook is lost.
+	for streamURL, stream := range publishing {
+		if _, ok := activeStreams[streamURL]; ok {
+			continue
+		}
+
+		stream.Update = time.Now().Format(time.RFC3339)
+		b, err := json.Marshal(stream)
+		if err != nil {
+			return errors.Wrapf(err, "marshal json")
+		} else if err = rdb.HSet(ctx, SRS_STREAM_ACTIVE, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_ACTIVE, streamURL, string(b))
+		}
+		report.Added = append(report.Added, streamURL)
+		logger.Tf(ctx, "reconcile: add missing stream %v", stream.String())
+	}
+
+	// Remove the process workers of dead streams. Note that the worker is created by the on_hls of stream,
+	// so it's not dead if updated in grace.
+	var deadWorkers []string
+	detectWorker.workers.Range(func(key, value interface{}) bool {
+		if stream := key.(string); !names[stream] && time.Since(value.(*ProcessWorker).updated()) >= v.grace {
+			deadWorkers = append(deadWorkers, stream)
+		}
+		return true
+	})
+	for _, stream := range deadWorkers {
+		if err := detectWorker.removeWorker(ctx, stream); err != nil {
+			return errors.Wrapf(err, "remove worker %v", stream)
+		}
+		report.Workers = append(report.Workers, stream)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.report = report
+
+	if len(report.Ended) > 0 || len(report.Added) > 0 || len(report.Workers) > 0 {
+		logger.Tf(ctx, "reconcile: done, %v", report.String())
+	}
+	return nil
+}
+
+// querySrs request the SRS HTTP API, and parse the response to data.
+func querySrs(ctx context.Context, api string, data interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	u := fmt.Sprintf("%v%v", strings.TrimSuffix(envSrsApiUrl(), "/"), api)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return errors.Wrapf(err, "new request %v", u)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "get %v", u)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", u)
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("get %v status %v, body %v", u, res.StatusCode, string(b))
+	}
+
+	var code struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(b, &code); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(b))
+	} else if code.Code != 0 {
+		return errors.Errorf("get %v code %v, body %v", u, code.Code, string(b))
+	}
+
+	if err := json.Unmarshal(b, data); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	return nil
+}
+
+// querySrsVhosts query the vhosts of SRS, return the map of vhost id to name, because the vhost of stream
+// is the id.
+func querySrsVhosts(ctx context.Context) (map[string]string, error) {
+	var res struct {
+		Vhosts []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"vhosts"`
+	}
+	if err := querySrs(ctx, "/api/v1/vhosts/", &res); err != nil {
+		return nil, errors.Wrapf(err, "query vhosts")
+	}
+
+	vhosts := make(map[string]string)
+	for _, vhost := range res.Vhosts {
+		vhosts[vhost.ID] = vhost.Name
+	}
+	return vhosts, nil
+}
+
+// querySrsStreams query all streams of SRS, page by page.
+func querySrsStreams(ctx context.Context) ([]*SrsApiStream, error) {
+	var streams []*SrsApiStream
+	for start := 0; ; start += reconcilePageSize {
+		var res struct {
+			Streams []*SrsApiStream `json:"streams"`
+		}
+		api := fmt.Sprintf("/api/v1/streams/?start=%v&count=%v", start, reconcilePageSize)
+		if err := querySrs(ctx, api, &res); err != nil {
+			return nil, errors.Wrapf(err, "query streams")
+		}
+
+		streams = append(streams, res.Streams...)
+		if len(res.Streams) < reconcilePageSize {
+			return streams, nil
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is a redis server in memory, which only supports the hash, sorted set and transaction commands
+// used by tests.
+type fakeRedis struct {
+	lock sync.Mutex
+	// The hashes and sorted sets by key.
+	hashes map[string]map[string]string
+	zsets  map[string]map[string]float64
+}
+
+// newFakeRedis start a fake redis server, and replace the global rdb by a client to it, which is restored
+// when the test is done.
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err %+v", err)
+	}
+
+	v := &fakeRedis{hashes: make(map[string]map[string]string), zsets: make(map[string]map[string]float64)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go v.serve(c)
+		}
+	}()
+
+	client, previous := redis.NewClient(&redis.Options{Addr: l.Addr().String()}), rdb
+	rdb = client
+	t.Cleanup(func() {
+		rdb = previous
+		client.Close()
+		l.Close()
+	})
+	return v
+}
+
+func (v *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	var queued [][]string
+	var multi bool
+	for {
+		args, err := v.readCommand(r)
+		if err != nil {
+			return
+		}
+
+		v.lock.Lock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			multi, queued, reply = true, nil, "+OK\r\n"
+		case cmd == "EXEC":
+			reply = fmt.Sprintf("*%v\r\n", len(queued))
+			for _, q := range queued {
+				reply += v.exec(q)
+			}
+			multi, queued = false, nil
+		case multi:
+			queued, reply = append(queued, args), "+QUEUED\r\n"
+		default:
+			reply = v.exec(args)
+		}
+		v.lock.Unlock()
+
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand read a command in RESP array of bulk strings.
+func (v *fakeRedis) readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func (v *fakeRedis) exec(args []string) string {
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%v\r\n%v\r\n", len(s), s)
+	}
+	bools := map[bool]string{true: ":1\r\n", false: ":0\r\n"}
+
+	switch strings.ToUpper(args[0]) {
+	case "HSET":
+		if v.hashes[args[1]] == nil {
+			v.hashes[args[1]] = make(map[string]string)
+		}
+		_, ok := v.hashes[args[1]][args[2]]
+		v.hashes[args[1]][args[2]] = args[3]
+		return bools[!ok]
+	case "HGET":
+		if value, ok := v.hashes[args[1]][args[2]]; ok {
+			return bulk(value)
+		}
+		return "$-1\r\n"
+	case "HEXISTS":
+		_, ok := v.hashes[args[1]][args[2]]
+		return bools[ok]
+	case "HDEL":
+		_, ok := v.hashes[args[1]][args[2]]
+		delete(v.hashes[args[1]], args[2])
+		return bools[ok]
+	case "HINCRBY":
+		if v.hashes[args[1]] == nil {
+			v.hashes[args[1]] = make(map[string]string)
+		}
+		n, _ := strconv.ParseInt(v.hashes[args[1]][args[2]], 10, 64)
+		delta, _ := strconv.ParseInt(args[3], 10, 64)
+		v.hashes[args[1]][args[2]] = fmt.Sprint(n + delta)
+		return fmt.Sprintf(":%v\r\n", n+delta)
+	case "DEL":
+		_, ok := v.hashes[args[1]]
+		delete(v.hashes, args[1])
+		delete(v.zsets, args[1])
+		return bools[ok]
+	case "HGETALL":
+		reply := fmt.Sprintf("*%v\r\n", 2*len(v.hashes[args[1]]))
+		for field, value := range v.hashes[args[1]] {
+			reply += bulk(field) + bulk(value)
+		}
+		return reply
+	case "ZADD":
+		if v.zsets[args[1]] == nil {
+			v.zsets[args[1]] = make(map[string]float64)
+		}
+		score, _ := strconv.ParseFloat(args[2], 64)
+		_, ok := v.zsets[args[1]][args[3]]
+		v.zsets[args[1]][args[3]] = score
+		return bools[!ok]
+	case "ZREM":
+		_, ok := v.zsets[args[1]][args[2]]
+		delete(v.zsets[args[1]], args[2])
+		return bools[ok]
+	case "ZSCORE":
+		if score, ok := v.zsets[args[1]][args[2]]; ok {
+			return bulk(strconv.FormatFloat(score, 'f', -1, 64))
+		}
+		return "$-1\r\n"
+	case "ZRANGEBYSCORE":
+		// Only support the max score, for the min score is always -inf.
+		zset := v.zsets[args[1]]
+		max, _ := strconv.ParseFloat(args[3], 64)
+
+		var members []string
+		for member, score := range zset {
+			if score <= max {
+				members = append(members, member)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if zset[members[i]] != zset[members[j]] {
+				return zset[members[i]] < zset[members[j]]
+			}
+			return members[i] < members[j]
+		})
+
+		reply := fmt.Sprintf("*%v\r\n", len(members))
+		for _, member := range members {
+			reply += bulk(member)
+		}
+		return reply
+	case "HELLO":
+		// Use RESP2 for the client.
+		return "-ERR unknown command\r\n"
+	}
+	return "+OK\r\n"
+}
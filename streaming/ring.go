@@ -0,0 +1,122 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// SegmentRing keeps the latest segments of a stream, to build the pre-roll of accident. The ring holds a
+// reference of each segment in store, so the file is never removed before evicted.
+type SegmentRing struct {
+	// The max duration in seconds of segments to keep.
+	duration float64
+	// The segments, ordered from oldest to newest.
+	segments []*TsFile
+	// Whether closed, to never hold the segment pushed after closed.
+	closed bool
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewSegmentRing(duration float64) *SegmentRing {
+	return &SegmentRing{duration: duration}
+}
+
+func (v *SegmentRing) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return fmt.Sprintf("duration=%v, segments=%v", v.duration, len(v.segments))
+}
+
+// Push a new segment, and drop the oldest segments which exceed the duration.
+func (v *SegmentRing) Push(ctx context.Context, tsFile *TsFile) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closed {
+		return nil
+	}
+
+	if _, err := segmentStore.Acquire(ctx, tsFile.File); err != nil {
+		return errors.Wrapf(err, "acquire %v", tsFile.String())
+	}
+	v.segments = append(v.segments, tsFile)
+
+	var duration float64
+	var evicted []*TsFile
+	for i := len(v.segments) - 1; i >= 0; i-- {
+		if duration += v.segments[i].Duration; duration > v.duration {
+			evicted = v.segments[:i]
+			v.segments = append([]*TsFile{}, v.segments[i:]...)
+			break
+		}
+	}
+
+	var r0 error
+	for _, segment := range evicted {
+		if err := segmentStore.Release(ctx, segment.File); err != nil && r0 == nil {
+			r0 = errors.Wrapf(err, "release %v", segment.String())
+		}
+	}
+	return r0
+}
+
+// Close release all segments, and never hold any segment after closed.
+func (v *SegmentRing) Close(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	segments := v.segments
+	v.segments, v.closed = nil, true
+
+	var r0 error
+	for _, segment := range segments {
+		if err := segmentStore.Release(ctx, segment.File); err != nil && r0 == nil {
+			r0 = errors.Wrapf(err, "release %v", segment.String())
+		}
+	}
+	return r0
+}
+
+// Before return the segments before tsFile, at most duration in seconds, ordered from oldest to newest.
+func (v *SegmentRing) Before(tsFile *TsFile, duration float64) []*TsFile {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	end := -1
+	for i, segment := range v.segments {
+		if segment == tsFile {
+			end = i
+			break
+		}
+	}
+	if end <= 0 {
+		return nil
+	}
+
+	start, total := end, 0.0
+	for start > 0 && total+v.segments[start-1].Duration <= duration {
+		start--
+		total += v.segments[start].Duration
+	}
+	return append([]*TsFile{}, v.segments[start:end]...)
+}
+
+// Files return the files of all segments.
+func (v *SegmentRing) Files() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var files []string
+	for _, segment := range v.segments {
+		files = append(files, segment.File)
+	}
+	return files
+}
@@ -0,0 +1,498 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var s3Client *S3Client
+
+// The min part size of multipart upload, limited by S3.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// The max expires of presigned url, limited by AWS Signature V4.
+const s3MaxPresignExpires = 7 * 24 * time.Hour
+
+// S3Client is a client of S3-compatible object storage, such as AWS S3 or MinIO, which signs requests by AWS
+// Signature Version 4. The large file is uploaded by multipart, which is resumed by the state in redis.
+type S3Client struct {
+	// The endpoint of storage, such as http://127.0.0.1:9000
+	Endpoint string
+	// The region and bucket, such as us-east-1 and accident.
+	Region string
+	Bucket string
+	// The credential to sign requests.
+	AccessKey string
+	SecretKey string
+	// Whether use path-style url such as http://host/bucket/key, which is required by MinIO, or use
+	// virtual-hosted url such as http://bucket.host/key.
+	PathStyle bool
+	// The prefix of object key, such as accident.
+	Prefix string
+	// The public url of bucket, to build object url, or use presigned url if empty.
+	PublicURL string
+	// The expires of presigned url.
+	PresignExpires time.Duration
+	// The size of part for multipart upload, and the file larger than it is uploaded by multipart.
+	PartSize int64
+	// The number of retries for each request.
+	Retries int
+
+	client *http.Client
+}
+
+// NewS3Client create the client from env, return nil if not configured.
+func NewS3Client() *S3Client {
+	if envS3Endpoint() == "" || envS3Bucket() == "" {
+		return nil
+	}
+
+	v := &S3Client{
+		Endpoint: strings.TrimSuffix(envS3Endpoint(), "/"), Region: envS3Region(), Bucket: envS3Bucket(),
+		AccessKey: envS3AccessKey(), SecretKey: envS3SecretKey(), PathStyle: envS3PathStyle() != "off",
+		Prefix: strings.Trim(envS3Prefix(), "/"), PublicURL: strings.TrimSuffix(envS3PublicUrl(), "/"),
+		PresignExpires: s3MaxPresignExpires, PartSize: 8 * 1024 * 1024, Retries: 3,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	if v.Region == "" {
+		v.Region = "us-east-1"
+	}
+	if n, err := strconv.Atoi(envS3PresignExpires()); err == nil && n > 0 {
+		v.PresignExpires = time.Duration(n) * time.Second
+	}
+	if v.PresignExpires > s3MaxPresignExpires {
+		v.PresignExpires = s3MaxPresignExpires
+	}
+	if n, err := strconv.ParseInt(envS3PartSize(), 10, 64); err == nil && n > 0 {
+		v.PartSize = n
+	}
+	if v.PartSize < s3MinPartSize {
+		v.PartSize = s3MinPartSize
+	}
+	if n, err := strconv.Atoi(envS3Retries()); err == nil && n >= 0 {
+		v.Retries = n
+	}
+	return v
+}
+
+func (v *S3Client) String() string {
+	return fmt.Sprintf("endpoint=%v, region=%v, bucket=%v, pathStyle=%v, prefix=%v, public=%v, expires=%v, part=%v, retries=%v",
+		v.Endpoint, v.Region, v.Bucket, v.PathStyle, v.Prefix, v.PublicURL, v.PresignExpires, v.PartSize, v.Retries,
+	)
+}
+
+// S3Error is the error response of S3.
+type S3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (v *S3Error) Error() string {
+	return fmt.Sprintf("s3 status=%v, code=%v, message=%v", v.Status, v.Code, v.Message)
+}
+
+// retryable whether the request should be retried, for server error or throttled.
+func (v *S3Error) retryable() bool {
+	return v.Status >= 500 || v.Status == http.StatusTooManyRequests || v.Status == http.StatusRequestTimeout
+}
+
+// Key return the object key of name, with prefix.
+func (v *S3Client) Key(name string) string {
+	if v.Prefix == "" {
+		return name
+	}
+	return fmt.Sprintf("%v/%v", v.Prefix, name)
+}
+
+// ObjectURL return the url of object to download, which is the public url or presigned url.
+func (v *S3Client) ObjectURL(key string) (string, error) {
+	if v.PublicURL != "" {
+		return fmt.Sprintf("%v/%v", v.PublicURL, s3Escape(key, false)), nil
+	}
+	return v.Presign(http.MethodGet, key, v.PresignExpires, time.Now())
+}
+
+// objectURL return the url and the canonical uri of object.
+func (v *S3Client) objectURL(key string) (u *url.URL, canonicalURI string, err error) {
+	if u, err = url.Parse(v.Endpoint); err != nil {
+		return nil, "", errors.Wrapf(err, "parse endpoint %v", v.Endpoint)
+	}
+
+	if v.PathStyle {
+		canonicalURI = fmt.Sprintf("/%v/%v", s3Escape(v.Bucket, false), s3Escape(key, false))
+	} else {
+		u.Host = fmt.Sprintf("%v.%v", v.Bucket, u.Host)
+		canonicalURI = fmt.Sprintf("/%v", s3Escape(key, false))
+	}
+
+	if u, err = url.Parse(fmt.Sprintf("%v://%v%v", u.Scheme, u.Host, canonicalURI)); err != nil {
+		return nil, "", errors.Wrapf(err, "parse object %v", key)
+	}
+	return u, canonicalURI, nil
+}
+
+// Presign return the presigned url of object, by query parameters of AWS Signature V4.
+func (v *S3Client) Presign(method, key string, expires time.Duration, now time.Time) (string, error) {
+	u, canonicalURI, err := v.objectURL(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "url of %v", key)
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", amzDate[:8], v.Region)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", fmt.Sprintf("%v/%v", v.AccessKey, scope))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprint(int64(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{
+		method, canonicalURI, canonicalQuery, fmt.Sprintf("host:%v\n", u.Host), "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	signature := v.signature(amzDate, scope, canonicalRequest)
+	return fmt.Sprintf("%v?%v&X-Amz-Signature=%v", u.String(), canonicalQuery, signature), nil
+}
+
+// sign the request by the Authorization header of AWS Signature V4. All headers of request are signed, so
+// the caller should set the headers before signing.
+func (v *S3Client) sign(req *http.Request, canonicalURI, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", amzDate[:8], v.Region)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, values := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(fmt.Sprintf("%v:%v\n", k, headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, canonicalURI, s3CanonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		v.AccessKey, scope, signedHeaders, v.signature(amzDate, scope, canonicalRequest),
+	))
+}
+
+// signature return the signature of canonical request.
+func (v *S3Client) signature(amzDate, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + v.SecretKey)
+	for _, data := range []string{amzDate[:8], v.Region, "s3", "aws4_request"} {
+		key = s3HMAC(key, data)
+	}
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+// do the request of object, and retry for network or server error.
+func (v *S3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+
+	var err error
+	for i := 0; i <= v.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(time.Duration(1<<(i-1)) * time.Second):
+			}
+			logger.Wf(ctx, "s3: retry %v %v, %v/%v, err %v", method, key, i, v.Retries, err)
+		}
+
+		var h http.Header
+		var b []byte
+		if h, b, err = v.doOnce(ctx, method, key, query, header, body, payloadHash); err == nil {
+			return h, b, nil
+		}
+
+		if r, ok := errors.Cause(err).(*S3Error); ok && !r.retryable() {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
+}
+
+func (v *S3Client) doOnce(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte, payloadHash string) (http.Header, []byte, error) {
+	u, canonicalURI, err := v.objectURL(key)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "url of %v", key)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "new request %v %v", method, u.String())
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	v.sign(req, canonicalURI, payloadHash, time.Now())
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "%v %v", method, u.String())
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read %v %v", method, u.String())
+	}
+
+	// Note that the complete multipart upload might respond error with status 200.
+	if res.StatusCode >= 300 || bytes.Contains(b, []byte("<Error>")) {
+		r := &S3Error{Status: res.StatusCode}
+		xml.Unmarshal(b, r)
+		if r.Status < 300 {
+			r.Status = http.StatusInternalServerError
+		}
+		return nil, nil, errors.Wrapf(r, "%v %v", method, u.String())
+	}
+
+	return res.Header, b, nil
+}
+
+// S3MultipartUpload is the state of multipart upload, saved in redis to resume.
+type S3MultipartUpload struct {
+	// The upload id of multipart upload.
+	UploadID string `json:"uploadId"`
+	// The size and modify time of file, to identify the file is not changed.
+	Size    int64  `json:"size"`
+	ModTime string `json:"mtime"`
+	// The size of part.
+	PartSize int64 `json:"partSize"`
+	// The uploaded parts.
+	Parts []*S3Part `json:"parts"`
+}
+
+// S3Part is a uploaded part of multipart upload.
+type S3Part struct {
+	PartNumber int    `json:"n" xml:"PartNumber"`
+	ETag       string `json:"etag" xml:"ETag"`
+}
+
+// PutFile upload the file to object, by multipart if larger than the part size.
+func (v *S3Client) PutFile(ctx context.Context, key, file string) error {
+	stats, err := os.Stat(file)
+	if err != nil {
+		return errors.Wrapf(err, "stat %v", file)
+	}
+
+	if stats.Size() > v.PartSize {
+		// Retry from a new upload, if the upload is aborted or expired by storage.
+		err := v.putMultipart(ctx, key, file, stats)
+		if r, ok := errors.Cause(err).(*S3Error); ok && r.Code == "NoSuchUpload" {
+			logger.Wf(ctx, "s3: restart upload %v, err %v", key, err)
+			err = v.putMultipart(ctx, key, file, stats)
+		}
+		return err
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", file)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", s3ContentType(file))
+	if _, _, err := v.do(ctx, http.MethodPut, key, nil, header, b); err != nil {
+		return errors.Wrapf(err, "put %v", key)
+	}
+
+	logger.Tf(ctx, "s3: put %v to %v ok, size=%v", file, key, len(b))
+	return nil
+}
+
+// putMultipart upload the file by multipart, and resume the uploaded parts from redis.
+func (v *S3Client) putMultipart(ctx context.Context, key, file string, stats os.FileInfo) error {
+	field := fmt.Sprintf("%v/%v", v.Bucket, key)
+	upload := &S3MultipartUpload{}
+	if obj, err := rdb.HGet(ctx, S3_MULTIPART_UPLOAD, field).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v %v", S3_MULTIPART_UPLOAD, field)
+	} else if obj != "" {
+		if err := json.Unmarshal([]byte(obj), upload); err != nil {
+			logger.Wf(ctx, "s3: ignore invalid upload %v %v err %+v", field, obj, err)
+		}
+	}
+
+	saveUpload := func() error {
+		if b, err := json.Marshal(upload); err != nil {
+			return errors.Wrapf(err, "marshal upload")
+		} else if err := rdb.HSet(ctx, S3_MULTIPART_UPLOAD, field, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", S3_MULTIPART_UPLOAD, field, string(b))
+		}
+		return nil
+	}
+
+	// Create a new upload, if the file or part size is changed.
+	modTime := stats.ModTime().Format(time.RFC3339Nano)
+	if upload.UploadID == "" || upload.Size != stats.Size() || upload.ModTime != modTime || upload.PartSize != v.PartSize {
+		header := http.Header{}
+		header.Set("Content-Type", s3ContentType(file))
+		_, b, err := v.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+		if err != nil {
+			return errors.Wrapf(err, "create upload %v", key)
+		}
+
+		var res struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(b, &res); err != nil || res.UploadID == "" {
+			return errors.Errorf("invalid upload %v of %v, err %v", string(b), key, err)
+		}
+
+		upload = &S3MultipartUpload{UploadID: res.UploadID, Size: stats.Size(), ModTime: modTime, PartSize: v.PartSize}
+		if err := saveUpload(); err != nil {
+			return errors.Wrapf(err, "save upload")
+		}
+	}
+
+	uploaded := make(map[int]bool)
+	for _, part := range upload.Parts {
+		uploaded[part.PartNumber] = true
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", file)
+	}
+	defer f.Close()
+
+	parts := int((upload.Size + upload.PartSize - 1) / upload.PartSize)
+	for n := 1; n <= parts; n++ {
+		if uploaded[n] {
+			continue
+		}
+
+		offset := int64(n-1) * upload.PartSize
+		b := make([]byte, upload.PartSize)
+		nn, err := f.ReadAt(b, offset)
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "read %v at %v", file, offset)
+		}
+
+		query := url.Values{"partNumber": {fmt.Sprint(n)}, "uploadId": {upload.UploadID}}
+		h, _, err := v.do(ctx, http.MethodPut, key, query, nil, b[:nn])
+		if err != nil {
+			return errors.Wrapf(err, "upload part %v/%v of %v", n, parts, key)
+		}
+
+		upload.Parts = append(upload.Parts, &S3Part{PartNumber: n, ETag: h.Get("ETag")})
+		if err := saveUpload(); err != nil {
+			return errors.Wrapf(err, "save upload")
+		}
+		logger.Tf(ctx, "s3: upload part %v/%v of %v ok, size=%v", n, parts, key, nn)
+	}
+
+	sort.Slice(upload.Parts, func(i, j int) bool {
+		return upload.Parts[i].PartNumber < upload.Parts[j].PartNumber
+	})
+	body, err := xml.Marshal(&struct {
+		XMLName xml.Name  `xml:"CompleteMultipartUpload"`
+		Parts   []*S3Part `xml:"Part"`
+	}{Parts: upload.Parts})
+	if err != nil {
+		return errors.Wrapf(err, "marshal parts")
+	}
+
+	query := url.Values{"uploadId": {upload.UploadID}}
+	if _, _, err := v.do(ctx, http.MethodPost, key, query, nil, body); err != nil {
+		// Drop the state, because the upload id is invalid now, and should restart.
+		if r, ok := errors.Cause(err).(*S3Error); ok && r.Code == "NoSuchUpload" {
+			rdb.HDel(ctx, S3_MULTIPART_UPLOAD, field)
+		}
+		return errors.Wrapf(err, "complete upload %v", key)
+	}
+
+	if err := rdb.HDel(ctx, S3_MULTIPART_UPLOAD, field).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", S3_MULTIPART_UPLOAD, field)
+	}
+
+	logger.Tf(ctx, "s3: put %v to %v by multipart ok, size=%v, parts=%v", file, key, upload.Size, parts)
+	return nil
+}
+
+// s3ContentType return the content type of file, or binary if unknown.
+func s3ContentType(file string) string {
+	if contentType := mediaContentType(file); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// s3CanonicalQuery return the query sorted by key, and encoded by AWS rules.
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", s3Escape(k, true), s3Escape(value, true)))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape encode the string by AWS rules, which only keeps the unreserved characters. The slash is also
+// encoded for query, but kept for path.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return b.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,456 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var scheduler *Scheduler
+
+// The classes of jobs, each has its own concurrency limit.
+const (
+	SchedulerClassFFmpeg   = "ffmpeg"
+	SchedulerClassDetector = "detector"
+	SchedulerClassFFprobe  = "ffprobe"
+)
+
+// The priority classes of stream, the higher is scheduled first. For example, the SOS-prone stream should
+// be high, so its segments are detected before others when busy.
+const (
+	SchedulerPriorityLow    = "low"
+	SchedulerPriorityNormal = "normal"
+	SchedulerPriorityHigh   = "high"
+)
+
+// schedulerPriorityValue return the value of priority class, normal if invalid.
+func schedulerPriorityValue(priority string) int {
+	switch priority {
+	case SchedulerPriorityHigh:
+		return 2
+	case SchedulerPriorityLow:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// The interval to reload the priorities of streams from redis.
+const schedulerReloadInterval = 10 * time.Second
+
+// schedulerWaiter is a job waiting for a slot.
+type schedulerWaiter struct {
+	// The stream of job.
+	stream string
+	// The priority value of stream.
+	priority int
+	// The time to wait.
+	starttime time.Time
+	// Closed when the slot is granted.
+	ready chan struct{}
+	// Whether the slot is granted.
+	granted bool
+}
+
+// schedulerClass is the slots and waiting jobs of a class.
+type schedulerClass struct {
+	// The class name, such as ffmpeg.
+	name string
+	// The max number of running jobs.
+	limit int
+	// The number of running jobs.
+	running int
+	// The waiting jobs of each stream, in order.
+	waiters map[string][]*schedulerWaiter
+	// The streams which have waiting jobs, to schedule in round-robin.
+	streams []string
+	// The index of next stream to schedule in round-robin.
+	next int
+}
+
+// dispatch grant the slots to waiting jobs, the highest priority first, and round-robin across the streams
+// of the same priority, so a stream with many segments never starves others.
+func (v *schedulerClass) dispatch() {
+	for v.running < v.limit && len(v.streams) > 0 {
+		priority := -1
+		for _, stream := range v.streams {
+			if p := v.waiters[stream][0].priority; p > priority {
+				priority = p
+			}
+		}
+
+		for i := 0; i < len(v.streams); i++ {
+			index := (v.next + i) % len(v.streams)
+			stream := v.streams[index]
+
+			queue := v.waiters[stream]
+			if queue[0].priority != priority {
+				continue
+			}
+
+			waiter := queue[0]
+			waiter.granted = true
+			close(waiter.ready)
+			v.running++
+
+			metricSchedulerGranted.Inc(metricLabels("class", v.name))
+			metricSchedulerWaitSeconds.Observe(metricLabels("class", v.name), time.Since(waiter.starttime))
+
+			if queue = queue[1:]; len(queue) > 0 {
+				v.waiters[stream] = queue
+				v.next = index + 1
+			} else {
+				delete(v.waiters, stream)
+				v.streams = append(v.streams[:index], v.streams[index+1:]...)
+				v.next = index
+			}
+			if len(v.streams) > 0 {
+				v.next %= len(v.streams)
+			} else {
+				v.next = 0
+			}
+			break
+		}
+	}
+}
+
+// remove the waiter which is canceled.
+func (v *schedulerClass) remove(waiter *schedulerWaiter) {
+	queue := v.waiters[waiter.stream]
+	for i, w := range queue {
+		if w == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		v.waiters[waiter.stream] = queue
+		return
+	}
+
+	delete(v.waiters, waiter.stream)
+	for i, stream := range v.streams {
+		if stream == waiter.stream {
+			v.streams = append(v.streams[:i], v.streams[i+1:]...)
+			if v.next > i {
+				v.next--
+			}
+			break
+		}
+	}
+	if len(v.streams) > 0 {
+		v.next %= len(v.streams)
+	} else {
+		v.next = 0
+	}
+}
+
+// SchedulerClassStat is the stat of a class.
+type SchedulerClassStat struct {
+	Class   string `json:"class"`
+	Limit   int    `json:"limit"`
+	Running int    `json:"running"`
+	// The number of waiting jobs of each priority class.
+	Waiting map[string]int `json:"waiting"`
+	// The number of waiting jobs of each stream.
+	Streams map[string]int `json:"streams,omitempty"`
+}
+
+// Scheduler limits the concurrency of ffmpeg, detector and ffprobe for all streams, because each stream
+// has its own loops, which overload the box and the AI server when there are many streams.
+type Scheduler struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The classes of jobs.
+	classes map[string]*schedulerClass
+	// The priority classes of streams, loaded from redis.
+	priorities map[string]string
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewScheduler() *Scheduler {
+	limit := func(value string, defaultValue int) int {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		return defaultValue
+	}
+
+	v := &Scheduler{classes: make(map[string]*schedulerClass), priorities: make(map[string]string)}
+	for _, c := range []*schedulerClass{
+		{name: SchedulerClassFFmpeg, limit: limit(envSchedulerFFmpeg(), 4)},
+		{name: SchedulerClassDetector, limit: limit(envSchedulerDetector(), 2)},
+		{name: SchedulerClassFFprobe, limit: limit(envSchedulerFFprobe(), 4)},
+	} {
+		c.waiters = make(map[string][]*schedulerWaiter)
+		v.classes[c.name] = c
+	}
+	return v
+}
+
+func (v *Scheduler) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var limits []string
+	for _, name := range []string{SchedulerClassFFmpeg, SchedulerClassDetector, SchedulerClassFFprobe} {
+		limits = append(limits, fmt.Sprintf("%v=%v", name, v.classes[name].limit))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// Acquire a slot of class for stream, block until granted or ctx is done. The release must be called
+// when the job is done.
+func (v *Scheduler) Acquire(ctx context.Context, class, stream string) (release func(), err error) {
+	v.lock.Lock()
+	c, ok := v.classes[class]
+	if !ok {
+		v.lock.Unlock()
+		return nil, errors.Errorf("invalid class %v", class)
+	}
+
+	waiter := &schedulerWaiter{
+		stream: stream, priority: schedulerPriorityValue(v.priorities[stream]),
+		starttime: time.Now(), ready: make(chan struct{}),
+	}
+	if _, ok := c.waiters[stream]; !ok {
+		c.streams = append(c.streams, stream)
+	}
+	c.waiters[stream] = append(c.waiters[stream], waiter)
+	c.dispatch()
+	v.lock.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			c.running--
+			c.dispatch()
+		})
+	}
+
+	select {
+	case <-waiter.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	// Release the slot if granted when canceled, or remove from waiting jobs.
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if waiter.granted {
+		c.running--
+		c.dispatch()
+	} else {
+		c.remove(waiter)
+	}
+	return nil, errors.Wrapf(ctx.Err(), "acquire %v for %v", class, stream)
+}
+
+// Run the job in a slot of class for stream.
+func (v *Scheduler) Run(ctx context.Context, class, stream string, job func() error) error {
+	release, err := v.Acquire(ctx, class, stream)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return job()
+}
+
+// Stats return the stat of all classes.
+func (v *Scheduler) Stats() []*SchedulerClassStat {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var stats []*SchedulerClassStat
+	for _, name := range []string{SchedulerClassFFmpeg, SchedulerClassDetector, SchedulerClassFFprobe} {
+		c := v.classes[name]
+		stat := &SchedulerClassStat{
+			Class: name, Limit: c.limit, Running: c.running,
+			Waiting: map[string]int{
+				SchedulerPriorityLow: 0, SchedulerPriorityNormal: 0, SchedulerPriorityHigh: 0,
+			},
+			Streams: make(map[string]int),
+		}
+		for stream, queue := range c.waiters {
+			stat.Streams[stream] = len(queue)
+			for _, waiter := range queue {
+				switch waiter.priority {
+				case schedulerPriorityValue(SchedulerPriorityHigh):
+					stat.Waiting[SchedulerPriorityHigh]++
+				case schedulerPriorityValue(SchedulerPriorityLow):
+					stat.Waiting[SchedulerPriorityLow]++
+				default:
+					stat.Waiting[SchedulerPriorityNormal]++
+				}
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// reload the priorities of streams from redis.
+func (v *Scheduler) reload(ctx context.Context) error {
+	priorities, err := rdb.HGetAll(ctx, PROCESS_STREAM_PRIORITY).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", PROCESS_STREAM_PRIORITY)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.priorities = priorities
+	return nil
+}
+
+func (v *Scheduler) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *Scheduler) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "scheduler: start worker, limits are %v", v.String())
+
+	if err := v.reload(ctx); err != nil {
+		return errors.Wrapf(err, "reload priorities")
+	}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(schedulerReloadInterval):
+				if err := v.reload(ctx); err != nil {
+					logger.Wf(ctx, "scheduler: ignore reload err %+v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *Scheduler) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/scheduler/stats"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			v.lock.Lock()
+			priorities := make(map[string]string)
+			for stream, priority := range v.priorities {
+				priorities[stream] = priority
+			}
+			v.lock.Unlock()
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Classes    []*SchedulerClassStat `json:"classes"`
+				Priorities map[string]string     `json:"priorities"`
+			}{
+				Classes: v.Stats(), Priorities: priorities,
+			})
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/scheduler/priorities"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			if err := authenticateAdmin(r); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Format is ?stream=livestream&priority=high, or DELETE ?stream=livestream to reset to normal.
+			q := r.URL.Query()
+			stream, priority := q.Get("stream"), q.Get("priority")
+			if stream == "" {
+				return errors.Errorf("no stream")
+			}
+
+			if r.Method == http.MethodDelete {
+				if err := rdb.HDel(ctx, PROCESS_STREAM_PRIORITY, stream).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", PROCESS_STREAM_PRIORITY, stream)
+				}
+			} else if r.Method == http.MethodPost {
+				if priority != SchedulerPriorityLow && priority != SchedulerPriorityNormal && priority != SchedulerPriorityHigh {
+					return errors.Errorf("invalid priority %v", priority)
+				}
+				if err := rdb.HSet(ctx, PROCESS_STREAM_PRIORITY, stream, priority).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", PROCESS_STREAM_PRIORITY, stream, priority)
+				}
+			} else {
+				return errors.Errorf("invalid method %v", r.Method)
+			}
+
+			if err := v.reload(ctx); err != nil {
+				return errors.Wrapf(err, "reload priorities")
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "scheduler: update priority of %v to %v by %v", stream, priority, r.Method)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+// writeSchedulerMetrics write the running and waiting jobs of classes, which are collected when scraping.
+func writeSchedulerMetrics(sb *strings.Builder) {
+	running, waiting := "streaming_scheduler_running", "streaming_scheduler_waiting"
+	sb.WriteString(fmt.Sprintf("# HELP %v The number of running jobs of class.\n# TYPE %v gauge\n", running, running))
+	stats := scheduler.Stats()
+	for _, stat := range stats {
+		sb.WriteString(metricSample(running, metricLabels("class", stat.Class), float64(stat.Running)))
+	}
+
+	sb.WriteString(fmt.Sprintf("# HELP %v The number of waiting jobs of class by priority.\n# TYPE %v gauge\n", waiting, waiting))
+	for _, stat := range stats {
+		var priorities []string
+		for priority := range stat.Waiting {
+			priorities = append(priorities, priority)
+		}
+		sort.Strings(priorities)
+
+		for _, priority := range priorities {
+			labels := metricLabels("class", stat.Class, "priority", priority)
+			sb.WriteString(metricSample(waiting, labels, float64(stat.Waiting[priority])))
+		}
+	}
+}
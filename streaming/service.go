@@ -49,6 +49,7 @@ func (v *httpService) Run(ctx context.Context) error {
 	}()
 
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	handler := http.NewServeMux()
 	if true {
@@ -196,6 +197,30 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 	if err := accidentWorker.Handle(ctx, handler); err != nil {
 		return errors.Wrapf(err, "handle accidents")
 	}
+	if err := categoryRegistry.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle categories")
+	}
+	if err := eventHub.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle events")
+	}
+	if err := janitorWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle janitor")
+	}
+	if err := outboxWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle outbox")
+	}
+	if err := reconcileWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle reconcile")
+	}
+	if err := scheduler.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle scheduler")
+	}
+	if err := handlePlaybackService(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle playback")
+	}
+	if err := handleMetricsService(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle metrics")
+	}
 
 	var ep string
 
@@ -0,0 +1,105 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The max level of load shedding. At level N, only 1 of every 2^N segments is analysed, with 1/2^N frames.
+const loadShedMaxLevel = 3
+
+// The reasons why a segment is skipped, not analysed.
+const (
+	// The segment waits longer than the latency budget.
+	SkipReasonStale = "stale"
+	// The segment is skipped by the stride, to lower the sampling rate.
+	SkipReasonStride = "stride"
+)
+
+// loadShedBudget return the latency budget of stream, by detector config or PROCESS_LATENCY_BUDGET, zero
+// to disable load shedding.
+func loadShedBudget(c *DetectorConfig) time.Duration {
+	if c != nil && c.Budget > 0 {
+		return time.Duration(c.Budget * float64(time.Second))
+	}
+	if f, err := strconv.ParseFloat(envProcessLatencyBudget(), 64); err == nil && f > 0 {
+		return time.Duration(f * float64(time.Second))
+	}
+	return 0
+}
+
+// LoadShedder decides whether to analyse a segment of stream, by the latency budget. Under backlog, it skips
+// the stale segments, and lowers the sampling rate level by level. When the backlog clears, it recovers level
+// by level too.
+type LoadShedder struct {
+	// The level of shedding, 0 is normal.
+	level int
+	// The number of segments skipped by stride since the last analysed.
+	strided int
+	// The lag of the last segment.
+	lag time.Duration
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewLoadShedder() *LoadShedder {
+	return &LoadShedder{}
+}
+
+func (v *LoadShedder) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return fmt.Sprintf("level=%v, strided=%v, lag=%v", v.level, v.strided, v.lag)
+}
+
+// Level return the current level and the lag of the last segment.
+func (v *LoadShedder) Level() (int, time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.level, v.lag
+}
+
+// Decide whether to analyse the segment which waits for lag, and whether there is backlog, that is, the
+// detect queue is full. Return the reason if skipped, and the number of frames to sample if analysed.
+func (v *LoadShedder) Decide(lag, budget time.Duration, backlog bool, frames int) (skip string, n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.lag = lag
+	if budget <= 0 {
+		v.level, v.strided = 0, 0
+		return "", frames
+	}
+
+	// Raise the level if lag is over half of budget, and lower it if lag is under a quarter.
+	if lag > budget/2 || backlog {
+		if v.level < loadShedMaxLevel {
+			v.level++
+		}
+	} else if lag < budget/4 && v.level > 0 {
+		v.level--
+	}
+
+	// The segment is stale, it's useless to detect it.
+	if lag > budget {
+		return SkipReasonStale, 0
+	}
+
+	// Analyse 1 of every 2^level segments.
+	if v.strided < (1<<v.level)-1 {
+		v.strided++
+		return SkipReasonStride, 0
+	}
+	v.strided = 0
+
+	if n = frames >> v.level; n < 1 {
+		n = 1
+	}
+	return "", n
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadShedderDecide(t *testing.T) {
+	// The step decides a segment of lag, with 8 frames, under the budget of 10s.
+	type step struct {
+		lag     time.Duration
+		backlog bool
+		skip    string
+		frames  int
+		level   int
+	}
+
+	for _, c := range []struct {
+		name   string
+		budget time.Duration
+		steps  []step
+	}{
+		{
+			name: "disabled", budget: 0,
+			steps: []step{
+				{lag: time.Hour, backlog: true, frames: 8},
+				{lag: time.Hour, frames: 8},
+			},
+		},
+		{
+			name: "normal", budget: 10 * time.Second,
+			steps: []step{
+				{lag: time.Second, frames: 8},
+				{lag: 4 * time.Second, frames: 8},
+				{lag: 5 * time.Second, frames: 8},
+			},
+		},
+		{
+			name: "stale", budget: 10 * time.Second,
+			steps: []step{
+				{lag: 11 * time.Second, skip: SkipReasonStale, level: 1},
+				{lag: 20 * time.Second, skip: SkipReasonStale, level: 2},
+			},
+		},
+		{
+			name: "escalate by lag", budget: 10 * time.Second,
+			steps: []step{
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 1},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 2},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 3},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 3},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 3},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 3},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 3},
+				{lag: 6 * time.Second, frames: 1, level: 3},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 3},
+			},
+		},
+		{
+			name: "escalate by backlog", budget: 10 * time.Second,
+			steps: []step{
+				{lag: time.Second, backlog: true, skip: SkipReasonStride, level: 1},
+				{lag: time.Second, frames: 8},
+			},
+		},
+		{
+			name: "recover level by level", budget: 10 * time.Second,
+			steps: []step{
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 1},
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 2},
+				{lag: time.Second, frames: 4, level: 1},
+				{lag: time.Second, frames: 8},
+				{lag: time.Second, frames: 8},
+			},
+		},
+		{
+			name: "hold level", budget: 10 * time.Second,
+			steps: []step{
+				{lag: 6 * time.Second, skip: SkipReasonStride, level: 1},
+				{lag: 3 * time.Second, frames: 4, level: 1},
+				{lag: 3 * time.Second, skip: SkipReasonStride, level: 1},
+				{lag: 3 * time.Second, frames: 4, level: 1},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			shedder := NewLoadShedder()
+			for i, s := range c.steps {
+				skip, frames := shedder.Decide(s.lag, c.budget, s.backlog, 8)
+				level, lag := shedder.Level()
+				if skip != s.skip || frames != s.frames || level != s.level || lag != s.lag {
+					t.Fatalf("step %v: expect skip=%v, frames=%v, level=%v, lag=%v, got skip=%v, frames=%v, level=%v, lag=%v",
+						i, s.skip, s.frames, s.level, s.lag, skip, frames, level, lag)
+				}
+			}
+		})
+	}
+}
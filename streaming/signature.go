@@ -0,0 +1,209 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// The max skew of signature timestamp, the request out of window is rejected as replay.
+const signatureWindow = 5 * time.Minute
+
+// The headers of signature, for both SRS hooks and callbacks to API server.
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+)
+
+// The secrets to verify SRS hooks and sign callbacks, resolved by initSignatureSecrets.
+var hookSecret, callbackSecret string
+
+// The placeholder of hook secret in the shipped SRS config, which is never accepted.
+const hookSecretPlaceholder = "CHANGE_ME"
+
+// initSignatureSecrets resolve the secrets of hooks and callbacks, and refuse to start without secret, to
+// never accept unsigned hooks or send unsigned callbacks. The SRS_HOOK_SECRET defaults to the publish secret
+// in SRS_AUTH_SECRET, then API_SECRET. The CALLBACK_SECRET defaults to API_SECRET.
+func initSignatureSecrets(ctx context.Context) error {
+	if hookSecret = envSrsHookSecret(); hookSecret == "" {
+		secret, err := rdb.HGet(ctx, SRS_AUTH_SECRET, "pubSecret").Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hget %v pubSecret", SRS_AUTH_SECRET)
+		}
+		if hookSecret = secret; hookSecret == "" {
+			hookSecret = envApiSecret()
+		}
+	}
+	if hookSecret == "" {
+		return errors.Errorf("no secret for hooks, please set SRS_HOOK_SECRET or API_SECRET")
+	}
+	if hookSecret == hookSecretPlaceholder {
+		return errors.Errorf("the secret for hooks is %v of SRS config, please change it", hookSecretPlaceholder)
+	}
+
+	if callbackSecret = envCallbackSecret(); callbackSecret == "" {
+		callbackSecret = envApiSecret()
+	}
+	if callbackSecret == "" {
+		return errors.Errorf("no secret for callbacks, please set CALLBACK_SECRET or API_SECRET")
+	}
+	return nil
+}
+
+// The nonces of hooks in window, to reject the replayed request.
+var hookNonces = &nonceCache{nonces: make(map[string]time.Time)}
+
+// nonceCache remembers the nonces in window.
+type nonceCache struct {
+	nonces map[string]time.Time
+	lock   sync.Mutex
+}
+
+// use the nonce, return false if already used in window.
+func (v *nonceCache) use(nonce string, now time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for k, t := range v.nonces {
+		if now.Sub(t) > 2*signatureWindow {
+			delete(v.nonces, k)
+		}
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return false
+	}
+	v.nonces[nonce] = now
+	return true
+}
+
+// signPayload return the HMAC-SHA256 of timestamp, nonce and body, in hex.
+func signPayload(secret, timestamp, nonce string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(fmt.Sprintf("%v.%v.", timestamp, nonce)))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signCallback sign the request to API server by the callback secret, error if no secret. The API server
+// should verify the signature, reject the timestamp out of window, and reject the nonce already used.
+func signCallback(req *http.Request, body []byte) error {
+	secret := callbackSecret
+	if secret == "" {
+		return errors.Errorf("no secret to sign %v", req.URL.Path)
+	}
+
+	timestamp, nonce := fmt.Sprint(time.Now().Unix()), uuid.NewString()
+	req.Header.Set(signatureTimestampHeader, timestamp)
+	req.Header.Set(signatureNonceHeader, nonce)
+	req.Header.Set(signatureHeader, fmt.Sprintf("sha256=%v", signPayload(secret, timestamp, nonce, body)))
+	return nil
+}
+
+// verifyHook verify the SRS hook by the hook secret, reject if no secret. Because SRS is not able to sign the
+// request, the secret is carried by the query of hook url, such as /hooks/srs/hls?secret=xxx, or by the bearer
+// token. A proxy in front of SRS is also able to sign the request by HMAC, like the callbacks to API server.
+func verifyHook(r *http.Request, body []byte) error {
+	secret := hookSecret
+	if secret == "" {
+		return errors.Errorf("no secret to verify %v", r.URL.Path)
+	}
+
+	if signature := r.Header.Get(signatureHeader); signature != "" {
+		timestamp, nonce := r.Header.Get(signatureTimestampHeader), r.Header.Get(signatureNonceHeader)
+		if nonce == "" {
+			return errors.Errorf("no nonce for %v", r.URL.Path)
+		}
+
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timestamp %v for %v", timestamp, r.URL.Path)
+		}
+		now := time.Now()
+		if skew := now.Sub(time.Unix(ts, 0)); skew > signatureWindow || skew < -signatureWindow {
+			return errors.Errorf("expired timestamp %v for %v", timestamp, r.URL.Path)
+		}
+
+		expect := fmt.Sprintf("sha256=%v", signPayload(secret, timestamp, nonce, body))
+		if !hmac.Equal([]byte(signature), []byte(expect)) {
+			return errors.Errorf("invalid signature for %v", r.URL.Path)
+		}
+
+		if !hookNonces.use(nonce, now) {
+			return errors.Errorf("replayed nonce %v for %v", nonce, r.URL.Path)
+		}
+		return nil
+	}
+
+	token := r.URL.Query().Get("secret")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.Errorf("invalid secret for %v", r.URL.Path)
+	}
+	return nil
+}
+
+// srsHlsRoot return the root directory of SRS HLS files, by SRS_HLS_ROOT or the default html directory.
+func srsHlsRoot() string {
+	if root := envSrsHlsRoot(); root != "" {
+		return root
+	}
+	return path.Join(conf.Pwd, "containers/objs/nginx/html")
+}
+
+// verifyHlsFile verify the ts file of on_hls is a regular file in the SRS HLS root, to never read arbitrary
+// files. The symbolic links are resolved, because the root might be a link. Return the resolved file, which
+// should be opened instead of the file, because the link might be changed after verified.
+func verifyHlsFile(file string) (string, error) {
+	if path.Ext(file) != ".ts" {
+		return "", errors.Errorf("invalid ext of %v", file)
+	}
+
+	root, err := filepath.EvalSymlinks(srsHlsRoot())
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve root %v", srsHlsRoot())
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return "", errors.Wrapf(err, "abs root %v", root)
+	}
+
+	target, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve file %v", file)
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return "", errors.Wrapf(err, "abs file %v", target)
+	}
+
+	if rel, err := filepath.Rel(root, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Errorf("file %v not in root %v", file, root)
+	}
+
+	if stats, err := os.Stat(target); err != nil {
+		return "", errors.Wrapf(err, "stat %v", target)
+	} else if !stats.Mode().IsRegular() {
+		return "", errors.Errorf("file %v is not regular", file)
+	}
+	return target, nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The snapshot files of accident, in the directory accident/{uuid}.
+const (
+	// The frame which triggers the accident.
+	accidentSnapshot = "snapshot.jpg"
+	// The frame with the max score during the accident.
+	accidentBestSnapshot = "best.jpg"
+)
+
+// The colors of boxes, by category, same to annotateColors.
+var snapshotColors = []color.RGBA{
+	{R: 255, A: 255}, {R: 255, G: 255, A: 255}, {G: 255, A: 255}, {G: 255, B: 255, A: 255},
+	{R: 255, B: 255, A: 255}, {R: 255, G: 165, A: 255}, {R: 255, G: 255, B: 255, A: 255}, {B: 255, A: 255},
+}
+
+// AccidentImage is a frame of accident, and the boxes to draw on it.
+type AccidentImage struct {
+	// The image file of frame.
+	ImageFile *TsFile `json:"image,omitempty"`
+	// The boxes of accident category in frame.
+	Boxes []ProcessDetectResult `json:"boxes,omitempty"`
+	// The max score of boxes.
+	Score float64 `json:"score,omitempty"`
+}
+
+func (v *AccidentImage) String() string {
+	return fmt.Sprintf("image=%v, boxes=%v, score=%v", v.ImageFile.File, len(v.Boxes), v.Score)
+}
+
+// newAccidentImage find the frame of the detection in segment, with the boxes of category.
+func newAccidentImage(segment *ProcessSegment, result *ProcessDetectResult) *AccidentImage {
+	if result == nil {
+		return nil
+	}
+
+	for _, frame := range segment.Frames {
+		if frame.Offset != result.Offset || frame.ImageFile == nil {
+			continue
+		}
+
+		v := &AccidentImage{ImageFile: frame.ImageFile, Score: result.Score}
+		for _, box := range frame.BoundingBox {
+			if box.Category == result.Category {
+				v.Boxes = append(v.Boxes, box)
+			}
+		}
+		return v
+	}
+
+	// The segment restored from previous version has no frames.
+	if segment.ImageFile != nil {
+		return &AccidentImage{ImageFile: segment.ImageFile, Boxes: []ProcessDetectResult{*result}, Score: result.Score}
+	}
+	return nil
+}
+
+// copyAccidentImage copy the image to accident directory, because the image of segment is disposed soon.
+func copyAccidentImage(ctx context.Context, snapshot *AccidentImage) (*AccidentImage, error) {
+	if snapshot == nil {
+		return nil, nil
+	}
+
+	imageFile := &TsFile{
+		TsID:     uuid.NewString(),
+		URL:      snapshot.ImageFile.URL,
+		SeqNo:    snapshot.ImageFile.SeqNo,
+		Duration: snapshot.ImageFile.Duration,
+		Size:     snapshot.ImageFile.Size,
+	}
+	imageFile.File = path.Join("accident", fmt.Sprintf("%v.jpg", imageFile.TsID))
+
+	if err := exec.CommandContext(ctx, "cp", "-f", snapshot.ImageFile.File, imageFile.File).Run(); err != nil {
+		return nil, errors.Wrapf(err, "copy file %v to %v", snapshot.ImageFile.File, imageFile.File)
+	}
+
+	return &AccidentImage{ImageFile: imageFile, Boxes: snapshot.Boxes, Score: snapshot.Score}, nil
+}
+
+// drawSnapshot draw the boxes on image, and save to file. The box is in 640x640, which is scaled to the
+// size of image.
+func drawSnapshot(snapshot *AccidentImage, file string) error {
+	f, err := os.Open(snapshot.ImageFile.File)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", snapshot.ImageFile.File)
+	}
+	defer f.Close()
+
+	src, err := jpeg.Decode(f)
+	if err != nil {
+		return errors.Wrapf(err, "decode %v", snapshot.ImageFile.File)
+	}
+
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
+
+	sx := float64(bounds.Dx()) / detectImageSize
+	sy := float64(bounds.Dy()) / detectImageSize
+	for _, box := range snapshot.Boxes {
+		if len(box.BBox) < 4 {
+			continue
+		}
+
+		rect := image.Rect(
+			bounds.Min.X+int(box.BBox[0]*sx), bounds.Min.Y+int(box.BBox[1]*sy),
+			bounds.Min.X+int((box.BBox[0]+box.BBox[2])*sx), bounds.Min.Y+int((box.BBox[1]+box.BBox[3])*sy),
+		).Intersect(bounds)
+		drawRect(dst, rect, snapshotColors[box.Category%len(snapshotColors)], 4)
+	}
+
+	// Write to a temporary file then rename, to never serve a partial file.
+	tmpFile := fmt.Sprintf("%v.%v.tmp", file, uuid.NewString())
+	if err := func() error {
+		w, err := os.Create(tmpFile)
+		if err != nil {
+			return errors.Wrapf(err, "create %v", tmpFile)
+		}
+		defer w.Close()
+
+		if err := jpeg.Encode(w, dst, &jpeg.Options{Quality: 85}); err != nil {
+			return errors.Wrapf(err, "encode %v", tmpFile)
+		}
+		return nil
+	}(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return errors.Wrapf(err, "rename %v to %v", tmpFile, file)
+	}
+	return nil
+}
+
+// drawRect draw the border of rect, in thickness pixels inside the rect.
+func drawRect(dst *image.RGBA, rect image.Rectangle, c color.RGBA, thickness int) {
+	if rect.Empty() {
+		return
+	}
+
+	uniform := image.NewUniform(c)
+	for i := 0; i < thickness && rect.Dx() > 2*i && rect.Dy() > 2*i; i++ {
+		x0, y0, x1, y1 := rect.Min.X+i, rect.Min.Y+i, rect.Max.X-i, rect.Max.Y-i
+		draw.Draw(dst, image.Rect(x0, y0, x1, y0+1), uniform, image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rect(x0, y1-1, x1, y1), uniform, image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rect(x0, y0, x0+1, y1), uniform, image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rect(x1-1, y0, x1, y1), uniform, image.Point{}, draw.Src)
+	}
+}
+
+// snapshotURL return the url of snapshot for accident, use PUBLIC_URL if set, signed by playback token if
+// enabled.
+func snapshotURL(uuid, name string) (string, error) {
+	prefix := fmt.Sprintf("/accident/hls/%v/", uuid)
+	return signedURL(unsignedSnapshotURL(uuid, name), prefix)
+}
+
+// unsignedSnapshotURL return the url of snapshot without playback token, for the message which might be
+// delivered after any token expires, and the receiver should mint the token by /playback/tokens?uuid=xxx.
+func unsignedSnapshotURL(uuid, name string) string {
+	return fmt.Sprintf("%v/accident/hls/%v/%v", strings.TrimSuffix(envPublicUrl(), "/"), uuid, name)
+}
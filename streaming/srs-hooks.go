@@ -7,9 +7,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
@@ -52,6 +53,9 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 		}
 	
 		req.Header.Set("Content-Type", "application/json")
+		if err := signCallback(req, b); err != nil {
+			return errors.Wrapf(err, "sign")
+		}
 	
 		var res *http.Response
 		res, err = http.DefaultClient.Do(req)
@@ -76,6 +80,9 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 			if err != nil {
 				return errors.Wrapf(err, "read body")
 			}
+			if err := verifyHook(r, b); err != nil {
+				return errors.Wrapf(err, "verify hook")
+			}
 			// requestBody := string(b)
 
 			var action SrsAction
@@ -90,7 +97,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 			}
 
 			if action == SrsActionOnPublish {
-				if err := pf("http://127.0.0.1:5000/stream/verify", &struct {
+				if err := pf(fmt.Sprintf("%v/stream/verify", strings.TrimSuffix(envApiBaseUrl(), "/")), &struct {
 					StreamKey string `json:"streamKey"`
 				}{
 					StreamKey: streamObj.Stream,
@@ -108,27 +115,17 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				} else if err = rdb.HSet(ctx, SRS_STREAM_ACTIVE, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
 					return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_ACTIVE, streamURL, string(b))
 				}
+				detectWorker.OnStreamPublished(ctx, streamObj.Stream)
 
-				if err := rdb.HIncrBy(ctx, SRS_STAT_COUNTER, "publish", 1).Err(); err != nil && err != redis.Nil {
-					return errors.Wrapf(err, "hincrby %v publish 1", SRS_STAT_COUNTER)
-				}
 			} else if action == SrsActionOnUnpublish {
-				if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, streamURL).Err(); err != nil && err != redis.Nil {
-					return errors.Wrapf(err, "hset %v %v", SRS_STREAM_ACTIVE, streamURL)
-				}
-
-				if err := pf("http://127.0.0.1:5000/stream/end", &struct {
-					StreamKey string `json:"streamKey"`
-				}{
-					StreamKey: streamObj.Stream,
-				}); err != nil {
+				if err := endStream(ctx, &streamObj); err != nil {
 					return errors.Wrapf(err, "unpublish with %s", streamObj.Stream)
 				}
-			} else if action == "on_play" {
-				if err := rdb.HIncrBy(ctx, SRS_STAT_COUNTER, "play", 1).Err(); err != nil && err != redis.Nil {
-					return errors.Wrapf(err, "hincrby %v play 1", SRS_STAT_COUNTER)
-				}
+
+				// Tear down the worker asynchronously, and a fresh one is created when republish.
+				detectWorker.OnStreamUnpublished(ctx, &streamObj)
 			}
+			metricHookEvents.Inc(metricLabels("action", string(action)))
 
 			ohttp.WriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "srs hooks ok, action=%v, %v",
@@ -146,7 +143,6 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 }
 
 func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
-	// TODO: FIXME: Fixed token.
 	// See https://github.com/ossrs/srs/wiki/v4_EN_HTTPCallback
 	ep := "/hooks/srs/hls"
 	logger.Tf(ctx, "Handle %v", ep)
@@ -156,6 +152,9 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 			if err != nil {
 				return errors.Wrapf(err, "read body")
 			}
+			if err := verifyHook(r, b); err != nil {
+				return errors.Wrapf(err, "verify hook")
+			}
 
 			var msg SrsOnHlsMessage
 			if err := json.Unmarshal(b, &msg); err != nil {
@@ -164,10 +163,12 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 			if msg.Action != SrsActionOnHls {
 				return errors.Errorf("invalid action=%v", msg.Action)
 			}
-			if _, err := os.Stat(msg.File); err != nil {
-				logger.Ef(ctx, conf.Pwd)
+			if file, err := verifyHlsFile(msg.File); err != nil {
 				return errors.Wrapf(err, "invalid ts file %v", msg.File)
+			} else {
+				msg.File = file
 			}
+			metricHookEvents.Inc(metricLabels("action", string(msg.Action)))
 			logger.Tf(ctx, "on_hls ok, %v", string(b))
 
 			// Handle TS file by Record task if enabled.
@@ -192,4 +193,44 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 	// }
 
 	return nil
-}
\ No newline at end of file
+}
+
+// endStream remove the stream from SRS_STREAM_ACTIVE, and notify the API server by outbox, which retries
+// until the API server is available.
+func endStream(ctx context.Context, stream *SrsStream) error {
+	streamURL := stream.StreamURL()
+	if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, streamURL).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_STREAM_ACTIVE, streamURL)
+	}
+
+	msg, err := NewOutboxMessage(OutboxTypeStreamEnd, "/stream/end", &struct {
+		StreamKey string `json:"streamKey"`
+	}{
+		StreamKey: stream.Stream,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "create message of %v", stream.Stream)
+	}
+	if err := outboxWorker.Enqueue(ctx, msg); err != nil {
+		return errors.Wrapf(err, "enqueue %v", msg.String())
+	}
+	return nil
+}
+
+// queryActiveStreams load the active streams from redis, the key is the stream name.
+func queryActiveStreams(ctx context.Context) (map[string]*SrsStream, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	streams := make(map[string]*SrsStream)
+	for streamURL, obj := range objs {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(obj), &stream); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", streamURL, obj)
+		}
+		streams[stream.Stream] = &stream
+	}
+	return streams, nil
+}
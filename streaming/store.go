@@ -0,0 +1,289 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var segmentStore *SegmentStore
+
+// SegmentStore is a content-addressed store of TS files, shared by the process tasks and accidents, so each
+// segment of SRS is ingested only once. The file is named by the SHA256 of content, and the references are
+// counted in redis, so the file is removed only when no one holds it. The references are rebuilt from the
+// holders when restart, see Rebuild.
+type SegmentStore struct {
+	// The directory of files, such as segment.
+	dir string
+	// To serialize the reference counting and file removing, to avoid removing the file which is acquired.
+	lock sync.Mutex
+}
+
+func NewSegmentStore() *SegmentStore {
+	return &SegmentStore{dir: "segment"}
+}
+
+// Rebuild the references from the holders saved in redis, that is the process tasks, the working accidents
+// and the artifacts. The references held in memory, such as the pre-roll ring and the queued messages, are
+// lost when restart, so they are dropped, to allow the files to be swept. Must be called before any worker
+// is started, because the holders might acquire or release files.
+func (v *SegmentStore) Rebuild(ctx context.Context) error {
+	refs := make(map[string]int64)
+	holds := func(files ...string) {
+		for _, file := range files {
+			if v.contains(file) {
+				refs[path.Base(file)]++
+			}
+		}
+	}
+
+	tasks, err := rdb.HGetAll(ctx, PROCESS_TASK).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", PROCESS_TASK)
+	}
+	for taskUUID, obj := range tasks {
+		task := NewProcessTask()
+		if err := json.Unmarshal([]byte(obj), task); err != nil {
+			logger.Wf(ctx, "store: ignore invalid task %v %v err %+v", taskUUID, obj, err)
+			continue
+		}
+		holds(task.files()...)
+	}
+
+	objs, err := rdb.HGetAll(ctx, SRS_ACCIDENT_M3U8_WORKING).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_ACCIDENT_M3U8_WORKING)
+	}
+	for m3u8URL, obj := range objs {
+		m3u8LocalObj := &AccidentM3u8Stream{}
+		if err := json.Unmarshal([]byte(obj), m3u8LocalObj); err != nil {
+			logger.Wf(ctx, "store: ignore invalid object %v %v err %+v", m3u8URL, obj, err)
+			continue
+		}
+		holds(m3u8LocalObj.files()...)
+	}
+
+	artifacts, err := queryArtifacts(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query artifacts")
+	}
+	for _, artifact := range artifacts {
+		for _, tsFile := range artifact.Files {
+			holds(tsFile.Key)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	previous, err := rdb.HGetAll(ctx, SEGMENT_STORE_REFS).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SEGMENT_STORE_REFS)
+	}
+
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, SEGMENT_STORE_REFS)
+		for name, n := range refs {
+			pipe.HSet(ctx, SEGMENT_STORE_REFS, name, n)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "save %v", SEGMENT_STORE_REFS)
+	}
+
+	var changed int
+	for name, n := range previous {
+		if fmt.Sprint(refs[name]) != n {
+			changed++
+		}
+	}
+	logger.Tf(ctx, "store: rebuild references of %v files, previous %v files, %v changed",
+		len(refs), len(previous), changed)
+	return nil
+}
+
+// contains whether the file is in store.
+func (v *SegmentStore) contains(file string) bool {
+	return path.Dir(file) == v.dir && path.Ext(file) == ".ts"
+}
+
+// Acquire a reference of the TS file, and ingest it to store by hardlink or copy if not in store. Return the
+// file in store, which should be released by Release.
+func (v *SegmentStore) Acquire(ctx context.Context, src string) (string, error) {
+	file := src
+	if !v.contains(src) {
+		hash, err := hashFile(src)
+		if err != nil {
+			return "", errors.Wrapf(err, "hash %v", src)
+		}
+		file = path.Join(v.dir, fmt.Sprintf("%v.ts", hash))
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, err := os.Stat(file); err != nil && os.IsNotExist(err) {
+		if file == src {
+			return "", errors.Errorf("no file %v in store", file)
+		}
+		if err := v.ingest(src, file); err != nil {
+			return "", errors.Wrapf(err, "ingest %v to %v", src, file)
+		}
+	} else if err != nil {
+		return "", errors.Wrapf(err, "stat %v", file)
+	}
+
+	if err := rdb.HIncrBy(ctx, SEGMENT_STORE_REFS, path.Base(file), 1).Err(); err != nil {
+		return "", errors.Wrapf(err, "hincrby %v %v", SEGMENT_STORE_REFS, path.Base(file))
+	}
+	return file, nil
+}
+
+// ingest the src to file by hardlink, or copy it if not in the same filesystem. Note that SRS never modifies
+// the TS file in place, so it's safe to hardlink it.
+func (v *SegmentStore) ingest(src, file string) error {
+	if err := os.Link(src, file); err == nil {
+		return nil
+	}
+
+	r, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", src)
+	}
+	defer r.Close()
+
+	tmp := fmt.Sprintf("%v.tmp", file)
+	w, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "create %v", tmp)
+	}
+	defer os.Remove(tmp)
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return errors.Wrapf(err, "copy %v to %v", src, tmp)
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "close %v", tmp)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", tmp, file)
+	}
+	return nil
+}
+
+// Release a reference of the file, and remove it if no one holds it. The file not in store, such as the
+// file copied by previous version, is removed directly.
+func (v *SegmentStore) Release(ctx context.Context, file string) error {
+	if !v.contains(file) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove %v", file)
+		}
+		return nil
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	refs, err := rdb.HIncrBy(ctx, SEGMENT_STORE_REFS, path.Base(file), -1).Result()
+	if err != nil {
+		return errors.Wrapf(err, "hincrby %v %v", SEGMENT_STORE_REFS, path.Base(file))
+	}
+	if refs > 0 {
+		return nil
+	}
+
+	if err := rdb.HDel(ctx, SEGMENT_STORE_REFS, path.Base(file)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SEGMENT_STORE_REFS, path.Base(file))
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %v", file)
+	}
+	return nil
+}
+
+// sweep remove the files held by no one, which are leaked if crashed before released, and the references
+// of files which do not exist. Never remove the file younger than grace, which might be ingesting.
+func (v *SegmentStore) sweep(ctx context.Context, grace time.Duration) (*JanitorDirReport, error) {
+	report := &JanitorDirReport{Dir: v.dir}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	refs, err := rdb.HGetAll(ctx, SEGMENT_STORE_REFS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SEGMENT_STORE_REFS)
+	}
+
+	// Note that the directory might be a symbolic link, so we read it with a slash.
+	entries, err := os.ReadDir(v.dir + "/")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read %v", v.dir)
+	}
+
+	now, files := time.Now(), make(map[string]bool)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+
+		files[entry.Name()] = true
+		report.Files++
+		report.Bytes += info.Size()
+		if n, err := strconv.ParseInt(refs[entry.Name()], 10, 64); err == nil && n > 0 {
+			report.Protected++
+			continue
+		}
+		if now.Sub(info.ModTime()) < grace {
+			continue
+		}
+
+		if err := os.Remove(path.Join(v.dir, entry.Name())); err == nil {
+			report.Removed++
+			report.Reclaimed += info.Size()
+		}
+	}
+
+	for name := range refs {
+		if files[name] {
+			continue
+		}
+		if err := rdb.HDel(ctx, SEGMENT_STORE_REFS, name).Err(); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "hdel %v %v", SEGMENT_STORE_REFS, name)
+		}
+		logger.Tf(ctx, "store: drop references of lost file %v, refs=%v", name, refs[name])
+	}
+
+	return report, nil
+}
+
+// hashFile return the SHA256 of file content in hex.
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %v", file)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "read %v", file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSegmentStoreRebuild(t *testing.T) {
+	ctx := context.Background()
+	newFakeRedis(t)
+
+	// The process task holds a.ts and b.ts, and an image which is not in store.
+	task := NewProcessTask()
+	task.LiveQueue.Segments = []*ProcessSegment{{TsFile: &TsFile{File: "segment/a.ts"}}}
+	task.DetectQueue.Segments = []*ProcessSegment{{
+		TsFile: &TsFile{File: "segment/b.ts"}, ImageFile: &TsFile{File: "process/b.jpg"},
+	}}
+
+	// The working accident holds b.ts, and the file copied by previous version.
+	m3u8LocalObj := &AccidentM3u8Stream{UUID: "accident", Messages: []*AccidentSegment{
+		{TsFile: &TsFile{File: "segment/b.ts"}}, {TsFile: &TsFile{File: "accident/old.ts"}},
+	}}
+
+	// The artifact holds b.ts and c.ts, no matter processing or not.
+	artifact := &M3u8VoDArtifact{UUID: "artifact", Files: []*TsFile{
+		{Key: "segment/b.ts"}, {Key: "segment/c.ts"},
+	}}
+
+	for key, obj := range map[string]map[string]interface{}{
+		PROCESS_TASK:               {task.UUID: task},
+		SRS_ACCIDENT_M3U8_WORKING:  {"livestream/1": m3u8LocalObj},
+		SRS_ACCIDENT_M3U8_ARTIFACT: {artifact.UUID: artifact},
+	} {
+		for field, value := range obj {
+			b, err := json.Marshal(value)
+			if err != nil {
+				t.Fatalf("marshal %v err %+v", field, err)
+			}
+			if err := rdb.HSet(ctx, key, field, string(b)).Err(); err != nil {
+				t.Fatalf("hset %v %v err %+v", key, field, err)
+			}
+		}
+	}
+
+	// The references held in memory before restart, such as the pre-roll ring, are dropped.
+	for name, n := range map[string]int64{"a.ts": 3, "b.ts": 1, "d.ts": 2} {
+		if err := rdb.HIncrBy(ctx, SEGMENT_STORE_REFS, name, n).Err(); err != nil {
+			t.Fatalf("hincrby %v err %+v", name, err)
+		}
+	}
+
+	store := NewSegmentStore()
+	if err := store.Rebuild(ctx); err != nil {
+		t.Fatalf("rebuild err %+v", err)
+	}
+
+	refs, err := rdb.HGetAll(ctx, SEGMENT_STORE_REFS).Result()
+	if err != nil {
+		t.Fatalf("hgetall err %+v", err)
+	}
+	if expect := map[string]string{"a.ts": "1", "b.ts": "3", "c.ts": "1"}; !reflect.DeepEqual(refs, expect) {
+		t.Errorf("expect %v, got %v", expect, refs)
+	}
+}
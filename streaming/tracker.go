@@ -0,0 +1,178 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// AccidentPolicy is the policy to confirm and end an accident of a category.
+type AccidentPolicy struct {
+	// Confirm the accident when detected in at least Hits segments of the latest Window segments.
+	Hits   int
+	Window int
+	// The minimum score of a detection, ignore the detection with lower score.
+	MinScore float64
+	// End the accident when not detected for a quiet period.
+	Quiet time.Duration
+	// The duration in seconds of segments before the first detection, to prepend to accident.
+	Preroll float64
+	// The duration in seconds of segments after the last detection, to append to accident.
+	Postroll float64
+}
+
+func (v *AccidentPolicy) String() string {
+	return fmt.Sprintf("hits=%v, window=%v, score=%v, quiet=%v, preroll=%v, postroll=%v",
+		v.Hits, v.Window, v.MinScore, v.Quiet, v.Preroll, v.Postroll,
+	)
+}
+
+// NewAccidentPolicy create the policy from env.
+func NewAccidentPolicy() *AccidentPolicy {
+	v := &AccidentPolicy{Hits: 2, Window: 3, MinScore: 0.5, Quiet: 30 * time.Second, Preroll: 10, Postroll: 10}
+	if n, err := strconv.Atoi(envAccidentConfirmHits()); err == nil && n > 0 {
+		v.Hits = n
+	}
+	if n, err := strconv.Atoi(envAccidentConfirmWindow()); err == nil && n > 0 {
+		v.Window = n
+	}
+	if v.Window < v.Hits {
+		v.Window = v.Hits
+	}
+	if f, err := strconv.ParseFloat(envAccidentMinScore(), 64); err == nil && f >= 0 {
+		v.MinScore = f
+	}
+	if f, err := strconv.ParseFloat(envAccidentQuietPeriod(), 64); err == nil && f > 0 {
+		v.Quiet = time.Duration(f * float64(time.Second))
+	}
+	if f, err := strconv.ParseFloat(envAccidentPreroll(), 64); err == nil && f >= 0 {
+		v.Preroll = f
+	}
+	if f, err := strconv.ParseFloat(envAccidentPostroll(), 64); err == nil && f >= 0 {
+		v.Postroll = f
+	}
+	return v
+}
+
+// AccidentHit is a segment to append to accident.
+type AccidentHit struct {
+	// The ts file of segment.
+	TsFile *TsFile
+	// The best detection in segment, nil if not detected, for example, the pre-roll or post-roll.
+	DetectResult *ProcessDetectResult
+	// The frame of the best detection, nil if not detected.
+	Image *AccidentImage
+}
+
+// AccidentEvent is the changes of tracker by a segment.
+type AccidentEvent struct {
+	// Whether the active accident is ended, before this segment.
+	Ended bool
+	// Whether the accident is confirmed by this segment.
+	Confirmed bool
+	// The segments to append to accident.
+	Hits []*AccidentHit
+}
+
+// AccidentTracker is the state machine of a category for a stream. It's idle until the accident is
+// confirmed by enough detections in the window, then it's active until not detected for a quiet period.
+type AccidentTracker struct {
+	// The stream name.
+	Stream string
+	// The category of accident.
+	Category int
+
+	// The latest segments, at most policy.Window segments.
+	window []*AccidentHit
+	// Whether accident is confirmed and active.
+	active bool
+	// The last time detected, when active.
+	detected time.Time
+	// The duration in seconds of segments appended after the last detection.
+	postroll float64
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewAccidentTracker(stream string, category int) *AccidentTracker {
+	return &AccidentTracker{Stream: stream, Category: category}
+}
+
+func (v *AccidentTracker) String() string {
+	return fmt.Sprintf("stream=%v, category=%v, window=%v, active=%v, detected=%v, postroll=%v",
+		v.Stream, v.Category, len(v.window), v.active, v.detected.Format(time.RFC3339), v.postroll,
+	)
+}
+
+// Reset the tracker when stream is unpublished, return whether there is an active accident to end.
+func (v *AccidentTracker) Reset() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	active := v.active
+	v.active, v.window, v.postroll = false, nil, 0
+	return active
+}
+
+// OnSegment feed a segment with the best detection of category and its frame, which are nil if not
+// detected. When confirmed, the event has the segments in window since the first detection, and the last
+// one triggers the accident. When active, the event has the detected segment, or the post-roll segment
+// after the last detection.
+func (v *AccidentTracker) OnSegment(ctx context.Context, policy *AccidentPolicy, tsFile *TsFile, result *ProcessDetectResult, image *AccidentImage) *AccidentEvent {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	event := &AccidentEvent{}
+
+	// End the accident if quiet for a while.
+	if v.active && now.Sub(v.detected) > policy.Quiet {
+		logger.Tf(ctx, "accident tracker end, %v, policy is %v", v.String(), policy.String())
+		v.active, v.window, event.Ended = false, nil, true
+	}
+
+	// Keep appending segments when active.
+	if v.active {
+		if result != nil {
+			v.detected, v.postroll = now, 0
+			event.Hits = []*AccidentHit{{TsFile: tsFile, DetectResult: result, Image: image}}
+		} else if v.postroll < policy.Postroll {
+			v.postroll += tsFile.Duration
+			event.Hits = []*AccidentHit{{TsFile: tsFile}}
+		}
+		return event
+	}
+
+	// Slide the window, and confirm the accident when enough detections.
+	v.window = append(v.window, &AccidentHit{TsFile: tsFile, DetectResult: result, Image: image})
+	if len(v.window) > policy.Window {
+		v.window = v.window[len(v.window)-policy.Window:]
+	}
+
+	first, hits := -1, 0
+	for i, hit := range v.window {
+		if hit.DetectResult != nil {
+			if first < 0 {
+				first = i
+			}
+			hits++
+		}
+	}
+	if hits < policy.Hits {
+		return event
+	}
+
+	// Note that the segments between detections are also appended, to make the accident continuous.
+	event.Confirmed, event.Hits = true, v.window[first:]
+	v.active, v.detected, v.postroll, v.window = true, now, 0, nil
+	logger.Tf(ctx, "accident tracker confirm, %v, hits=%v, policy is %v", v.String(), hits, policy.String())
+	return event
+}
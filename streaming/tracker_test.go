@@ -0,0 +1,168 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccidentTrackerOnSegment(t *testing.T) {
+	// The step feeds a segment of 2s, detected or not, after sleeping. The tracker is reset instead if reset,
+	// which returns whether active.
+	type step struct {
+		detected  bool
+		sleep     time.Duration
+		reset     bool
+		active    bool
+		ended     bool
+		confirmed bool
+		hits      int
+	}
+
+	for _, c := range []struct {
+		name   string
+		policy AccidentPolicy
+		steps  []step
+	}{
+		{
+			name:   "confirm in window",
+			policy: AccidentPolicy{Hits: 2, Window: 3, Quiet: time.Hour},
+			steps: []step{
+				{detected: true},
+				{},
+				{detected: true, confirmed: true, hits: 3},
+			},
+		},
+		{
+			name:   "slide out of window",
+			policy: AccidentPolicy{Hits: 2, Window: 2, Quiet: time.Hour},
+			steps: []step{
+				{detected: true},
+				{},
+				{detected: true},
+				{detected: true, confirmed: true, hits: 2},
+			},
+		},
+		{
+			name:   "drop leading misses",
+			policy: AccidentPolicy{Hits: 2, Window: 4, Quiet: time.Hour},
+			steps: []step{
+				{},
+				{detected: true},
+				{},
+				{detected: true, confirmed: true, hits: 3},
+			},
+		},
+		{
+			name:   "postroll after last detection",
+			policy: AccidentPolicy{Hits: 1, Window: 1, Quiet: time.Hour, Postroll: 4},
+			steps: []step{
+				{detected: true, confirmed: true, hits: 1},
+				{hits: 1},
+				{hits: 1},
+				{},
+				{detected: true, hits: 1},
+				{hits: 1},
+			},
+		},
+		{
+			name:   "end by quiet",
+			policy: AccidentPolicy{Hits: 2, Window: 2, Quiet: 10 * time.Millisecond, Postroll: 4},
+			steps: []step{
+				{detected: true},
+				{detected: true, confirmed: true, hits: 2},
+				{sleep: 20 * time.Millisecond, ended: true},
+				{detected: true},
+				{detected: true, confirmed: true, hits: 2},
+			},
+		},
+		{
+			name:   "end and confirm again",
+			policy: AccidentPolicy{Hits: 1, Window: 1, Quiet: 10 * time.Millisecond},
+			steps: []step{
+				{detected: true, confirmed: true, hits: 1},
+				{detected: true, sleep: 20 * time.Millisecond, ended: true, confirmed: true, hits: 1},
+			},
+		},
+		{
+			name:   "reset by unpublish",
+			policy: AccidentPolicy{Hits: 2, Window: 2, Quiet: time.Hour},
+			steps: []step{
+				{detected: true},
+				{reset: true},
+				{detected: true},
+				{detected: true, confirmed: true, hits: 2},
+				{reset: true, active: true},
+				{reset: true},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			tracker := NewAccidentTracker("livestream", 1)
+			for i, s := range c.steps {
+				if s.reset {
+					if active := tracker.Reset(); active != s.active {
+						t.Fatalf("step %v: expect active %v, got %v", i, s.active, active)
+					}
+					continue
+				}
+
+				time.Sleep(s.sleep)
+
+				tsFile := &TsFile{TsID: fmt.Sprint(i), Duration: 2}
+				var result *ProcessDetectResult
+				if s.detected {
+					result = &ProcessDetectResult{Score: 0.9, Category: 1}
+				}
+
+				event := tracker.OnSegment(ctx, &c.policy, tsFile, result, nil)
+				if event.Ended != s.ended || event.Confirmed != s.confirmed || len(event.Hits) != s.hits {
+					t.Fatalf("step %v: expect ended=%v, confirmed=%v, hits=%v, got ended=%v, confirmed=%v, hits=%v",
+						i, s.ended, s.confirmed, s.hits, event.Ended, event.Confirmed, len(event.Hits))
+				}
+				if s.confirmed && event.Hits[len(event.Hits)-1].TsFile != tsFile {
+					t.Fatalf("step %v: expect the last hit is the confirming segment", i)
+				}
+			}
+		})
+	}
+}
+
+func TestAccidentWorkerOnStreamUnpublished(t *testing.T) {
+	// The stream is published again before the teardown of generation 1, so only generation 0 and 1 are
+	// dropped, while the trackers and rings of generation 2 and other streams are kept.
+	v := NewAccidentWorker()
+	for _, key := range []accidentKey{
+		{stream: "livestream", generation: 0}, {stream: "livestream", generation: 1},
+		{stream: "livestream", generation: 2}, {stream: "other", generation: 1},
+	} {
+		v.rings.Store(key, NewSegmentRing(10))
+		key.category = 1
+		v.trackers.Store(key, NewAccidentTracker(key.stream, key.category))
+	}
+
+	if err := v.OnStreamUnpublished(context.Background(), &SrsStream{Stream: "livestream"}, 1); err != nil {
+		t.Fatalf("unpublish err %+v", err)
+	}
+
+	for name, m := range map[string]*sync.Map{"rings": &v.rings, "trackers": &v.trackers} {
+		var keys []string
+		m.Range(func(key, value interface{}) bool {
+			k := key.(accidentKey)
+			keys = append(keys, fmt.Sprintf("%v/%v", k.stream, k.generation))
+			return true
+		})
+		sort.Strings(keys)
+		if expect := []string{"livestream/2", "other/1"}; !reflect.DeepEqual(keys, expect) {
+			t.Errorf("%v expect %v, got %v", name, expect, keys)
+		}
+	}
+}
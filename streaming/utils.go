@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -18,11 +20,6 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-type Category struct {
-	ID     int
-	Type string
-}
-
 type Config struct {
 	IsDarwin bool
 	// Current working directory, at xxx/oryx/platform.
@@ -48,8 +45,6 @@ const (
 	SRS_STREAM_ACTIVE     = "SRS_STREAM_ACTIVE"
 	SRS_STREAM_SRT_ACTIVE = "SRS_STREAM_SRT_ACTIVE"
 	SRS_STREAM_RTC_ACTIVE = "SRS_STREAM_RTC_ACTIVE"
-	// For feature statistics.
-	SRS_STAT_COUNTER = "SRS_STAT_COUNTER"
 	// For container and images.
 	SRS_CONTAINER_DISABLED = "SRS_CONTAINER_DISABLED"
 	// For live stream and rooms.
@@ -65,9 +60,25 @@ const (
 	
 	RECORD_M3U8_ARTIFACT = "RECORD_M3U8_ARTIFACT"
 	PROCESS_TASK = "PROCESS_TASK"
+	// The priority class of stream, such as high, normal or low, to schedule the jobs.
+	PROCESS_STREAM_PRIORITY = "PROCESS_STREAM_PRIORITY"
 	PROCESS_STREAM_WORKING = "PROCESS_STREAM_WORKING"
 	SRS_ACCIDENT_M3U8_WORKING = "SRS_ACCIDENT_M3U8_WORKING"
 	SRS_ACCIDENT_M3U8_ARTIFACT = "SRS_ACCIDENT_M3U8_ARTIFACT"
+	// For callbacks to API server, the pending messages, the schedule of delivery, and the dead letters.
+	CALLBACK_OUTBOX          = "CALLBACK_OUTBOX"
+	CALLBACK_OUTBOX_SCHEDULE = "CALLBACK_OUTBOX_SCHEDULE"
+	CALLBACK_OUTBOX_DEAD     = "CALLBACK_OUTBOX_DEAD"
+	// The accident id of accident uuid, responded by API server.
+	SRS_ACCIDENT_ID = "SRS_ACCIDENT_ID"
+	// For multipart upload of object storage, to resume the uploaded parts.
+	S3_MULTIPART_UPLOAD = "S3_MULTIPART_UPLOAD"
+	// For accident categories of model.
+	SRS_ACCIDENT_CATEGORY = "SRS_ACCIDENT_CATEGORY"
+	// For detector config of streams.
+	PROCESS_DETECTOR = "PROCESS_DETECTOR"
+	// The reference count of files in segment store.
+	SEGMENT_STORE_REFS = "SEGMENT_STORE_REFS"
 )
 
 // GenerateRoomPublishKey to build the redis hashset key from room stream name.
@@ -135,6 +146,216 @@ func envGoPprof() string {
 	return os.Getenv("GO_PPROF")
 }
 
+func envDetectorType() string {
+	return os.Getenv("DETECTOR_TYPE")
+}
+
+func envDetectorURL() string {
+	return os.Getenv("DETECTOR_URL")
+}
+
+func envDetectorCommand() string {
+	return os.Getenv("DETECTOR_COMMAND")
+}
+
+func envDetectorArgs() string {
+	return os.Getenv("DETECTOR_ARGS")
+}
+
+func envProcessFrames() string {
+	return os.Getenv("PROCESS_FRAMES")
+}
+
+func envProcessFrameMode() string {
+	return os.Getenv("PROCESS_FRAME_MODE")
+}
+
+func envProcessFrameAggregate() string {
+	return os.Getenv("PROCESS_FRAME_AGGREGATE")
+}
+
+func envAccidentConfirmHits() string {
+	return os.Getenv("ACCIDENT_CONFIRM_HITS")
+}
+
+func envAccidentConfirmWindow() string {
+	return os.Getenv("ACCIDENT_CONFIRM_WINDOW")
+}
+
+func envAccidentMinScore() string {
+	return os.Getenv("ACCIDENT_MIN_SCORE")
+}
+
+func envAccidentQuietPeriod() string {
+	return os.Getenv("ACCIDENT_QUIET_PERIOD")
+}
+
+func envAccidentPreroll() string {
+	return os.Getenv("ACCIDENT_PREROLL")
+}
+
+func envAccidentPostroll() string {
+	return os.Getenv("ACCIDENT_POSTROLL")
+}
+
+func envProcessLatencyBudget() string {
+	return os.Getenv("PROCESS_LATENCY_BUDGET")
+}
+
+func envProcessAnnotate() string {
+	return os.Getenv("PROCESS_ANNOTATE")
+}
+
+func envProcessAnnotateFont() string {
+	return os.Getenv("PROCESS_ANNOTATE_FONT")
+}
+
+func envJanitorInterval() string {
+	return os.Getenv("JANITOR_INTERVAL")
+}
+
+func envJanitorDetectMaxAge() string {
+	return os.Getenv("JANITOR_DETECT_MAX_AGE")
+}
+
+func envJanitorDetectMaxBytes() string {
+	return os.Getenv("JANITOR_DETECT_MAX_BYTES")
+}
+
+func envJanitorProcessMaxAge() string {
+	return os.Getenv("JANITOR_PROCESS_MAX_AGE")
+}
+
+func envJanitorProcessMaxBytes() string {
+	return os.Getenv("JANITOR_PROCESS_MAX_BYTES")
+}
+
+func envJanitorAccidentMaxAge() string {
+	return os.Getenv("JANITOR_ACCIDENT_MAX_AGE")
+}
+
+func envJanitorAccidentMaxBytes() string {
+	return os.Getenv("JANITOR_ACCIDENT_MAX_BYTES")
+}
+
+func envJanitorAccidentKeep() string {
+	return os.Getenv("JANITOR_ACCIDENT_KEEP")
+}
+
+func envApiBaseUrl() string {
+	return os.Getenv("API_BASE_URL")
+}
+
+func envCallbackMaxAttempts() string {
+	return os.Getenv("CALLBACK_MAX_ATTEMPTS")
+}
+
+func envSrsHookSecret() string {
+	return os.Getenv("SRS_HOOK_SECRET")
+}
+
+func envSrsHlsRoot() string {
+	return os.Getenv("SRS_HLS_ROOT")
+}
+
+func envCallbackSecret() string {
+	return os.Getenv("CALLBACK_SECRET")
+}
+
+func envPlaybackToken() string {
+	return os.Getenv("PLAYBACK_TOKEN")
+}
+
+func envPlaybackSecret() string {
+	return os.Getenv("PLAYBACK_SECRET")
+}
+
+func envPlaybackTokenTTL() string {
+	return os.Getenv("PLAYBACK_TOKEN_TTL")
+}
+
+func envSrsApiUrl() string {
+	return os.Getenv("SRS_API_URL")
+}
+
+func envSrsReconcileInterval() string {
+	return os.Getenv("SRS_RECONCILE_INTERVAL")
+}
+
+func envSrsReconcileGrace() string {
+	return os.Getenv("SRS_RECONCILE_GRACE")
+}
+
+func envSchedulerFFmpeg() string {
+	return os.Getenv("SCHEDULER_FFMPEG")
+}
+
+func envSchedulerDetector() string {
+	return os.Getenv("SCHEDULER_DETECTOR")
+}
+
+func envSchedulerFFprobe() string {
+	return os.Getenv("SCHEDULER_FFPROBE")
+}
+
+func envS3Endpoint() string {
+	return os.Getenv("S3_ENDPOINT")
+}
+
+func envS3Region() string {
+	return os.Getenv("S3_REGION")
+}
+
+func envS3Bucket() string {
+	return os.Getenv("S3_BUCKET")
+}
+
+func envS3AccessKey() string {
+	return os.Getenv("S3_ACCESS_KEY")
+}
+
+func envS3SecretKey() string {
+	return os.Getenv("S3_SECRET_KEY")
+}
+
+func envS3PathStyle() string {
+	return os.Getenv("S3_PATH_STYLE")
+}
+
+func envS3Prefix() string {
+	return os.Getenv("S3_PREFIX")
+}
+
+func envS3PublicUrl() string {
+	return os.Getenv("S3_PUBLIC_URL")
+}
+
+func envS3PresignExpires() string {
+	return os.Getenv("S3_PRESIGN_EXPIRES")
+}
+
+func envS3PartSize() string {
+	return os.Getenv("S3_PART_SIZE")
+}
+
+func envS3Retries() string {
+	return os.Getenv("S3_RETRIES")
+}
+
+// authenticateAdmin verify the bearer token of management API by API_SECRET, reject if no secret.
+func authenticateAdmin(r *http.Request) error {
+	secret := envApiSecret()
+	if secret == "" {
+		return errors.Errorf("no secret to verify %v", r.URL.Path)
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.Errorf("invalid token for %v", r.URL.Path)
+	}
+	return nil
+}
+
 // setEnvDefault set env key=value if not set.
 func setEnvDefault(key, value string) {
 	if os.Getenv(key) == "" {
@@ -161,7 +382,7 @@ func InitRdb() error {
 
 // buildLiveM3u8ForLocal go generate dynamic m3u8.
 func buildLiveM3u8ForLocal(
-	ctx context.Context, tsFiles []*TsFile, useKey bool, prefix string, metadata []string,
+	ctx context.Context, tsFiles []*TsFile, useKey bool, prefix string, metadata, skipped []string,
 ) (
 	contentType, m3u8Body string, duration float64, err error,
 ) {
@@ -184,13 +405,22 @@ func buildLiveM3u8ForLocal(
 	}
 	for index, file := range tsFiles {
 		// TODO: FIXME: Identify discontinuity by callback.
-		if index < len(tsFiles)-2 {
+		if file.Discontinuity {
+			m3u8 = append(m3u8, "#EXT-X-DISCONTINUITY")
+		} else if index < len(tsFiles)-2 {
 			next := tsFiles[index+1]
 			if file.SeqNo+1 != next.SeqNo {
 				m3u8 = append(m3u8, "#EXT-X-DISCONTINUITY")
 			}
 		}
-		m3u8 = append(m3u8, fmt.Sprintf("#BOUNDING-BOX:%v", metadata[index]))
+		// Keep the legacy tag for old clients, see master.m3u8 for the WebVTT of detections.
+		if index < len(metadata) {
+			m3u8 = append(m3u8, fmt.Sprintf("#BOUNDING-BOX:%v", metadata[index]))
+		}
+		// Mark the segment not analysed by load shedding, with the reason.
+		if index < len(skipped) && skipped[index] != "" {
+			m3u8 = append(m3u8, fmt.Sprintf("#NOT-ANALYSED:%v", skipped[index]))
+		}
 
 		m3u8 = append(m3u8, fmt.Sprintf("#EXTINF:%.2f, no desc", file.Duration))
 
@@ -239,6 +469,19 @@ type TsFile struct {
 	Duration float64 `json:"duration,omitempty"`
 	// The size of TS file in bytes, such as 1934897
 	Size uint64 `json:"size,omitempty"`
+	// Whether the TS is the first one of a new publish, so there is a discontinuity before it.
+	Discontinuity bool `json:"discontinuity,omitempty"`
+
+	// The start and end PTS of TS in seconds, parsed by demuxer, such as 10.08 and 19.44
+	Start float64 `json:"start,omitempty"`
+	End   float64 `json:"end,omitempty"`
+	// The offsets in seconds from start of the keyframes, parsed by demuxer.
+	Keyframes []float64 `json:"keyframes,omitempty"`
+	// The codec of video, parsed by demuxer, such as h264 or hevc. Empty if not demuxed.
+	Codec string `json:"codec,omitempty"`
+	// The resolution of video, parsed from SPS by demuxer, such as 1920x1080
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
 }
 
 func (v *TsFile) String() string {
@@ -269,6 +512,9 @@ type SrsOnHlsMessage struct {
 
 	// The TS url, generated by SRS, such as live/livestream/2015-04-23/01/476584165.ts
 	URL string `json:"url,omitempty"`
+
+	// The publish generation of stream when got the message, to drop the message of previous publish.
+	generation uint64
 }
 
 func (v *SrsOnHlsMessage) String() string {
@@ -472,6 +718,12 @@ type M3u8VoDArtifact struct {
 	App string `json:"app"`
 	// The name of stream, generated by SRS, such as livestream
 	Stream string `json:"stream"`
+	// The category of accident, such as 7.
+	Category int `json:"category,omitempty"`
+	// The accident id from API server.
+	AccidentId int `json:"accidentId,omitempty"`
+	// The create time.
+	Create string `json:"create,omitempty"`
 
 	// TODO: FIXME: It's a typo progress.
 	// The Record is processing, use local m3u8 address to preview or download.
@@ -479,13 +731,15 @@ type M3u8VoDArtifact struct {
 	// The done time.
 	Done string `json:"done"`
 	// The ts files of this m3u8.
-	Files []*TsFile `json:"files"`
+	Files []*TsFile `json:"files,omitempty"`
 
 	// For DVR only.
-	// The COS bucket name.
+	// The bucket name of object storage.
 	Bucket string `json:"bucket"`
-	// The COS bucket region.
+	// The bucket region of object storage.
 	Region string `json:"region"`
+	// The uploaded object keys, such as accident/3ECF0239-708C-42E4-96E1-5AE935C6E6A9/index.mp4
+	Keys []string `json:"keys,omitempty"`
 
 	// For VoD only.
 	// The file ID generated by VoD commit.
@@ -495,6 +749,24 @@ type M3u8VoDArtifact struct {
 	Definition uint64 `json:"definition"`
 	TaskID     string `json:"taskId"`
 }
+// fixup the fields of artifact saved by previous version, which has no category or create time.
+func (v *M3u8VoDArtifact) fixup() {
+	// The m3u8 url of accident is stream/category.
+	if v.Category == 0 {
+		if index := strings.LastIndex(v.M3u8URL, "/"); index >= 0 {
+			v.Category, _ = strconv.Atoi(v.M3u8URL[index+1:])
+		}
+	}
+	if v.Stream == "" {
+		if index := strings.LastIndex(v.M3u8URL, "/"); index >= 0 {
+			v.Stream = v.M3u8URL[:index]
+		}
+	}
+	if v.Create == "" {
+		v.Create = v.Update
+	}
+}
+
 func (v *M3u8VoDArtifact) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("uuid=%v, done=%v, update=%v, processing=%v, files=%v",
@@ -532,8 +804,11 @@ func buildVodM3u8ForLocal(
 		return
 	}
 
+	// Note that the target duration is the max duration of segments, not the total duration.
+	var targetDuration float64
 	for _, file := range tsFiles {
 		duration += file.Duration
+		targetDuration = math.Max(targetDuration, file.Duration)
 	}
 
 	m3u8 := []string{
@@ -541,16 +816,14 @@ func buildVodM3u8ForLocal(
 		"#EXT-X-VERSION:3",
 		"#EXT-X-ALLOW-CACHE:YES",
 		"#EXT-X-PLAYLIST-TYPE:VOD",
-		fmt.Sprintf("#EXT-X-TARGETDURATION:%v", math.Ceil(duration)),
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%v", math.Ceil(targetDuration)),
 		"#EXT-X-MEDIA-SEQUENCE:0",
 	}
 	for index, file := range tsFiles {
 		// TODO: FIXME: Identify discontinuity by callback.
-		if index < len(tsFiles)-2 {
-			next := tsFiles[index+1]
-			if file.SeqNo+1 != next.SeqNo {
-				m3u8 = append(m3u8, "#EXT-X-DISCONTINUITY")
-			}
+		// Note that the discontinuity tag is before the first segment after the gap.
+		if index > 0 && (file.Discontinuity || tsFiles[index-1].SeqNo+1 != file.SeqNo) {
+			m3u8 = append(m3u8, "#EXT-X-DISCONTINUITY")
 		}
 
 		m3u8 = append(m3u8, fmt.Sprintf("#EXTINF:%.2f, no desc", file.Duration))
@@ -568,4 +841,23 @@ func buildVodM3u8ForLocal(
 	contentType = "application/vnd.apple.mpegurl"
 	m3u8Body = strings.Join(m3u8, "\n")
 	return
+}
+
+// writeConcatList write the ts files to a list for the concat demuxer of ffmpeg, in absolute path, because
+// the files are in segment store.
+func writeConcatList(list string, tsFiles []*TsFile) error {
+	var sb strings.Builder
+	sb.WriteString("ffconcat version 1.0\n")
+	for _, tsFile := range tsFiles {
+		file, err := filepath.Abs(tsFile.Key)
+		if err != nil {
+			return errors.Wrapf(err, "abs %v", tsFile.Key)
+		}
+		sb.WriteString(fmt.Sprintf("file '%v'\n", strings.ReplaceAll(file, "'", `'\''`)))
+	}
+
+	if err := os.WriteFile(list, []byte(sb.String()), 0644); err != nil {
+		return errors.Wrapf(err, "write %v", list)
+	}
+	return nil
 }
\ No newline at end of file
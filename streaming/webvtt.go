@@ -0,0 +1,153 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The group id of detections rendition in master playlist.
+const webvttGroupID = "detections"
+
+// WebVTTCue is the payload of a cue, which is a JSON array of boxes in a line.
+type WebVTTCue struct {
+	// The category id of model.
+	Category int `json:"category_id"`
+	// The accident type of category, such as FALL.
+	Type string `json:"type,omitempty"`
+	// The score of detection.
+	Score float64 `json:"score"`
+	// The box in [x, y, width, height] of a 640x640 image.
+	BBox []float64 `json:"bbox"`
+}
+
+// buildMasterM3u8 build the master playlist, which references the video playlist and the detections
+// rendition, so the player is able to load the detections in sync with video.
+func buildMasterM3u8(tsFiles []*TsFile, videoURL, metadataURL string) (contentType, m3u8Body string) {
+	// The bandwidth is required by EXT-X-STREAM-INF, estimate by the size of segments.
+	var size, duration float64
+	for _, file := range tsFiles {
+		size, duration = size+float64(file.Size), duration+file.Duration
+	}
+	bandwidth := 1000000
+	if duration > 0 && size > 0 {
+		bandwidth = int(size * 8 / duration)
+	}
+
+	m3u8 := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="%v",NAME="Detections",LANGUAGE="und",DEFAULT=YES,AUTOSELECT=YES,FORCED=NO,URI="%v"`,
+			webvttGroupID, metadataURL,
+		),
+		fmt.Sprintf(`#EXT-X-STREAM-INF:BANDWIDTH=%v,SUBTITLES="%v"`, bandwidth, webvttGroupID),
+		videoURL,
+	}
+
+	contentType = "application/vnd.apple.mpegurl"
+	m3u8Body = strings.Join(m3u8, "\n")
+	return
+}
+
+// buildWebVTTM3u8 build the subtitles playlist of detections, each WebVTT file has the same sequence
+// and duration as the ts file, so the cues match the segments.
+func buildWebVTTM3u8(tsFiles []*TsFile, prefix string) (contentType, m3u8Body string, err error) {
+	if len(tsFiles) == 0 {
+		err = errors.Errorf("no files")
+		return
+	}
+
+	var duration float64
+	for _, file := range tsFiles {
+		duration = math.Max(duration, file.Duration)
+	}
+
+	m3u8 := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%v", tsFiles[0].SeqNo),
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%v", math.Ceil(duration)),
+	}
+	for index, file := range tsFiles {
+		if file.Discontinuity || (index > 0 && tsFiles[index-1].SeqNo+1 != file.SeqNo) {
+			m3u8 = append(m3u8, "#EXT-X-DISCONTINUITY")
+		}
+		m3u8 = append(m3u8, fmt.Sprintf("#EXTINF:%.2f, no desc", file.Duration))
+		m3u8 = append(m3u8, fmt.Sprintf("%v%v.vtt", prefix, file.TsID))
+	}
+
+	contentType = "application/vnd.apple.mpegurl"
+	m3u8Body = strings.Join(m3u8, "\n")
+	return
+}
+
+// buildWebVTT build the WebVTT of segment, a cue for each frame which has detections, from the offset
+// of frame to the next frame. The X-TIMESTAMP-MAP maps the start of segment to its MPEG-TS timestamp,
+// so the cue time is relative to the segment.
+func buildWebVTT(segment *ProcessSegment) (contentType, body string, err error) {
+	// The MPEG-TS timestamp is in 90kHz and 33 bits.
+	mpegts := int64(segment.StreamStarttime.Seconds()*90000) % (int64(1) << 33)
+
+	lines := []string{
+		"WEBVTT",
+		fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%v,LOCAL:00:00:00.000", mpegts),
+	}
+
+	frames := segment.Frames
+	if len(frames) == 0 {
+		frames = []*ProcessFrame{{BoundingBox: segment.BoundingBox}}
+	}
+
+	for i, frame := range frames {
+		if len(frame.BoundingBox) == 0 {
+			continue
+		}
+
+		start, end := frame.Offset, segment.TsFile.Duration
+		if i < len(frames)-1 {
+			end = frames[i+1].Offset
+		}
+		if end <= start {
+			continue
+		}
+
+		var cues []WebVTTCue
+		for _, box := range frame.BoundingBox {
+			cue := WebVTTCue{Category: box.Category, Score: box.Score, BBox: box.BBox}
+			if c := categoryRegistry.Query(box.Category); c != nil {
+				cue.Type = c.Type
+			}
+			cues = append(cues, cue)
+		}
+
+		b, err := json.Marshal(cues)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "marshal %v", cues)
+		}
+
+		lines = append(lines, "",
+			fmt.Sprintf("%v --> %v", formatWebVTTTime(start), formatWebVTTTime(end)),
+			string(b),
+		)
+	}
+
+	contentType = "text/vtt"
+	body = strings.Join(lines, "\n") + "\n"
+	return
+}
+
+// formatWebVTTTime format the seconds as hh:mm:ss.ttt of WebVTT.
+func formatWebVTTTime(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	h, d := d/time.Hour, d%time.Hour
+	m, d := d/time.Minute, d%time.Minute
+	s, d := d/time.Second, d%time.Second
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, d/time.Millisecond)
+}